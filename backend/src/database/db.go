@@ -1,7 +1,9 @@
 package database
 
 import (
+	"errors"
 	"fmt"
+	"github.com/jackc/pgconn"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -16,6 +18,12 @@ import (
 // DB is a global db connection to be shared
 var DB *gorm.DB
 
+// IsUniqueViolation checks if an error is from a row breaking a unique constraint
+func IsUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
 // checkExists checks if a value exists and fails if it doesn't
 func checkExists(exists bool, msg string) {
 	if !exists {
@@ -127,6 +135,10 @@ func createPerms() {
 			Name:        "view_logs",
 			Description: "Allows a user to view a history of web server logs",
 		},
+		{
+			Name:        "manage_ban_lists",
+			Description: "Enables creating and deleting shared ban lists and the bans on them",
+		},
 	}
 
 	// Server Permissions
@@ -163,6 +175,14 @@ func createPerms() {
 			Name:        "manage_server_console",
 			Description: "Enables attaching to the server console directly in order to run commands. Note, this will make you a server operator as well on games that have support for that",
 		},
+		{
+			Name:        "manage_backups",
+			Description: "Enables creating, downloading, deleting and restoring backups of the server, and changing its backup schedule",
+		},
+		{
+			Name:        "container_shell",
+			Description: "Enables opening a shell inside the server container. Note, this is not part of administrator and has to be given on its own",
+		},
 	}
 
 	// Upsert into table permissions
@@ -249,11 +269,34 @@ func MakeDB() {
 		&PermsPerUser{},
 		&ServerPermsPerUser{},
 		&UserPlayer{},
+		&UserKey{},
+		&PlayerLinkCode{},
+		&SyncedPlayer{},
+		&ModerationAction{},
+		&BanList{},
+		&BanListServer{},
+		&Ban{},
+		&CommandRule{},
 		&ServerLog{},
+		&ConsoleRecording{},
+		&ShellSession{},
+		&BackupTarget{},
+		&Backup{},
+		&BackupSchedule{},
+		&BackupJob{},
+		&Alert{},
 		&PlayerLog{},
 		&WebLog{},
 	)
 
+	// Player names used to be unique, but names can change hands so they are keyed by UUID now
+	if DB.Migrator().HasConstraint(&Player{}, "players_name_key") {
+		DB.Migrator().DropConstraint(&Player{}, "players_name_key")
+	}
+
+	// Commands used to only come from players, now they can come from users and msmf too
+	DB.Exec("ALTER TABLE server_logs ALTER COLUMN player_id DROP NOT NULL")
+
 	// Create base permissions
 	createPerms()
 
@@ -271,7 +314,22 @@ func DropTables() {
 	DB.Migrator().DropTable(&PermsPerUser{})
 	DB.Migrator().DropTable(&ServerPermsPerUser{})
 	DB.Migrator().DropTable(&UserPlayer{})
+	DB.Migrator().DropTable(&UserKey{})
+	DB.Migrator().DropTable(&PlayerLinkCode{})
+	DB.Migrator().DropTable(&SyncedPlayer{})
+	DB.Migrator().DropTable(&ModerationAction{})
+	DB.Migrator().DropTable(&Ban{})
+	DB.Migrator().DropTable(&CommandRule{})
+	DB.Migrator().DropTable(&BanListServer{})
+	DB.Migrator().DropTable(&BanList{})
 	DB.Migrator().DropTable(&ServerLog{})
+	DB.Migrator().DropTable(&ConsoleRecording{})
+	DB.Migrator().DropTable(&ShellSession{})
+	DB.Migrator().DropTable(&BackupJob{})
+	DB.Migrator().DropTable(&Backup{})
+	DB.Migrator().DropTable(&BackupSchedule{})
+	DB.Migrator().DropTable(&BackupTarget{})
+	DB.Migrator().DropTable(&Alert{})
 	DB.Migrator().DropTable(&PlayerLog{})
 	DB.Migrator().DropTable(&WebLog{})
 	DB.Migrator().DropTable(&ServerPerm{})
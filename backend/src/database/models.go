@@ -43,6 +43,11 @@ type Server struct {
 	Owner     User    `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"owner"`
 	VersionID *int    `json:"-"`
 	Version   Version `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:SET NULL" json:"version"`
+	// Encrypted with the portal secret key since it has to be read back to connect
+	RconPassword []byte `gorm:"type: bytea" json:"-"`
+
+	// Whether msmf keeps the whitelist and operators in line with portal permissions
+	ManagePlayers bool `gorm:"type: bool; default: false" json:"manage_players"`
 }
 
 // ServerPerm Model
@@ -78,10 +83,12 @@ type Referrer struct {
 	User       User      `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"user"`
 }
 
-// Player Model
+// Player Model. Names can change, so players are keyed by UUID
 type Player struct {
-	ID   *int   `gorm:"primaryKey; type:serial" json:"-"`
-	Name string `gorm:"type: varchar(64) not null unique" json:"name"`
+	ID       *int      `gorm:"primaryKey; type:serial" json:"-"`
+	UUID     string    `gorm:"type: varchar(36) unique" json:"uuid"`
+	Name     string    `gorm:"type: varchar(64) not null; index" json:"name"`
+	LastSeen time.Time `json:"last_seen"`
 }
 
 // ModsPerServer Model. Foriegn Key table
@@ -112,6 +119,17 @@ type ServerPermsPerUser struct {
 	User         User       `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"user"`
 }
 
+// UserKey Model. SSH public keys a user can log in to server consoles with
+type UserKey struct {
+	ID          *int      `gorm:"primaryKey; type:serial" json:"id"`
+	UserID      int       `gorm:"not null; index" json:"-"`
+	User        User      `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"-"`
+	Name        string    `gorm:"type: varchar(64)" json:"name"`
+	Key         string    `gorm:"type: text not null" json:"key"`
+	Fingerprint string    `gorm:"type: varchar(64) not null unique" json:"fingerprint"`
+	Created     time.Time `gorm:"type: timestamp not null" json:"created"`
+}
+
 // UserPlayer Model. Foriegn Key table
 type UserPlayer struct {
 	UserID   int    `gorm:"not null; index:user_player,unique" json:"-"`
@@ -120,15 +138,236 @@ type UserPlayer struct {
 	Player   Player `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"player"`
 }
 
-// ServerLog Model
-type ServerLog struct {
+// SyncedPlayer Model. Players msmf put on a server's whitelist or operator list, so it
+// knows which ones it is allowed to take off again
+type SyncedPlayer struct {
+	ServerID    int    `gorm:"not null; index:synced_player,unique" json:"server_id"`
+	Server      Server `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"-"`
+	PlayerID    int    `gorm:"not null; index:synced_player,unique" json:"player_id"`
+	Player      Player `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"player"`
+	Whitelisted bool   `gorm:"type: bool not null" json:"whitelisted"`
+	Opped       bool   `gorm:"type: bool not null" json:"opped"`
+}
+
+// PlayerLinkCode Model. Codes a user types in game to prove they own a player
+type PlayerLinkCode struct {
+	Code       string    `gorm:"type: varchar(16); primaryKey" json:"code"`
+	Expiration time.Time `gorm:"not null" json:"expiration"`
+	UserID     *int      `gorm:"not null" json:"-"`
+	User       User      `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"-"`
+}
+
+// ModerationAction Model. Moderation done to players through the portal
+type ModerationAction struct {
 	ID       *int      `gorm:"primaryKey; type:serial" json:"id"`
 	Time     time.Time `gorm:"type: timestamp not null" json:"time"`
+	Action   string    `gorm:"type: varchar(32) not null" json:"action"`
+	Target   string    `gorm:"type: varchar(64) not null" json:"target"`
+	Reason   string    `gorm:"type: text" json:"reason"`
+	Response string    `gorm:"type: text" json:"response"`
+	ServerID *int      `gorm:"not null" json:"server_id"`
+	Server   Server    `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"-"`
+	UserID   *int      `json:"-"`
+	User     User      `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:SET NULL" json:"user"`
+}
+
+// BanList Model. A named group of bans shared by every server subscribed to it
+type BanList struct {
+	ID          *int   `gorm:"primaryKey; type:serial" json:"id"`
+	Name        string `gorm:"type: varchar(64) not null unique" json:"name"`
+	Description string `gorm:"type: text" json:"description"`
+}
+
+// BanListServer Model. Foriegn Key table of the servers subscribed to each ban list
+type BanListServer struct {
+	BanListID int     `gorm:"not null; index:ban_list_server,unique" json:"ban_list_id"`
+	BanList   BanList `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"ban_list"`
+	ServerID  int     `gorm:"not null; index:ban_list_server,unique" json:"server_id"`
+	Server    Server  `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"-"`
+}
+
+// Ban Model. A player or IP banned on every server subscribed to a ban list. Bans without
+// an expiration are permanent
+type Ban struct {
+	ID        *int       `gorm:"primaryKey; type:serial" json:"id"`
+	BanListID int        `gorm:"not null; index:ban_target,unique" json:"ban_list_id"`
+	BanList   BanList    `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"-"`
+	Target    string     `gorm:"type: varchar(64) not null; index:ban_target,unique" json:"target"`
+	UUID      string     `gorm:"type: varchar(36)" json:"uuid,omitempty"`
+	IP        bool       `gorm:"type: bool not null" json:"ip"`
+	Reason    string     `gorm:"type: text" json:"reason"`
+	Issuer    string     `gorm:"type: varchar(64)" json:"issuer"`
+	Created   time.Time  `gorm:"type: timestamp not null" json:"created"`
+	Expires   *time.Time `gorm:"type: timestamp" json:"expires"`
+	ServerID  *int       `json:"server_id"`
+	Server    Server     `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:SET NULL" json:"-"`
+}
+
+// CommandRule Model. Allows or denies console commands matching a pattern on a server, either
+// for one user or for everyone with a server permission
+type CommandRule struct {
+	ID           *int        `gorm:"primaryKey; type:serial" json:"id"`
+	ServerID     int         `gorm:"not null; index" json:"server_id"`
+	Server       Server      `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"-"`
+	UserID       *int        `json:"-"`
+	User         *User       `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"user,omitempty"`
+	ServerPermID *int        `json:"-"`
+	ServerPerm   *ServerPerm `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"permission,omitempty"`
+	Pattern      string      `gorm:"type: varchar(256) not null" json:"pattern"`
+	Allow        bool        `gorm:"type: bool not null" json:"allow"`
+}
+
+// ServerLog Model. Commands sent to a server, by a portal user, a player in game or msmf itself
+type ServerLog struct {
+	ID       *int      `gorm:"primaryKey; type:serial" json:"id"`
+	Time     time.Time `gorm:"type: timestamp not null; index" json:"time"`
 	Command  string    `gorm:"type: text not null" json:"command"`
-	PlayerID *int      ` gorm:"not null" json:"player_id"`
-	Player   Player    `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"player"`
+	Source   string    `gorm:"type: varchar(32) not null; default: 'console'" json:"source"`
+	Rejected bool      `gorm:"type: bool not null; default: false" json:"rejected"`
+	UserID   *int      `json:"-"`
+	User     *User     `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:SET NULL" json:"user,omitempty"`
+	PlayerID *int      `json:"-"`
+	Player   *Player   `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"player,omitempty"`
 	ServerID *int      `gorm:"not null" json:"server_id"`
-	Server   Server    `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"server"`
+	Server   Server    `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"-"`
+}
+
+// ConsoleRecording Model. A recorded console session, the events themselves are kept on disk
+type ConsoleRecording struct {
+	ID       *int       `gorm:"primaryKey; type:serial" json:"id"`
+	Time     time.Time  `gorm:"type: timestamp not null; index" json:"time"`
+	Ended    *time.Time `gorm:"type: timestamp" json:"ended,omitempty"`
+	Events   int        `gorm:"type: int not null; default: 0" json:"events"`
+	Size     int64      `gorm:"type: bigint not null; default: 0" json:"size"`
+	UserID   *int       `json:"-"`
+	User     *User      `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:SET NULL" json:"user,omitempty"`
+	ServerID int        `gorm:"not null; index" json:"server_id"`
+	Server   Server     `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"-"`
+}
+
+// ShellSession Model. A shell someone opened inside a server container
+type ShellSession struct {
+	ID         *int       `gorm:"primaryKey; type:serial" json:"id"`
+	Time       time.Time  `gorm:"type: timestamp not null; index" json:"time"`
+	Ended      *time.Time `gorm:"type: timestamp" json:"ended,omitempty"`
+	ExitCode   *int       `gorm:"type: int" json:"exit_code,omitempty"`
+	RemoteAddr string     `gorm:"type: varchar(64)" json:"remote_addr"`
+	UserID     *int       `json:"-"`
+	User       *User      `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:SET NULL" json:"user,omitempty"`
+	ServerID   int        `gorm:"not null; index" json:"server_id"`
+	Server     Server     `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"-"`
+}
+
+// Backup Model. A backup of a server's data, the archive itself is kept on disk
+type Backup struct {
+	ID   *int      `gorm:"primaryKey; type:serial" json:"id"`
+	Time time.Time `gorm:"type: timestamp not null; index" json:"time"`
+	// Running, complete or failed
+	Status string `gorm:"type: varchar(16) not null" json:"status"`
+	Error  string `gorm:"type: text" json:"error,omitempty"`
+	// Manual or scheduled, only scheduled backups are cleaned up by the retention policy
+	Reason string `gorm:"type: varchar(16) not null" json:"reason"`
+	// The size of every file in the backup, and how much new data it added to the backup store.
+	// Backups share whatever didn't change, so deleting one only frees what no other backup uses
+	Size   int64 `gorm:"type: bigint not null; default: 0" json:"size"`
+	Stored int64 `gorm:"type: bigint not null; default: 0" json:"stored"`
+	// How the server was kept from writing to its files while they were copied. Offline if it
+	// was stopped, flushed if saving was paused and the save confirmed, unconfirmed if the save
+	// never said it finished, or live if saving couldn't be paused at all
+	Consistency string `gorm:"type: varchar(16)" json:"consistency,omitempty"`
+	// SHA-256 of the manifest listing every file and chunk in the backup
+	Checksum string `gorm:"type: varchar(64)" json:"checksum,omitempty"`
+	// The archive format the backup is downloaded and exported as unless another is asked for
+	Format string `gorm:"type: varchar(16) not null; default: 'tar.gz'" json:"format"`
+	// The ID and salt of the key the backup is encrypted with, if it's encrypted
+	KeyFingerprint string `gorm:"type: varchar(16)" json:"key_fingerprint,omitempty"`
+	KeySalt        []byte `gorm:"type: bytea" json:"-"`
+	// Whether restoring the backup somewhere to try it passed or failed, or couldn't be done
+	// because msmf doesn't have its key, and when it was last tried. Backups that were never
+	// tried have no verification
+	Verification      string     `gorm:"type: varchar(16)" json:"verification,omitempty"`
+	VerificationError string     `gorm:"type: text" json:"verification_error,omitempty"`
+	VerifiedAt        *time.Time `gorm:"type: timestamp" json:"verified_at,omitempty"`
+	// Where the backup is kept, msmf's own data directory if there's no target
+	TargetID *int          `json:"target_id,omitempty"`
+	Target   *BackupTarget `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:RESTRICT" json:"-"`
+	UserID   *int          `json:"-"`
+	User     *User         `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:SET NULL" json:"user,omitempty"`
+	ServerID int           `gorm:"not null; index" json:"server_id"`
+	Server   Server        `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"-"`
+}
+
+// BackupJob Model. Something done with a backup in the background, like restoring it, since it
+// can take far longer than a request
+type BackupJob struct {
+	ID *int `gorm:"primaryKey; type:serial" json:"id"`
+	// What the job does, restore or export
+	Kind string `gorm:"type: varchar(16) not null" json:"kind"`
+	// Running, complete or failed
+	Status   string     `gorm:"type: varchar(16) not null" json:"status"`
+	Error    string     `gorm:"type: text" json:"error,omitempty"`
+	Time     time.Time  `gorm:"type: timestamp not null; index" json:"time"`
+	Finished *time.Time `gorm:"type: timestamp" json:"finished,omitempty"`
+	// Exports only, where the archive was written and what it's called
+	TargetID *int          `json:"target_id,omitempty"`
+	Target   *BackupTarget `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:SET NULL" json:"-"`
+	Format   string        `gorm:"type: varchar(16)" json:"format,omitempty"`
+	Name     string        `gorm:"type: text" json:"name,omitempty"`
+	BackupID *int          `json:"backup_id,omitempty"`
+	Backup   *Backup       `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:SET NULL" json:"-"`
+	UserID   *int          `json:"-"`
+	User     *User         `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:SET NULL" json:"user,omitempty"`
+	ServerID int           `gorm:"not null; index" json:"server_id"`
+	Server   Server        `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"-"`
+}
+
+// BackupSchedule Model. How often a server is backed up and which scheduled backups are kept
+type BackupSchedule struct {
+	ID       *int   `gorm:"primaryKey; type:serial" json:"-"`
+	ServerID int    `gorm:"not null; unique" json:"server_id"`
+	Server   Server `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"-"`
+	// Minutes between backups, or 0 to not back up on a schedule
+	Interval int `gorm:"type: int not null; default: 0" json:"interval"`
+	// Keep the newest backups, the newest backup of each of the last days, and the newest backup
+	// of each of the last weeks. A backup any of them keeps is kept, and all zero keeps everything
+	KeepLast   int        `gorm:"type: int not null; default: 0" json:"keep_last"`
+	KeepDaily  int        `gorm:"type: int not null; default: 0" json:"keep_daily"`
+	KeepWeekly int        `gorm:"type: int not null; default: 0" json:"keep_weekly"`
+	LastRun    *time.Time `gorm:"type: timestamp" json:"last_run,omitempty"`
+	// The archive format backups are downloaded and exported as. Tar.zst, tar.gz or zip
+	Format string `gorm:"type: varchar(16) not null; default: 'tar.gz'" json:"format"`
+	// Whether backups are encrypted, with the server's own passphrase if it has one or the
+	// portal's if it doesn't. The passphrase is encrypted with the portal's secret key, and the
+	// ID and salt are of the key it was made into
+	Encrypted      bool   `gorm:"not null; default: false" json:"encrypted"`
+	Passphrase     []byte `gorm:"type: bytea" json:"-"`
+	KeyFingerprint string `gorm:"type: varchar(16)" json:"key_fingerprint,omitempty"`
+	KeySalt        []byte `gorm:"type: bytea" json:"-"`
+	// Where the server is backed up to, msmf's own data directory if there's no target
+	TargetID *int          `json:"target_id,omitempty"`
+	Target   *BackupTarget `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:SET NULL" json:"-"`
+}
+
+// BackupTarget Model. Somewhere other than msmf's own disk that backups can be kept
+type BackupTarget struct {
+	ID   *int   `gorm:"primaryKey; type:serial" json:"id"`
+	Name string `gorm:"type: varchar(64) not null unique" json:"name"`
+	// Local, s3 or sftp
+	Kind string `gorm:"type: varchar(16) not null" json:"kind"`
+	// How to reach the target as JSON, encrypted since it holds credentials
+	Config []byte `gorm:"type: bytea not null" json:"-"`
+}
+
+// Alert Model. Something a user needs to know about, such as a backup of their server failing
+// verification. Alerts stay until the user dismisses them
+type Alert struct {
+	ID       *int      `gorm:"primaryKey; type:serial" json:"id"`
+	Time     time.Time `gorm:"type: timestamp not null" json:"time"`
+	Message  string    `gorm:"type: text not null" json:"message"`
+	UserID   int       `gorm:"not null; index" json:"-"`
+	User     User      `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"-"`
+	ServerID *int      `json:"server_id,omitempty"`
+	Server   *Server   `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"-"`
 }
 
 // PlayerLog Model
@@ -136,8 +375,11 @@ type PlayerLog struct {
 	ID       *int      `gorm:"primaryKey; type: serial" json:"id"`
 	Time     time.Time `gorm:"type: timestamp not null" json:"time"`
 	Action   string    `gorm:"type: text not null" json:"action"`
-	PlayerID *int      ` gorm:"not null" json:"-" json:"player_id"`
+	Message  string    `gorm:"type: text" json:"message"`
+	PlayerID *int      ` gorm:"not null" json:"player_id"`
 	Player   Player    `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"player"`
+	ServerID *int      `json:"server_id"`
+	Server   Server    `gorm:"constraint:OnUpdate:CASCADE,ONDELETE:CASCADE" json:"-"`
 }
 
 // WebLog Model
@@ -0,0 +1,202 @@
+package games
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Where a Minecraft container keeps the server files
+const McDataDir = "/data"
+
+// Files in the Minecraft data directory
+const (
+	McPropertiesFile    = McDataDir + "/server.properties"
+	McWhitelistFile     = McDataDir + "/whitelist.json"
+	McOpsFile           = McDataDir + "/ops.json"
+	McBannedPlayersFile = McDataDir + "/banned-players.json"
+	McBannedIPsFile     = McDataDir + "/banned-ips.json"
+)
+
+// McDefaultOpLevel is the permission level given to operators msmf adds
+const McDefaultOpLevel = 4
+
+// McBanForever is the expiry of a ban that never ends
+const McBanForever = "forever"
+
+// mcTimeFormat is how times are written in the ban lists
+const mcTimeFormat = "2006-01-02 15:04:05 -0700"
+
+// Valid player names and UUIDs
+var (
+	mcValidName = regexp.MustCompile(`^[A-Za-z0-9_]{1,16}$`)
+	mcValidUUID = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+)
+
+// MCListEntry is an entry in any of the player list files. Each file only uses some of the fields
+type MCListEntry struct {
+	UUID                string `json:"uuid,omitempty"`
+	Name                string `json:"name,omitempty"`
+	IP                  string `json:"ip,omitempty"`
+	Level               *int   `json:"level,omitempty"`
+	BypassesPlayerLimit *bool  `json:"bypassesPlayerLimit,omitempty"`
+	Created             string `json:"created,omitempty"`
+	Source              string `json:"source,omitempty"`
+	Expires             string `json:"expires,omitempty"`
+	Reason              string `json:"reason,omitempty"`
+}
+
+// MCList is one of the player list files a Minecraft server keeps
+type MCList struct {
+	File string
+	// Entries are IP addresses instead of players
+	ByIP bool
+	// Entries have an operator level
+	Ops bool
+	// Entries are bans with a reason and expiry
+	Bans bool
+}
+
+// MCLists are all of the player list files by name
+var MCLists = map[string]MCList{
+	"whitelist":      {File: McWhitelistFile},
+	"ops":            {File: McOpsFile, Ops: true},
+	"banned-players": {File: McBannedPlayersFile, Bans: true},
+	"banned-ips":     {File: McBannedIPsFile, ByIP: true, Bans: true},
+}
+
+// MCTime formats a time the way the ban lists want it
+func MCTime(t time.Time) string {
+	return t.Format(mcTimeFormat)
+}
+
+// MCParseTime parses a time from the ban lists
+func MCParseTime(s string) (time.Time, error) {
+	return time.Parse(mcTimeFormat, s)
+}
+
+// Key is what identifies an entry in the list
+func (l MCList) Key(entry MCListEntry) string {
+	if l.ByIP {
+		return entry.IP
+	}
+	return strings.ToLower(entry.UUID)
+}
+
+// Prepare checks an entry belongs in the list and fills in anything left out.
+// Players must already have their UUID filled in
+func (l MCList) Prepare(entry *MCListEntry, source string) error {
+	if l.ByIP {
+		if net.ParseIP(entry.IP) == nil {
+			return fmt.Errorf("%q is not a valid IP address", entry.IP)
+		}
+		entry.UUID = ""
+		entry.Name = ""
+	} else {
+		entry.UUID = strings.ToLower(entry.UUID)
+		if !mcValidUUID.MatchString(entry.UUID) {
+			return fmt.Errorf("%q is not a valid UUID", entry.UUID)
+		}
+		if !mcValidName.MatchString(entry.Name) {
+			return fmt.Errorf("%q is not a valid player name", entry.Name)
+		}
+		entry.IP = ""
+	}
+
+	if l.Ops {
+		if entry.Level == nil {
+			level := McDefaultOpLevel
+			entry.Level = &level
+		}
+		if *entry.Level < 0 || *entry.Level > 4 {
+			return errors.New("operator level must be between 0 and 4")
+		}
+		if entry.BypassesPlayerLimit == nil {
+			bypass := false
+			entry.BypassesPlayerLimit = &bypass
+		}
+	} else {
+		entry.Level = nil
+		entry.BypassesPlayerLimit = nil
+	}
+
+	if l.Bans {
+		if len(entry.Created) == 0 {
+			entry.Created = MCTime(time.Now())
+		} else if _, err := MCParseTime(entry.Created); err != nil {
+			return fmt.Errorf("created must look like %q", mcTimeFormat)
+		}
+		if len(entry.Expires) == 0 {
+			entry.Expires = McBanForever
+		} else if _, err := MCParseTime(entry.Expires); err != nil && entry.Expires != McBanForever {
+			return fmt.Errorf("expires must be %q or look like %q", McBanForever, mcTimeFormat)
+		}
+		if len(entry.Source) == 0 {
+			entry.Source = source
+		}
+		if len(entry.Reason) == 0 {
+			entry.Reason = "Banned by an operator."
+		}
+	} else {
+		entry.Created = ""
+		entry.Source = ""
+		entry.Expires = ""
+		entry.Reason = ""
+	}
+	return nil
+}
+
+// Merge adds entries to a list. Entries already in the list are replaced
+func (l MCList) Merge(entries []MCListEntry, add ...MCListEntry) []MCListEntry {
+	index := make(map[string]int)
+	for i, entry := range entries {
+		index[l.Key(entry)] = i
+	}
+	for _, entry := range add {
+		if i, exists := index[l.Key(entry)]; exists {
+			entries[i] = entry
+		} else {
+			index[l.Key(entry)] = len(entries)
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Remove takes entries out of a list that match any of the targets by UUID, name or IP.
+// It also reports whether anything was removed
+func (l MCList) Remove(entries []MCListEntry, targets ...string) ([]MCListEntry, bool) {
+	remove := make(map[string]bool)
+	for _, target := range targets {
+		remove[strings.ToLower(target)] = true
+	}
+
+	kept := make([]MCListEntry, 0, len(entries))
+	for _, entry := range entries {
+		if remove[strings.ToLower(entry.UUID)] || remove[strings.ToLower(entry.Name)] ||
+			(len(entry.IP) > 0 && remove[entry.IP]) {
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	return kept, len(kept) != len(entries)
+}
+
+// MCParseProperties parses a server.properties file
+func MCParseProperties(data []byte) map[string]string {
+	properties := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 {
+			properties[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	return properties
+}
@@ -0,0 +1,216 @@
+package games
+
+import (
+	"crypto/md5"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Actions a line of console output can describe
+const (
+	ActionUUID        = "uuid"
+	ActionJoin        = "join"
+	ActionLeave       = "leave"
+	ActionDeath       = "death"
+	ActionAdvancement = "advancement"
+	ActionChat        = "chat"
+	ActionLink        = "link"
+	ActionCommand     = "command"
+	ActionBan         = "ban"
+	ActionBanIP       = "ban-ip"
+	ActionPardon      = "pardon"
+	ActionPardonIP    = "pardon-ip"
+)
+
+// LogEvent is something a player did, pulled out of a line of console output
+type LogEvent struct {
+	Action string
+	Player string
+	// Only set for ActionUUID
+	UUID string
+	// The chat message, death message, advancement, link code, command or ban reason
+	Message string
+	// Who issued a ban or pardon, "Server" when it came from the console
+	Source string
+}
+
+// ParseLine pulls a player event out of a line of console output for a game. online reports
+// whether a name belongs to a player currently on the server, since some messages (deaths)
+// can only be told apart by who they start with. Lines without an event return nil
+func ParseLine(game, line string, online func(name string) bool) *LogEvent {
+	switch game {
+	case "Minecraft":
+		return MCParseLine(line, online)
+	}
+	return nil
+}
+
+// Strips the colour codes some server software adds
+var mcColour = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// Matches the "[12:00:00] [Server thread/INFO]: " prefix of vanilla and "[12:00:00 INFO]: " of Paper
+var mcPrefix = regexp.MustCompile(`^(?:\[[^\]]*\] ?)+: (.*)$`)
+
+// Minecraft names are 3-16 characters, but offline servers allow more so be lenient
+const mcName = `([A-Za-z0-9_]{1,16})`
+
+var (
+	mcUUID        = regexp.MustCompile(`^UUID of player ` + mcName + ` is ([0-9a-fA-F-]{36})$`)
+	mcJoin        = regexp.MustCompile(`^` + mcName + ` joined the game$`)
+	mcLeave       = regexp.MustCompile(`^` + mcName + ` left the game$`)
+	mcAdvancement = regexp.MustCompile(
+		`^` + mcName + ` has (?:made the advancement|completed the challenge|reached the goal) \[(.*)\]$`,
+	)
+	// Newer versions mark chat that couldn't be verified
+	mcChatLine = regexp.MustCompile(`^(?:\[Not Secure\] )?<` + mcName + `> (.*)$`)
+	mcWord     = regexp.MustCompile(`^` + mcName + ` (.*)$`)
+	// Server software like Paper logs every command players run
+	mcCommand = regexp.MustCompile(`^` + mcName + ` issued server command: /(.*)$`)
+	// Players can link with "/msmf link CODE", by whispering it to anyone, or in chat with "!msmf link CODE"
+	mcLink = regexp.MustCompile(`^(?:!|/|(?:msg|tell|w) \S+ )?msmf link ([A-Za-z0-9]+)$`)
+	// Command feedback is wrapped with who ran it when a player or RCON does it, "[Steve: Banned Alex: Griefing]"
+	mcIssued = regexp.MustCompile(`^\[(\S+): (.*)\]$`)
+	mcBan    = regexp.MustCompile(`^Banned (IP )?(\S+): (.*)$`)
+	mcPardon = regexp.MustCompile(`^Unbanned (IP )?(\S+)$`)
+)
+
+// Every vanilla death message starts with one of these right after the player name
+var mcDeaths = []string{
+	"was ",
+	"walked into ",
+	"drowned",
+	"died",
+	"experienced kinetic energy",
+	"blew up",
+	"hit the ground too hard",
+	"fell ",
+	"went up in flames",
+	"burned to death",
+	"went off with a bang",
+	"tried to swim in lava",
+	"discovered the floor was lava",
+	"suffocated in a wall",
+	"starved to death",
+	"withered away",
+	"froze to death",
+	"left the confines of this world",
+	"didn't want to live in the same world as ",
+	"got finished off by ",
+}
+
+// MCParseLine pulls a player event out of a line of Minecraft console output
+func MCParseLine(line string, online func(name string) bool) *LogEvent {
+	line = mcColour.ReplaceAllString(strings.TrimRight(line, "\r\n"), "")
+	match := mcPrefix.FindStringSubmatch(line)
+	if match == nil {
+		return nil
+	}
+	msg := match[1]
+
+	if m := mcUUID.FindStringSubmatch(msg); m != nil {
+		return &LogEvent{Action: ActionUUID, Player: m[1], UUID: strings.ToLower(m[2])}
+	}
+	if m := mcJoin.FindStringSubmatch(msg); m != nil {
+		return &LogEvent{Action: ActionJoin, Player: m[1]}
+	}
+	if m := mcLeave.FindStringSubmatch(msg); m != nil {
+		return &LogEvent{Action: ActionLeave, Player: m[1]}
+	}
+	if m := mcChatLine.FindStringSubmatch(msg); m != nil {
+		// Don't put link codes into the chat history
+		if link := mcLink.FindStringSubmatch(m[2]); link != nil {
+			return &LogEvent{Action: ActionLink, Player: m[1], Message: link[1]}
+		}
+		return &LogEvent{Action: ActionChat, Player: m[1], Message: m[2]}
+	}
+	if m := mcCommand.FindStringSubmatch(msg); m != nil {
+		if link := mcLink.FindStringSubmatch(m[2]); link != nil {
+			return &LogEvent{Action: ActionLink, Player: m[1], Message: link[1]}
+		}
+		return &LogEvent{Action: ActionCommand, Player: m[1], Message: m[2]}
+	}
+	if event := mcParseBan(msg); event != nil {
+		return event
+	}
+	if m := mcAdvancement.FindStringSubmatch(msg); m != nil {
+		return &LogEvent{Action: ActionAdvancement, Player: m[1], Message: m[2]}
+	}
+
+	// Deaths have no common format, so only trust them from players that are on the server
+	if m := mcWord.FindStringSubmatch(msg); m != nil && online != nil && online(m[1]) {
+		for _, death := range mcDeaths {
+			if strings.HasPrefix(m[2], death) {
+				return &LogEvent{Action: ActionDeath, Player: m[1], Message: msg}
+			}
+		}
+	}
+	return nil
+}
+
+// mcParseBan pulls a ban or pardon out of command feedback
+func mcParseBan(msg string) *LogEvent {
+	source := "Server"
+	if m := mcIssued.FindStringSubmatch(msg); m != nil {
+		source = m[1]
+		msg = m[2]
+	}
+
+	if m := mcBan.FindStringSubmatch(msg); m != nil {
+		action := ActionBan
+		if len(m[1]) > 0 {
+			action = ActionBanIP
+		}
+		return &LogEvent{Action: action, Player: m[2], Message: m[3], Source: source}
+	}
+	if m := mcPardon.FindStringSubmatch(msg); m != nil {
+		action := ActionPardon
+		if len(m[1]) > 0 {
+			action = ActionPardonIP
+		}
+		return &LogEvent{Action: action, Player: m[2], Source: source}
+	}
+	return nil
+}
+
+// What Minecraft says once a save has finished writing the world
+const mcSaved = "Saved the game"
+
+// IsSaved reports whether a line of console output for a game says it finished saving
+func IsSaved(game, line string) bool {
+	switch game {
+	case "Minecraft":
+		return MCIsSaved(line)
+	}
+	return false
+}
+
+// MCIsSaved reports whether a line of Minecraft console output says the world finished saving.
+// Saves run over RCON or by a player show up wrapped like other command feedback
+func MCIsSaved(line string) bool {
+	line = mcColour.ReplaceAllString(strings.TrimRight(line, "\r\n"), "")
+	match := mcPrefix.FindStringSubmatch(line)
+	if match == nil {
+		return false
+	}
+	msg := match[1]
+	if m := mcIssued.FindStringSubmatch(msg); m != nil {
+		msg = m[2]
+	}
+	return msg == mcSaved
+}
+
+// MCSavedResponse reports whether the RCON response to a save says it finished. The response
+// only comes back once the save is done, with everything the save said run together
+func MCSavedResponse(resp string) bool {
+	return strings.HasSuffix(strings.TrimSpace(mcColour.ReplaceAllString(resp, "")), mcSaved)
+}
+
+// MCOfflineUUID computes the UUID an offline mode server gives a player name
+func MCOfflineUUID(name string) string {
+	sum := md5.Sum([]byte("OfflinePlayer:" + name))
+	// Make it a version 3 UUID
+	sum[6] = sum[6]&0x0f | 0x30
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
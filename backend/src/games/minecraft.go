@@ -7,6 +7,17 @@ import (
 
 const McDefaultPort uint16 = 25565
 
+// McDefaultRconPort is the port the RCON listener binds to inside a Minecraft container
+const McDefaultRconPort uint16 = 25575
+
+// Console commands for keeping a Minecraft world still while its files are copied. Flushing
+// waits for every chunk to be written before saying the game was saved
+const (
+	McSaveOff   = "save-off"
+	McSaveFlush = "save-all flush"
+	McSaveOn    = "save-on"
+)
+
 // MCIsVersion checks if the string is actually a valid Minecraft version
 func MCIsVersion(v string) bool {
 	s := strings.Split(v, ".")
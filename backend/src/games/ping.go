@@ -0,0 +1,307 @@
+package games
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MCPlayer is a player as reported by the status protocols
+type MCPlayer struct {
+	Name string `json:"name"`
+	ID   string `json:"id,omitempty"`
+}
+
+// MCStatus is what a Minecraft server reports about itself
+type MCStatus struct {
+	MOTD    string `json:"motd"`
+	Version struct {
+		Name     string `json:"name"`
+		Protocol int    `json:"protocol"`
+	} `json:"version"`
+	Players struct {
+		Online int        `json:"online"`
+		Max    int        `json:"max"`
+		Sample []MCPlayer `json:"sample"`
+	} `json:"players"`
+	// Only filled in when the query protocol is turned on
+	Map     string   `json:"map,omitempty"`
+	Plugins []string `json:"plugins,omitempty"`
+	// Round trip time of the ping packet in milliseconds
+	Latency int64 `json:"latency"`
+}
+
+// mcChat is the subset of a chat component we care about for the MOTD
+type mcChat struct {
+	Text  string   `json:"text"`
+	Extra []mcChat `json:"extra"`
+}
+
+// flatten strips the formatting out of a chat component
+func (c mcChat) flatten() string {
+	var b strings.Builder
+	b.WriteString(c.Text)
+	for _, extra := range c.Extra {
+		b.WriteString(extra.flatten())
+	}
+	return b.String()
+}
+
+// MCPing gets the status of a server with the Server List Ping protocol
+func MCPing(host string, port uint16, timeout time.Duration) (*MCStatus, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))), timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	// Handshake with the next state set to status
+	var handshake bytes.Buffer
+	writeVarInt(&handshake, 0x00)
+	// -1 since we don't know what version the server is
+	writeVarInt(&handshake, -1)
+	writeVarInt(&handshake, int32(len(host)))
+	handshake.WriteString(host)
+	_ = binary.Write(&handshake, binary.BigEndian, port)
+	writeVarInt(&handshake, 1)
+	err = writePacket(conn, handshake.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// Status request has no fields
+	err = writePacket(conn, []byte{0x00})
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	packet, err := readPacket(reader)
+	if err != nil {
+		return nil, err
+	}
+	packetID, err := binary.ReadUvarint(packet)
+	if err != nil {
+		return nil, err
+	}
+	if packetID != 0x00 {
+		return nil, fmt.Errorf("unexpected status packet id %d", packetID)
+	}
+	length, err := binary.ReadUvarint(packet)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]byte, length)
+	_, err = io.ReadFull(packet, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// The description can be a plain string or a chat component
+	var resp struct {
+		MCStatus
+		Description json.RawMessage `json:"description"`
+	}
+	err = json.Unmarshal(raw, &resp)
+	if err != nil {
+		return nil, err
+	}
+	status := resp.MCStatus
+	var motd string
+	if json.Unmarshal(resp.Description, &motd) == nil {
+		status.MOTD = motd
+	} else {
+		var chat mcChat
+		_ = json.Unmarshal(resp.Description, &chat)
+		status.MOTD = chat.flatten()
+	}
+	if status.Players.Sample == nil {
+		status.Players.Sample = []MCPlayer{}
+	}
+
+	// Time a ping to get the latency
+	var ping bytes.Buffer
+	writeVarInt(&ping, 0x01)
+	sent := time.Now()
+	_ = binary.Write(&ping, binary.BigEndian, sent.UnixNano())
+	err = writePacket(conn, ping.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	_, err = readPacket(reader)
+	if err != nil {
+		return nil, err
+	}
+	status.Latency = time.Since(sent).Milliseconds()
+
+	return &status, nil
+}
+
+// MCQuery gets the full status of a server with the GameSpy4 query protocol.
+// This needs enable-query set in the server properties
+func MCQuery(host string, port uint16, timeout time.Duration) (*MCStatus, error) {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(host, strconv.Itoa(int(port))), timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	// Only the lower 4 bits of each byte of the session id are used
+	sessionID := rand.Int31() & 0x0F0F0F0F
+
+	// Handshake to get a challenge token
+	sent := time.Now()
+	resp, err := queryRequest(conn, 0x09, sessionID, nil)
+	if err != nil {
+		return nil, err
+	}
+	latency := time.Since(sent).Milliseconds()
+	token, err := strconv.ParseInt(string(bytes.TrimRight(resp, "\x00")), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	// Full stat request is the token followed by 4 bytes of padding
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint32(payload, uint32(token))
+	resp, err = queryRequest(conn, 0x00, sessionID, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip the "splitnum" padding before the key value section
+	if len(resp) < 11 {
+		return nil, errors.New("query response is too short")
+	}
+	resp = resp[11:]
+
+	// Key value pairs are null terminated and end with an empty key
+	values := make(map[string]string)
+	for {
+		key, rest := splitNull(resp)
+		resp = rest
+		if len(key) == 0 {
+			break
+		}
+		value, rest := splitNull(resp)
+		resp = rest
+		values[key] = value
+	}
+
+	// Skip the "\x01player_\x00\x00" padding before the player list
+	if len(resp) >= 10 {
+		resp = resp[10:]
+	}
+	status := &MCStatus{
+		MOTD:    values["hostname"],
+		Map:     values["map"],
+		Latency: latency,
+	}
+	status.Version.Name = values["version"]
+	status.Players.Online, _ = strconv.Atoi(values["numplayers"])
+	status.Players.Max, _ = strconv.Atoi(values["maxplayers"])
+	status.Players.Sample = []MCPlayer{}
+	for {
+		name, rest := splitNull(resp)
+		resp = rest
+		if len(name) == 0 {
+			break
+		}
+		status.Players.Sample = append(status.Players.Sample, MCPlayer{Name: name})
+	}
+
+	// Plugins look like "Paper on 1.17: Plugin1 1.0; Plugin2 2.0"
+	parts := strings.SplitN(values["plugins"], ":", 2)
+	if len(parts) == 2 {
+		for _, plugin := range strings.Split(parts[1], ";") {
+			plugin = strings.TrimSpace(plugin)
+			if len(plugin) > 0 {
+				status.Plugins = append(status.Plugins, plugin)
+			}
+		}
+	}
+	return status, nil
+}
+
+// queryRequest sends a query packet and returns the payload of the response
+func queryRequest(conn net.Conn, packetType byte, sessionID int32, payload []byte) ([]byte, error) {
+	var req bytes.Buffer
+	req.Write([]byte{0xFE, 0xFD, packetType})
+	_ = binary.Write(&req, binary.BigEndian, sessionID)
+	req.Write(payload)
+	_, err := conn.Write(req.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	// Response starts with the type and session id
+	if n < 5 || buf[0] != packetType {
+		return nil, errors.New("invalid query response")
+	}
+	return buf[5:n], nil
+}
+
+// splitNull splits off a null terminated string
+func splitNull(b []byte) (string, []byte) {
+	i := bytes.IndexByte(b, 0)
+	if i == -1 {
+		return string(b), nil
+	}
+	return string(b[:i]), b[i+1:]
+}
+
+// writeVarInt writes a Minecraft protocol VarInt
+func writeVarInt(w *bytes.Buffer, value int32) {
+	v := uint32(value)
+	for {
+		if v&^0x7F == 0 {
+			w.WriteByte(byte(v))
+			return
+		}
+		w.WriteByte(byte(v&0x7F | 0x80))
+		v >>= 7
+	}
+}
+
+// writePacket writes a length prefixed packet
+func writePacket(w io.Writer, data []byte) error {
+	var packet bytes.Buffer
+	writeVarInt(&packet, int32(len(data)))
+	packet.Write(data)
+	_, err := w.Write(packet.Bytes())
+	return err
+}
+
+// readPacket reads a length prefixed packet
+func readPacket(r *bufio.Reader) (*bytes.Reader, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	// Status responses are at most a few KB, anything huge is garbage
+	if length > 1<<21 {
+		return nil, fmt.Errorf("packet of length %d is too large", length)
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
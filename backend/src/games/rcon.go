@@ -0,0 +1,182 @@
+package games
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// RCON packet types
+const (
+	rconResponse int32 = 0
+	rconCommand  int32 = 2
+	rconLogin    int32 = 3
+)
+
+// Minecraft will refuse any packet larger than this
+const rconMaxPayload = 1446
+
+// ErrRconAuth is returned when the server rejects the RCON password
+var ErrRconAuth = errors.New("rcon authentication failed")
+
+// RconUnsentError is returned when a command never reached the server, because it couldn't be
+// connected to or the command couldn't be written. Nothing was run, so it's safe to try again
+type RconUnsentError struct {
+	Err error
+}
+
+// Error describes why the command wasn't sent
+func (e *RconUnsentError) Error() string {
+	return "rcon command was not sent: " + e.Err.Error()
+}
+
+// Unwrap gets the error that stopped the command being sent
+func (e *RconUnsentError) Unwrap() error {
+	return e.Err
+}
+
+// RCON is a client for the Source RCON protocol that Minecraft servers implement
+type RCON struct {
+	conn    net.Conn
+	lock    sync.Mutex
+	nextID  int32
+	timeout time.Duration
+}
+
+// DialRCON connects to an RCON server and logs in with the password. Any error is an
+// RconUnsentError
+func DialRCON(addr, password string, timeout time.Duration) (*RCON, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, &RconUnsentError{err}
+	}
+
+	r := &RCON{
+		conn:    conn,
+		nextID:  1,
+		timeout: timeout,
+	}
+
+	// Authenticate before handing the client back
+	id := r.newID()
+	err = r.write(id, rconLogin, password)
+	if err != nil {
+		_ = conn.Close()
+		return nil, &RconUnsentError{err}
+	}
+	respID, _, _, err := r.read()
+	if err != nil {
+		_ = conn.Close()
+		return nil, &RconUnsentError{err}
+	}
+	// A failed login comes back with an id of -1
+	if respID != id {
+		_ = conn.Close()
+		return nil, &RconUnsentError{ErrRconAuth}
+	}
+	return r, nil
+}
+
+// Command runs a command on the server and returns the full response. Failing to write the
+// command gives an RconUnsentError, anything after that might have been run
+func (r *RCON) Command(command string) (string, error) {
+	if len(command) > rconMaxPayload {
+		return "", fmt.Errorf("command is longer than %d bytes", rconMaxPayload)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	id := r.newID()
+	err := r.write(id, rconCommand, command)
+	if err != nil {
+		return "", &RconUnsentError{err}
+	}
+
+	// Long responses are split over several packets with no marker on the last one.
+	// Send a packet of an unknown type right after, since the server answers requests in
+	// order, everything before the reply to this one belongs to the command
+	end := r.newID()
+	err = r.write(end, rconResponse, "")
+	if err != nil {
+		return "", err
+	}
+
+	var resp bytes.Buffer
+	for {
+		respID, _, body, err := r.read()
+		if err != nil {
+			return "", err
+		}
+		if respID == end {
+			break
+		}
+		if respID == id {
+			resp.Write(body)
+		}
+	}
+	return resp.String(), nil
+}
+
+// Close closes the underlying connection
+func (r *RCON) Close() error {
+	return r.conn.Close()
+}
+
+// newID returns the next request id, skipping -1 since it signals a failed login
+func (r *RCON) newID() int32 {
+	id := r.nextID
+	r.nextID++
+	if r.nextID < 1 {
+		r.nextID = 1
+	}
+	return id
+}
+
+// write sends a single packet
+func (r *RCON) write(id, packetType int32, body string) error {
+	// Length covers the id, type, body and the two null terminators
+	length := int32(4 + 4 + len(body) + 2)
+	buf := bytes.NewBuffer(make([]byte, 0, length+4))
+	_ = binary.Write(buf, binary.LittleEndian, length)
+	_ = binary.Write(buf, binary.LittleEndian, id)
+	_ = binary.Write(buf, binary.LittleEndian, packetType)
+	buf.WriteString(body)
+	buf.Write([]byte{0, 0})
+
+	_ = r.conn.SetWriteDeadline(time.Now().Add(r.timeout))
+	_, err := r.conn.Write(buf.Bytes())
+	return err
+}
+
+// read reads a single packet
+func (r *RCON) read() (id, packetType int32, body []byte, err error) {
+	_ = r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+
+	var length int32
+	err = binary.Read(r.conn, binary.LittleEndian, &length)
+	if err != nil {
+		return
+	}
+	// Smallest valid packet is an id, a type and two null bytes
+	if length < 10 || length > 4096+10 {
+		err = fmt.Errorf("invalid rcon packet length %d", length)
+		return
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r.conn, payload)
+	if err != nil {
+		return
+	}
+	id = int32(binary.LittleEndian.Uint32(payload[0:4]))
+	packetType = int32(binary.LittleEndian.Uint32(payload[4:8]))
+	// Strip the two null terminators
+	body = payload[8 : length-2]
+	return
+}
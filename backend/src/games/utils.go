@@ -23,6 +23,13 @@ func MakeParameters(m map[string]interface{}, image *string) (parameters []strin
 		case "PATH":
 			// Ignore the name, msmf sets its own to manage it
 		case "NAME":
+			// Ignore RCON settings, msmf configures RCON itself
+		case "ENABLE_RCON":
+		case "RCON_PORT":
+		case "RCON_PASSWORD":
+			// Ignore query settings, msmf needs it on the default port
+		case "ENABLE_QUERY":
+		case "QUERY_PORT":
 			// Ignore game, that's not an environmental variable
 		case "GAME":
 		case "PORT":
@@ -0,0 +1,299 @@
+package games
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// NBT tag types
+const (
+	nbtEnd = iota
+	nbtByte
+	nbtShort
+	nbtInt
+	nbtLong
+	nbtFloat
+	nbtDouble
+	nbtByteArray
+	nbtString
+	nbtList
+	nbtCompound
+	nbtIntArray
+	nbtLongArray
+)
+
+// How deep NBT can be nested before it's treated as broken. Minecraft allows the same
+const nbtMaxDepth = 512
+
+// Region files are split into sectors. The first two hold where each chunk is and when it was
+// last saved
+const mcSector = 4096
+
+// errNBTShort is returned when NBT ends before everything in it has been read
+var errNBTShort = errors.New("NBT ends early")
+
+// CheckWorld makes sure the worlds in a directory a server was restored into could be loaded
+// by the game. Games without a check always pass
+func CheckWorld(game, dir string) error {
+	switch game {
+	case "Minecraft":
+		return MCCheckWorld(dir)
+	}
+	return nil
+}
+
+// MCCheckWorld finds the worlds in a directory by their level.dat, making sure every level.dat
+// parses and every region file has a valid header. Not finding a world at all is an error
+func MCCheckWorld(dir string) error {
+	worlds := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.Name() == "level.dat":
+			worlds++
+			err = mcCheckLevel(path)
+		case filepath.Ext(path) == ".mca" || filepath.Ext(path) == ".mcr":
+			err = mcCheckRegion(path, info.Size())
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.ToSlash(rel), err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if worlds == 0 {
+		return errors.New("no world was found, there is no level.dat")
+	}
+	return nil
+}
+
+// mcCheckLevel makes sure a level.dat is gzipped NBT holding the world's data
+func mcCheckLevel(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decompressor, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("not gzipped: %w", err)
+	}
+
+	reader := nbtReader{bufio.NewReader(decompressor)}
+	tag, err := reader.tag()
+	if err != nil {
+		return err
+	}
+	if tag != nbtCompound {
+		return errors.New("NBT doesn't start with a compound")
+	}
+	_, err = reader.string()
+	if err != nil {
+		return err
+	}
+
+	// Go through the root by hand to find the world's data in it
+	hasData := false
+	for {
+		tag, err = reader.tag()
+		if err != nil {
+			return err
+		}
+		if tag == nbtEnd {
+			break
+		}
+		name, err := reader.string()
+		if err != nil {
+			return err
+		}
+		if name == "Data" && tag == nbtCompound {
+			hasData = true
+		}
+		err = reader.payload(tag, 1)
+		if err != nil {
+			return err
+		}
+	}
+	if !hasData {
+		return errors.New("NBT has no Data compound")
+	}
+	return nil
+}
+
+// mcCheckRegion makes sure every chunk in the header of a region file is inside the file and
+// starts with a sensible length and compression type. Minecraft leaves empty region files
+// around, so those are fine
+func mcCheckRegion(path string, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	if size < 2*mcSector {
+		return errors.New("region file is too short to have a header")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	header := make([]byte, mcSector)
+	_, err = io.ReadFull(file, header)
+	if err != nil {
+		return err
+	}
+
+	sectors := (size + mcSector - 1) / mcSector
+	start := make([]byte, 5)
+	for i := 0; i < mcSector/4; i++ {
+		location := binary.BigEndian.Uint32(header[i*4:])
+		if location == 0 {
+			continue
+		}
+		offset, count := int64(location>>8), int64(location&0xff)
+		if offset < 2 || count == 0 || offset+count > sectors {
+			return fmt.Errorf("chunk %d is outside the region file", i)
+		}
+
+		// Chunks start with how long they are and how they're compressed. The high bit of the
+		// compression means the chunk is kept in a file of its own
+		_, err = file.ReadAt(start, offset*mcSector)
+		if err != nil {
+			return fmt.Errorf("chunk %d can't be read: %w", i, err)
+		}
+		length := int64(binary.BigEndian.Uint32(start))
+		if length == 0 || length > count*mcSector-4 {
+			return fmt.Errorf("chunk %d has a bad length", i)
+		}
+		if compression := start[4] &^ 0x80; compression < 1 || compression > 4 {
+			return fmt.Errorf("chunk %d has an unknown compression type %d", i, compression)
+		}
+	}
+	return nil
+}
+
+// nbtReader reads through NBT to make sure it's well formed, without keeping any of it
+type nbtReader struct {
+	r *bufio.Reader
+}
+
+// Helper function to turn running out of NBT into a clearer error
+func nbtError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errNBTShort
+	}
+	return err
+}
+
+// tag reads the type of the next tag
+func (n nbtReader) tag() (byte, error) {
+	tag, err := n.r.ReadByte()
+	return tag, nbtError(err)
+}
+
+// skip reads past part of a tag
+func (n nbtReader) skip(size int64) error {
+	_, err := io.CopyN(ioutil.Discard, n.r, size)
+	return nbtError(err)
+}
+
+// length reads the length of an array or list
+func (n nbtReader) length() (int64, error) {
+	var length int32
+	err := binary.Read(n.r, binary.BigEndian, &length)
+	if err != nil {
+		return 0, nbtError(err)
+	}
+	if length < 0 {
+		return 0, errors.New("NBT has a negative length")
+	}
+	return int64(length), nil
+}
+
+// string reads a string, such as the name of a tag
+func (n nbtReader) string() (string, error) {
+	var length uint16
+	err := binary.Read(n.r, binary.BigEndian, &length)
+	if err != nil {
+		return "", nbtError(err)
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(n.r, data)
+	return string(data), nbtError(err)
+}
+
+// payload reads past what's in a tag, going into lists and compounds
+func (n nbtReader) payload(tag byte, depth int) error {
+	if depth > nbtMaxDepth {
+		return errors.New("NBT is nested too deeply")
+	}
+	switch tag {
+	case nbtByte:
+		return n.skip(1)
+	case nbtShort:
+		return n.skip(2)
+	case nbtInt, nbtFloat:
+		return n.skip(4)
+	case nbtLong, nbtDouble:
+		return n.skip(8)
+	case nbtString:
+		_, err := n.string()
+		return err
+	case nbtByteArray, nbtIntArray, nbtLongArray:
+		length, err := n.length()
+		if err != nil {
+			return err
+		}
+		size := map[byte]int64{nbtByteArray: 1, nbtIntArray: 4, nbtLongArray: 8}[tag]
+		return n.skip(length * size)
+	case nbtList:
+		element, err := n.tag()
+		if err != nil {
+			return err
+		}
+		length, err := n.length()
+		if err != nil {
+			return err
+		}
+		if element == nbtEnd && length > 0 {
+			return errors.New("NBT has a list of nothing")
+		}
+		for i := int64(0); i < length; i++ {
+			err = n.payload(element, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case nbtCompound:
+		for {
+			child, err := n.tag()
+			if err != nil || child == nbtEnd {
+				return err
+			}
+			_, err = n.string()
+			if err != nil {
+				return err
+			}
+			err = n.payload(child, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("NBT has an unknown tag type %d", tag)
+}
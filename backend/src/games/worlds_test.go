@@ -0,0 +1,229 @@
+package games
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// nbtWriter builds NBT for tests
+type nbtWriter struct {
+	bytes.Buffer
+}
+
+func (n *nbtWriter) tag(tag byte, name string) *nbtWriter {
+	n.WriteByte(tag)
+	return n.string(name)
+}
+
+func (n *nbtWriter) string(s string) *nbtWriter {
+	_ = binary.Write(n, binary.BigEndian, uint16(len(s)))
+	n.WriteString(s)
+	return n
+}
+
+func (n *nbtWriter) int(i int32) *nbtWriter {
+	_ = binary.Write(n, binary.BigEndian, i)
+	return n
+}
+
+func (n *nbtWriter) end() *nbtWriter {
+	n.WriteByte(nbtEnd)
+	return n
+}
+
+// Helper function to make the NBT of a level.dat, with or without its Data compound
+func levelNBT(withData bool) []byte {
+	n := &nbtWriter{}
+	n.tag(nbtCompound, "")
+	if withData {
+		n.tag(nbtCompound, "Data")
+		n.tag(nbtString, "LevelName").string("world")
+		n.tag(nbtLong, "RandomSeed").int(0).int(42)
+		n.tag(nbtByte, "hardcore").WriteByte(0)
+		n.tag(nbtList, "ServerBrands").WriteByte(nbtString)
+		n.int(1).string("vanilla")
+		n.tag(nbtIntArray, "WanderingTraderId").int(2).int(1).int(2)
+		n.tag(nbtCompound, "Version").tag(nbtInt, "Id").int(2586).end()
+		n.end()
+	}
+	n.tag(nbtInt, "DataVersion").int(2586)
+	n.end()
+	return n.Bytes()
+}
+
+// Helper function to gzip data
+func gzipped(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, _ = w.Write(data)
+	_ = w.Close()
+	return buf.Bytes()
+}
+
+// Helper function to make a region file with a chunk in each of the given sectors. The chunk
+// headers can be changed with edit
+func region(sectors []uint32, edit func(file []byte)) []byte {
+	file := make([]byte, 2*mcSector+len(sectors)*mcSector)
+	for i, sector := range sectors {
+		binary.BigEndian.PutUint32(file[i*4:], sector<<8|1)
+		chunk := file[sector*mcSector:]
+		binary.BigEndian.PutUint32(chunk, 100)
+		chunk[4] = 2
+	}
+	if edit != nil {
+		edit(file)
+	}
+	return file
+}
+
+func TestMCCheckWorld(t *testing.T) {
+	level := gzipped(levelNBT(true))
+	tests := []struct {
+		name  string
+		files map[string][]byte
+		// Part of the error expected, or nothing if the world is fine
+		err string
+	}{
+		{
+			name: "valid world",
+			files: map[string][]byte{
+				"world/level.dat":          level,
+				"world/region/r.0.0.mca":   region([]uint32{2, 3}, nil),
+				"world/region/r.1.0.mca":   {},
+				"world/DIM-1/region/r.mca": region([]uint32{2}, nil),
+			},
+		},
+		{
+			name:  "no world",
+			files: map[string][]byte{"server.properties": []byte("motd=hi")},
+			err:   "no world was found",
+		},
+		{
+			name:  "level.dat cut short",
+			files: map[string][]byte{"world/level.dat": gzipped(levelNBT(true)[:40])},
+			err:   errNBTShort.Error(),
+		},
+		{
+			name:  "level.dat gzip cut short",
+			files: map[string][]byte{"world/level.dat": level[:len(level)/2]},
+			err:   "world/level.dat",
+		},
+		{
+			name:  "level.dat not gzipped",
+			files: map[string][]byte{"world/level.dat": levelNBT(true)},
+			err:   "not gzipped",
+		},
+		{
+			name:  "level.dat without Data",
+			files: map[string][]byte{"world/level.dat": gzipped(levelNBT(false))},
+			err:   "no Data compound",
+		},
+		{
+			name: "level.dat with an unknown tag",
+			files: map[string][]byte{"world/level.dat": gzipped(
+				(&nbtWriter{}).tag(nbtCompound, "").tag(42, "Data").end().Bytes(),
+			)},
+			err: "unknown tag type 42",
+		},
+		{
+			name: "region header too short",
+			files: map[string][]byte{
+				"world/level.dat":        level,
+				"world/region/r.0.0.mca": make([]byte, 100),
+			},
+			err: "too short to have a header",
+		},
+		{
+			name: "region chunk outside the file",
+			files: map[string][]byte{
+				"world/level.dat": level,
+				"world/region/r.0.0.mca": region([]uint32{2}, func(file []byte) {
+					binary.BigEndian.PutUint32(file[4:], 40<<8|1)
+				}),
+			},
+			err: "chunk 1 is outside the region file",
+		},
+		{
+			name: "region chunk in the header",
+			files: map[string][]byte{
+				"world/level.dat": level,
+				"world/region/r.0.0.mca": region([]uint32{2}, func(file []byte) {
+					binary.BigEndian.PutUint32(file[0:], 1<<8|1)
+				}),
+			},
+			err: "chunk 0 is outside the region file",
+		},
+		{
+			name: "region chunk with a bad length",
+			files: map[string][]byte{
+				"world/level.dat": level,
+				"world/region/r.0.0.mca": region([]uint32{2}, func(file []byte) {
+					binary.BigEndian.PutUint32(file[2*mcSector:], mcSector)
+				}),
+			},
+			err: "chunk 0 has a bad length",
+		},
+		{
+			name: "region chunk with unknown compression",
+			files: map[string][]byte{
+				"world/level.dat": level,
+				"world/region/r.0.0.mca": region([]uint32{2}, func(file []byte) {
+					file[2*mcSector+4] = 9
+				}),
+			},
+			err: "unknown compression type 9",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range test.files {
+				path := filepath.Join(dir, filepath.FromSlash(name))
+				err := os.MkdirAll(filepath.Dir(path), 0750)
+				if err == nil {
+					err = os.WriteFile(path, data, 0640)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := CheckWorld("Minecraft", dir)
+			if len(test.err) == 0 && err != nil {
+				t.Errorf("CheckWorld() = %v, want no error", err)
+			} else if len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("CheckWorld() = %v, want an error containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestCheckWorldOtherGames(t *testing.T) {
+	// Games without a check always pass, even with nothing there
+	err := CheckWorld("Factorio", t.TempDir())
+	if err != nil {
+		t.Errorf("CheckWorld() = %v, want no error", err)
+	}
+}
+
+func TestNBTShort(t *testing.T) {
+	// Running out partway through a tag is always errNBTShort
+	data := levelNBT(true)
+	for _, cut := range []int{1, 3, 10, len(data) / 2, len(data) - 1} {
+		reader := nbtReader{bufio.NewReader(bytes.NewReader(data[:cut]))}
+		_, _ = reader.tag()
+		_, _ = reader.string()
+		err := reader.payload(nbtCompound, 1)
+		if !errors.Is(err, errNBTShort) {
+			t.Errorf("payload of %d bytes = %v, want errNBTShort", cut, err)
+		}
+	}
+}
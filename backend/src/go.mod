@@ -5,9 +5,12 @@ go 1.16
 require (
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.4.2
-	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897
+	github.com/jackc/pgconn v1.7.0
+	github.com/klauspost/compress v1.13.6
+	github.com/minio/minio-go/v7 v7.0.12
+	github.com/pkg/sftp v1.13.4
+	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
-	gopkg.in/yaml.v2 v2.3.0 // indirect
 	gorm.io/driver/postgres v1.0.5
 	gorm.io/gorm v1.20.6
 )
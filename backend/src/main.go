@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"msmf/utils"
@@ -15,8 +16,19 @@ import (
 )
 
 func main() {
+	// Load the key used to encrypt stored secrets
+	err := utils.LoadSecretKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Load the key backups are encrypted with, if the portal has one
+	err = utils.LoadBackupKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Make DB connection
-	err := database.ConnectDB("postgres")
+	err = database.ConnectDB("postgres")
 	if err != nil {
 		panic("failed to connect database")
 	}
@@ -35,14 +47,41 @@ func main() {
 		// Run them as goroutines so the serer start up is faster
 		go func(server database.Server) {
 			log.Printf("Starting server %d if it wasn't already started", *server.ID)
-			err := utils.StartServer(utils.GameName(*server.ID))
+			// Bring the whitelist and operators in line with any permission changes
+			err := routes.SyncServerPlayers(*server.ID)
+			if err != nil {
+				log.Printf("Could not sync players on server %d: %s\n", *server.ID, err)
+			}
+			err = utils.StartServer(utils.GameName(*server.ID))
 			// TODO come up with a solution to remedy this
 			if err != nil {
 				log.Printf("Server %d no longer exists in docker\n", *server.ID)
+				return
+			}
+
+			// Attach to the console so player activity is tracked
+			_, err = routes.AttachConsole(*server.ID)
+			if err != nil {
+				log.Printf("Could not attach to server %d: %s\n", *server.ID, err)
 			}
 		}(server)
 	}
 
+	// Lift temporary bans on shared ban lists as they expire
+	go routes.WatchBans()
+
+	// Delete console recordings once they are past the retention
+	go routes.WatchRecordings()
+
+	// Back servers up on their schedules
+	go routes.WatchBackups()
+
+	// Try restoring backups on a schedule to make sure they still work
+	go routes.WatchVerifications()
+
+	// Let users get to server consoles over SSH if it's turned on
+	go routes.ServeSSH()
+
 	// Create new base router for app
 	router := mux.NewRouter()
 
@@ -66,6 +105,8 @@ func main() {
 	api.HandleFunc("/server", routes.GetServers).Methods("GET")
 	// Handle calls to view a server
 	api.HandleFunc("/server/{id:[0-9]+}", routes.GetServer).Methods("GET")
+	// Handle calls to view the live status of a server
+	api.HandleFunc("/server/{id:[0-9]+}/status", routes.GetServerStatus).Methods("GET")
 	// Handle calls to update a server
 	api.HandleFunc("/server/{id:[0-9]+}", routes.UpdateServer).Methods("PATCH")
 	// Handle calls to delete servers
@@ -76,9 +117,139 @@ func main() {
 	api.HandleFunc("/server/{id:[0-9]+}/stop", routes.StopServer).Methods("POST")
 	// Handle calls to restart a server
 	api.HandleFunc("/server/{id:[0-9]+}/restart", routes.RestartServer).Methods("POST")
+	// Handle calls to run a command on a server
+	api.HandleFunc("/server/{id:[0-9]+}/command", routes.RunCommand).Methods("POST")
+	// Handle calls to view the commands sent to a server
+	api.HandleFunc("/server/{id:[0-9]+}/commands", routes.GetServerCommands).Methods("GET")
+	// Handle calls to see how console websockets on a server are keeping up
+	api.HandleFunc("/server/{id:[0-9]+}/console/metrics", routes.GetConsoleMetrics).Methods("GET")
+	// Handle calls to list the recorded console sessions of a server
+	api.HandleFunc("/server/{id:[0-9]+}/console/recordings", routes.GetRecordings).Methods("GET")
+	// Handle calls to download a recorded console session
+	api.HandleFunc(
+		"/server/{id:[0-9]+}/console/recordings/{recording:[0-9]+}", routes.GetRecording,
+	).Methods("GET")
+	// Handle calls to delete a recorded console session
+	api.HandleFunc(
+		"/server/{id:[0-9]+}/console/recordings/{recording:[0-9]+}", routes.DeleteRecording,
+	).Methods("DELETE")
+	// Handle calls to list the shells opened inside a server container
+	api.HandleFunc("/server/{id:[0-9]+}/shell/sessions", routes.GetShellSessions).Methods("GET")
+	// Handle calls to list the rules for which console commands users can send
+	api.HandleFunc("/server/{id:[0-9]+}/commands/rules", routes.GetCommandRules).Methods("GET")
+	// Handle calls to allow or deny console commands for a user or permission
+	api.HandleFunc("/server/{id:[0-9]+}/commands/rules", routes.AddCommandRule).Methods("POST")
+	// Handle calls to delete a console command rule
+	api.HandleFunc(
+		"/server/{id:[0-9]+}/commands/rules/{rule:[0-9]+}", routes.DeleteCommandRule,
+	).Methods("DELETE")
+
+	// Handle calls to list the backups of a server
+	api.HandleFunc("/server/{id:[0-9]+}/backups", routes.GetBackups).Methods("GET")
+	// Handle calls to back up a server
+	api.HandleFunc("/server/{id:[0-9]+}/backups", routes.CreateBackup).Methods("POST")
+	// Handle calls to view the backup schedule of a server
+	api.HandleFunc("/server/{id:[0-9]+}/backups/schedule", routes.GetBackupSchedule).Methods("GET")
+	// Handle calls to change the backup schedule of a server
+	api.HandleFunc("/server/{id:[0-9]+}/backups/schedule", routes.UpdateBackupSchedule).Methods("PUT")
+	// Handle calls to download a backup
+	api.HandleFunc("/server/{id:[0-9]+}/backups/{backup:[0-9]+}", routes.GetBackup).Methods("GET")
+	// Handle calls to delete a backup
+	api.HandleFunc("/server/{id:[0-9]+}/backups/{backup:[0-9]+}", routes.DeleteBackup).Methods("DELETE")
+	// Handle calls to check a backup can still be restored
+	api.HandleFunc(
+		"/server/{id:[0-9]+}/backups/{backup:[0-9]+}/verify", routes.VerifyBackup,
+	).Methods("POST")
+	// Handle calls to restore a backup into a server
+	api.HandleFunc(
+		"/server/{id:[0-9]+}/backups/{backup:[0-9]+}/restore", routes.RestoreBackup,
+	).Methods("POST")
+
+	// Handle calls to write a backup out as an archive on a backup target
+	api.HandleFunc(
+		"/server/{id:[0-9]+}/backups/{backup:[0-9]+}/export", routes.ExportBackup,
+	).Methods("POST")
+	// Handle calls to list the backup jobs of a server
+	api.HandleFunc("/server/{id:[0-9]+}/backups/jobs", routes.GetBackupJobs).Methods("GET")
+	// Handle calls to see how a backup job is doing
+	api.HandleFunc("/server/{id:[0-9]+}/backups/jobs/{job:[0-9]+}", routes.GetBackupJob).Methods("GET")
+	// Handle calls to list backup targets
+	api.HandleFunc("/backups/targets", routes.GetBackupTargets).Methods("GET")
+	// Handle calls to add a backup target
+	api.HandleFunc("/backups/targets", routes.CreateBackupTarget).Methods("POST")
+	// Handle calls to delete a backup target
+	api.HandleFunc("/backups/targets/{target:[0-9]+}", routes.DeleteBackupTarget).Methods("DELETE")
+
+	// Handle calls to list players seen on a server
+	api.HandleFunc("/server/{id:[0-9]+}/players", routes.GetServerPlayers).Methods("GET")
+	// Handle calls to view player activity on a server
+	api.HandleFunc("/server/{id:[0-9]+}/players/logs", routes.GetServerPlayerLogs).Methods("GET")
+	// Handle calls to list players on a server right now
+	api.HandleFunc("/server/{id:[0-9]+}/players/online", routes.GetOnlinePlayers).Methods("GET")
+	// Handle calls to kick, ban, op or whitelist a player on a server
+	api.HandleFunc(
+		"/server/{id:[0-9]+}/players/{player}/{action}", routes.ModeratePlayer,
+	).Methods("POST")
+	// Handle calls to view moderation done on a server
+	api.HandleFunc("/server/{id:[0-9]+}/moderation", routes.GetModerationActions).Methods("GET")
+	// Handle calls to list the shared ban lists a server subscribes to
+	api.HandleFunc("/server/{id:[0-9]+}/banlists", routes.GetServerBanLists).Methods("GET")
+	// Handle calls to subscribe a server to a shared ban list
+	api.HandleFunc("/server/{id:[0-9]+}/banlists/{list:[0-9]+}", routes.SubscribeBanList).Methods("PUT")
+	// Handle calls to unsubscribe a server from a shared ban list
+	api.HandleFunc("/server/{id:[0-9]+}/banlists/{list:[0-9]+}", routes.UnsubscribeBanList).Methods("DELETE")
+	// Handle calls to read the whitelist, ops and ban lists of a server
+	api.HandleFunc("/server/{id:[0-9]+}/lists/{list}", routes.GetServerList).Methods("GET")
+	// Handle calls to replace a player list of a stopped server
+	api.HandleFunc("/server/{id:[0-9]+}/lists/{list}", routes.ReplaceServerList).Methods("PUT")
+	// Handle calls to add and remove entries in a player list of a stopped server
+	api.HandleFunc("/server/{id:[0-9]+}/lists/{list}", routes.UpdateServerList).Methods("PATCH")
+
+	// Handle calls to list the shared ban lists
+	api.HandleFunc("/banlist", routes.GetBanLists).Methods("GET")
+	// Handle calls to create a shared ban list
+	api.HandleFunc("/banlist", routes.CreateBanList).Methods("POST")
+	// Handle calls to delete a shared ban list
+	api.HandleFunc("/banlist/{list:[0-9]+}", routes.DeleteBanList).Methods("DELETE")
+	// Handle calls to list the bans on a shared ban list
+	api.HandleFunc("/banlist/{list:[0-9]+}/bans", routes.GetBans).Methods("GET")
+	// Handle calls to ban someone on every server subscribed to a ban list
+	api.HandleFunc("/banlist/{list:[0-9]+}/bans", routes.AddBan).Methods("POST")
+	// Handle calls to pardon a ban on every server subscribed to a ban list
+	api.HandleFunc("/banlist/{list:[0-9]+}/bans/{ban:[0-9]+}", routes.RemoveBan).Methods("DELETE")
+
+	// Handle calls to get a code to link a player to your account
+	api.HandleFunc("/player/link", routes.CreateLinkCode).Methods("POST")
+	// Handle calls to list players linked to an account
+	api.HandleFunc("/player/link", routes.GetLinkedPlayers).Methods("GET")
+	// Handle calls to link a player to an account without confirming it in game
+	api.HandleFunc("/player/{uuid:[0-9a-fA-F-]{36}}/link", routes.LinkPlayer).Methods("PUT")
+	// Handle calls to unlink a player from an account
+	api.HandleFunc("/player/{uuid:[0-9a-fA-F-]{36}}/link", routes.UnlinkPlayer).Methods("DELETE")
+	// Handle calls to view a player
+	api.HandleFunc("/player/{uuid:[0-9a-fA-F-]{36}}", routes.GetPlayer).Methods("GET")
+	// Handle calls to view a player's activity across servers
+	api.HandleFunc("/player/{uuid:[0-9a-fA-F-]{36}}/logs", routes.GetPlayerLogs).Methods("GET")
+
+	// Handle calls to list the alerts of the current user
+	api.HandleFunc("/user/alerts", routes.GetAlerts).Methods("GET")
+	// Handle calls to dismiss an alert of the current user
+	api.HandleFunc("/user/alerts/{alert:[0-9]+}", routes.DeleteAlert).Methods("DELETE")
+	// Handle calls to list the SSH keys of the current user
+	api.HandleFunc("/user/keys", routes.GetSSHKeys).Methods("GET")
+	// Handle calls to add an SSH key for the current user
+	api.HandleFunc("/user/keys", routes.AddSSHKey).Methods("POST")
+	// Handle calls to remove an SSH key of the current user
+	api.HandleFunc("/user/keys/{key:[0-9]+}", routes.DeleteSSHKey).Methods("DELETE")
 
 	// Handle websocket connections for server consoles
 	api.HandleFunc("/ws/server/{id:[0-9]+}", routes.WsServerHandler)
+	// Handle websocket connections for shells inside server containers
+	api.HandleFunc("/ws/server/{id:[0-9]+}/shell", routes.WsShellHandler)
+	// Handle websocket connections watching many server consoles at once
+	api.HandleFunc("/ws/consoles", routes.WsConsolesHandler)
+	// Handle websocket connections replaying recorded console sessions
+	api.HandleFunc("/ws/server/{id:[0-9]+}/recordings/{recording:[0-9]+}", routes.WsRecordingHandler)
 
 	// Get existing referral codes
 	api.HandleFunc("/refer", routes.GetReferrals).Methods("GET")
@@ -89,6 +260,10 @@ func main() {
 
 	// Get user permissions
 	api.HandleFunc("/perm", routes.GetPerms).Methods("GET")
+	// Give a user a permission on a server
+	api.HandleFunc("/perm/server", routes.AddServerPerm).Methods("POST")
+	// Take a permission on a server away from a user
+	api.HandleFunc("/perm/server", routes.RemoveServerPerm).Methods("DELETE")
 
 	// Handle static traffic
 	router.PathPrefix("/").Handler(http.FileServer(HTMLStrippingFileSystem{http.Dir("static")})).Methods("GET")
@@ -126,6 +301,10 @@ func main() {
 		Addr:         fmt.Sprintf("%s:%s", listenAddr, port),
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
+		// Lets downloads push back the write timeout while they're still going. HTTP/2 keeps the
+		// timeout on each stream where they can't get at it, so only HTTP/1.1 is served
+		ConnContext:  routes.SaveConn,
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
 	}
 
 	// Start server
@@ -0,0 +1,77 @@
+package routes
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"msmf/database"
+	"msmf/utils"
+)
+
+// alertOwner leaves an alert for the owner of a server
+func alertOwner(serverID int, message string) {
+	var server database.Server
+	err := database.DB.Where("servers.id = ?", serverID).First(&server).Error
+	if err != nil {
+		log.Printf("Could not alert the owner of server %d: %s\n", serverID, err)
+		return
+	}
+	alert := database.Alert{
+		Time:     time.Now(),
+		Message:  message,
+		UserID:   *server.OwnerID,
+		ServerID: &serverID,
+	}
+	err = database.DB.Create(&alert).Error
+	if err != nil {
+		log.Printf("Could not alert the owner of server %d: %s\n", serverID, err)
+	}
+}
+
+// GetAlerts lists the alerts of the current user, newest first
+func GetAlerts(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(r)
+	if err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	alerts := make([]database.Alert, 0)
+	err = database.DB.Where("alerts.user_id = ?", *user.ID).Order("alerts.time DESC").Find(&alerts).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the alerts
+	_, _ = w.Write(utils.ToJSON(&alerts))
+}
+
+// DeleteAlert dismisses one of the current user's alerts
+func DeleteAlert(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(r)
+	if err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	result := database.DB.Where(
+		"alerts.id = ? AND alerts.user_id = ?", mux.Vars(r)["alert"], *user.ID,
+	).Delete(&database.Alert{})
+	if result.Error != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, result.Error.Error())
+		return
+	}
+	if result.RowsAffected == 0 {
+		utils.ErrorJSON(w, http.StatusNotFound, "Alert does not exist")
+		return
+	}
+
+	// Write out response
+	resp := make(map[string]string)
+	resp["status"] = "Success"
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
@@ -0,0 +1,143 @@
+package routes
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"msmf/database"
+	"msmf/utils"
+)
+
+// Kinds of backup jobs
+const (
+	jobRestore = "restore"
+	jobExport  = "export"
+)
+
+// How long a streamed response can go without the client taking anything before it's cut off.
+// It's the same as the web server's write timeout
+const streamWriteTimeout = 15 * time.Second
+
+// connKey is what the connection of a request is kept under in its context
+type connKey struct{}
+
+// SaveConn keeps the connection of each request in its context, so responses that stream for a
+// long time can push back the web server's write timeout. It's used as the server's ConnContext
+func SaveConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// streamWriter lets a response take as long as it needs as long as the client keeps up. Every
+// write gets the whole write timeout to itself, rather than the response sharing one
+type streamWriter struct {
+	http.ResponseWriter
+	conn net.Conn
+}
+
+// newStreamWriter wraps the writer of a request that streams its response
+func newStreamWriter(w http.ResponseWriter, r *http.Request) streamWriter {
+	conn, _ := r.Context().Value(connKey{}).(net.Conn)
+	return streamWriter{ResponseWriter: w, conn: conn}
+}
+
+// Write pushes back the deadline and writes
+func (s streamWriter) Write(p []byte) (int, error) {
+	if s.conn != nil {
+		_ = s.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+// startJob records a backup job and runs it in the background, recording how it went
+func startJob(job database.BackupJob, run func() error) (database.BackupJob, error) {
+	job.Status = backupRunning
+	job.Time = time.Now()
+	err := database.DB.Create(&job).Error
+	if err != nil {
+		return job, err
+	}
+
+	go func() {
+		err := run()
+		status, message := backupComplete, ""
+		if err != nil {
+			log.Printf("Backup job %d on server %d failed: %s\n", *job.ID, job.ServerID, err)
+			status, message = backupFailed, err.Error()
+		}
+		database.DB.Model(&job).Updates(map[string]interface{}{
+			"status":   status,
+			"error":    message,
+			"finished": time.Now(),
+		})
+	}()
+	return job, nil
+}
+
+// Helper function to check if a backup has a job running on it
+func backupHasJob(backupID int) bool {
+	var jobs int64
+	database.DB.Model(&database.BackupJob{}).Where(
+		"backup_jobs.backup_id = ? AND backup_jobs.status = ?", backupID, backupRunning,
+	).Count(&jobs)
+	return jobs > 0
+}
+
+// GetBackupJobs lists the backup jobs of a server, newest first
+func GetBackupJobs(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "manage_backups") {
+		return
+	}
+
+	query := database.DB.Preload("User").Where("backup_jobs.server_id = ?", serverID)
+	if status := r.URL.Query().Get("status"); len(status) > 0 {
+		query = query.Where("backup_jobs.status = ?", status)
+	}
+	query, err := pageLogs(query, r, "backup_jobs")
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	jobs := make([]database.BackupJob, 0)
+	err = query.Find(&jobs).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the jobs
+	_, _ = w.Write(utils.ToJSON(&jobs))
+}
+
+// GetBackupJob gets a backup job of a server, to see if it's done
+func GetBackupJob(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "manage_backups") {
+		return
+	}
+
+	var job database.BackupJob
+	id, err := strconv.Atoi(mux.Vars(r)["job"])
+	if err == nil {
+		database.DB.Preload("User").Where(
+			"backup_jobs.id = ? AND backup_jobs.server_id = ?", id, serverID,
+		).Find(&job)
+	}
+	if job.ID == nil {
+		utils.ErrorJSON(w, http.StatusNotFound, "Backup job does not exist")
+		return
+	}
+
+	// Write out the job
+	_, _ = w.Write(utils.ToJSON(&job))
+}
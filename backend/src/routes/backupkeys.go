@@ -0,0 +1,88 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"msmf/database"
+	"msmf/utils"
+)
+
+// The header a backup's passphrase can be given in, for backups encrypted with a key msmf no
+// longer has
+const backupPassphraseHeader = "X-Backup-Passphrase"
+
+// errNoBackupKey is returned when a server's backups should be encrypted but there's nothing to
+// encrypt them with
+var errNoBackupKey = errors.New(
+	"backups are set to be encrypted, but neither the server nor the portal has a backup passphrase",
+)
+
+// Helper function to get the key from a server's own passphrase, or nil if it doesn't have one
+func serverKey(schedule database.BackupSchedule) (*utils.BackupKey, error) {
+	if len(schedule.Passphrase) == 0 {
+		return nil, nil
+	}
+	passphrase, err := utils.DecryptSecret(schedule.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return utils.OpenBackupKey(string(passphrase), utils.BackupKeyInfo{
+		ID:   schedule.KeyFingerprint,
+		Salt: schedule.KeySalt,
+	})
+}
+
+// scheduleKey gets the key a server's backups are encrypted with, or nil if they aren't
+func scheduleKey(schedule database.BackupSchedule) (*utils.BackupKey, error) {
+	if !schedule.Encrypted {
+		return nil, nil
+	}
+	key, err := serverKey(schedule)
+	if err != nil || key != nil {
+		return key, err
+	}
+	if utils.PortalBackupKey == nil {
+		return nil, errNoBackupKey
+	}
+	return utils.PortalBackupKey, nil
+}
+
+// backupKey finds the key a backup was encrypted with. The passphrase given with the request is
+// tried first, then the portal's key and the server's. A wrong passphrase isn't found out until
+// the backup's manifest can't be decrypted with it
+func backupKey(backup database.Backup, passphrase string) (*utils.BackupKey, error) {
+	if len(backup.KeyFingerprint) == 0 {
+		return nil, nil
+	}
+	if len(passphrase) > 0 {
+		return utils.OpenBackupKey(passphrase, utils.BackupKeyInfo{
+			ID:   backup.KeyFingerprint,
+			Salt: backup.KeySalt,
+		})
+	}
+
+	if utils.PortalBackupKey != nil && utils.PortalBackupKey.Fingerprint() == backup.KeyFingerprint {
+		return utils.PortalBackupKey, nil
+	}
+	var schedule database.BackupSchedule
+	database.DB.Where("backup_schedules.server_id = ?", backup.ServerID).Find(&schedule)
+	if schedule.KeyFingerprint == backup.KeyFingerprint && len(schedule.Passphrase) > 0 {
+		return serverKey(schedule)
+	}
+	return nil, fmt.Errorf(
+		"%w (key %s), give its passphrase in the %s header",
+		utils.ErrBackupKeyMissing, backup.KeyFingerprint, backupPassphraseHeader,
+	)
+}
+
+// Helper function to write out an error reading a backup. A missing key is something the user
+// can fix, anything else isn't
+func backupReadError(w http.ResponseWriter, err error) {
+	if errors.Is(err, utils.ErrBackupKeyMissing) {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+}
@@ -0,0 +1,970 @@
+package routes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm/clause"
+
+	"msmf/database"
+	"msmf/utils"
+)
+
+// Backup statuses
+const (
+	backupRunning  = "running"
+	backupComplete = "complete"
+	backupFailed   = "failed"
+)
+
+// Why a backup was made
+const (
+	backupManual    = "manual"
+	backupScheduled = "scheduled"
+)
+
+// How often backup schedules are checked
+const backupCheckInterval = time.Minute
+
+// The shortest time allowed between scheduled backups, in minutes
+const minBackupInterval = 5
+
+// errServerBusy is returned when a server is already being backed up or restored
+var errServerBusy = errors.New("a backup or restore is already running on this server")
+
+// busyServers holds the servers being backed up or restored, so only one happens at a time
+var busyServers = make(map[int]bool)
+
+// busyLock is a lock for accessing the busyServers map
+var busyLock sync.Mutex
+
+// claimServer marks a server as busy. It returns false if it already was
+func claimServer(serverID int) bool {
+	busyLock.Lock()
+	defer busyLock.Unlock()
+	if busyServers[serverID] {
+		return false
+	}
+	busyServers[serverID] = true
+	return true
+}
+
+// releaseServer marks a server as no longer busy
+func releaseServer(serverID int) {
+	busyLock.Lock()
+	defer busyLock.Unlock()
+	delete(busyServers, serverID)
+}
+
+// errServerRestoring is returned when a server can't be started because a backup is being
+// restored onto it
+var errServerRestoring = errors.New("a backup is being restored on this server")
+
+// restoringServers holds the servers a backup is being restored onto, which can't be started
+// until it's done. Backups of running servers claim busyServers too, so that can't be used
+var restoringServers = make(map[int]bool)
+
+// startingServers counts the starts of each server in progress, so a restore can't begin under
+// one
+var startingServers = make(map[int]int)
+
+// restoringLock is a lock for accessing the restoringServers and startingServers maps
+var restoringLock sync.Mutex
+
+// claimRestore marks a server as being restored. It returns false if the server is already
+// being restored or started
+func claimRestore(serverID int) bool {
+	restoringLock.Lock()
+	defer restoringLock.Unlock()
+	if restoringServers[serverID] || startingServers[serverID] > 0 {
+		return false
+	}
+	restoringServers[serverID] = true
+	return true
+}
+
+// releaseRestore marks a server as no longer being restored
+func releaseRestore(serverID int) {
+	restoringLock.Lock()
+	defer restoringLock.Unlock()
+	delete(restoringServers, serverID)
+}
+
+// claimStart marks a server as starting. It returns false if a backup is being restored onto it
+func claimStart(serverID int) bool {
+	restoringLock.Lock()
+	defer restoringLock.Unlock()
+	if restoringServers[serverID] {
+		return false
+	}
+	startingServers[serverID]++
+	return true
+}
+
+// releaseStart marks a start of a server as done
+func releaseStart(serverID int) {
+	restoringLock.Lock()
+	defer restoringLock.Unlock()
+	startingServers[serverID]--
+	if startingServers[serverID] <= 0 {
+		delete(startingServers, serverID)
+	}
+}
+
+// serverRestoring checks if a backup is being restored onto a server
+func serverRestoring(serverID int) bool {
+	restoringLock.Lock()
+	defer restoringLock.Unlock()
+	return restoringServers[serverID]
+}
+
+// startBackup starts backing up a server in the background. userID is who asked for it, if
+// anyone did
+func startBackup(serverID int, userID *int, reason string) (database.Backup, error) {
+	if !claimServer(serverID) {
+		return database.Backup{}, errServerBusy
+	}
+	// Servers are backed up to whichever target they're set to use, with their key if they're
+	// encrypted
+	var schedule database.BackupSchedule
+	database.DB.Where("backup_schedules.server_id = ?", serverID).Find(&schedule)
+	key, err := scheduleKey(schedule)
+	if err != nil {
+		releaseServer(serverID)
+		return database.Backup{}, err
+	}
+	backup := database.Backup{
+		Time:     time.Now(),
+		Status:   backupRunning,
+		Reason:   reason,
+		UserID:   userID,
+		ServerID: serverID,
+		TargetID: schedule.TargetID,
+		Format:   schedule.Format,
+	}
+	if len(backup.Format) == 0 {
+		backup.Format = utils.DefaultArchiveFormat
+	}
+	if key != nil {
+		backup.KeyFingerprint = key.Fingerprint()
+		backup.KeySalt = key.Info().Salt
+	}
+	err = database.DB.Create(&backup).Error
+	if err != nil {
+		releaseServer(serverID)
+		return backup, err
+	}
+
+	go func() {
+		defer releaseServer(serverID)
+		runBackup(backup, key)
+	}()
+	return backup, nil
+}
+
+// runBackup makes a backup and records how it went. Running servers have saving paused while
+// their files are copied
+func runBackup(backup database.Backup, key *utils.BackupKey) {
+	source := utils.SourceMsmf
+	if backup.Reason == backupScheduled {
+		source = utils.SourceScheduler
+	}
+	backup.Consistency = pauseSaving(backup.ServerID, backup.UserID, source)
+	err := writeBackup(&backup, key)
+	if backup.Consistency != consistencyOffline {
+		resumeSaving(backup.ServerID, backup.UserID, source)
+	}
+	if err != nil {
+		log.Printf("Could not back up server %d: %s\n", backup.ServerID, err)
+		backup.Status = backupFailed
+		backup.Error = err.Error()
+	} else {
+		backup.Status = backupComplete
+	}
+	database.DB.Model(&backup).Updates(map[string]interface{}{
+		"status":      backup.Status,
+		"error":       backup.Error,
+		"size":        backup.Size,
+		"stored":      backup.Stored,
+		"consistency": backup.Consistency,
+		"checksum":    backup.Checksum,
+	})
+
+	// Make room for the new backup
+	if backup.Status == backupComplete && backup.Reason == backupScheduled {
+		var schedule database.BackupSchedule
+		database.DB.Where("backup_schedules.server_id = ?", backup.ServerID).Find(&schedule)
+		if schedule.ID != nil {
+			pruneBackups(schedule)
+		}
+	}
+}
+
+// writeBackup splits the server's data into chunks, storing the ones that are new, and saves the
+// manifest of the backup. It fills in the size and checksum of the backup
+func writeBackup(backup *database.Backup, key *utils.BackupKey) error {
+	store, err := backupStore(backup.TargetID)
+	if err != nil {
+		return err
+	}
+	store = store.WithKey(key)
+
+	// Chunks can't be collected until the manifest using them is saved
+	done := store.Use()
+	defer done()
+	archive, err := utils.ArchiveServerData(utils.GameName(backup.ServerID), utils.ServerDataDir)
+	if err != nil {
+		return err
+	}
+	manifest, stats, err := utils.ChunkArchive(store, archive)
+	if closeErr := archive.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	manifest, err = store.SealManifest(manifest)
+	if err != nil {
+		return err
+	}
+	data, err := utils.EncodeManifest(manifest)
+	if err != nil {
+		return err
+	}
+	err = store.PutManifest(backup.ServerID, *backup.ID, data)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	backup.Size = stats.Size
+	backup.Stored = stats.Stored
+	backup.Checksum = hex.EncodeToString(sum[:])
+	return nil
+}
+
+// Helper function to load the manifest of a backup, making sure it still has the checksum it
+// was made with
+func loadManifest(store *utils.ChunkStore, backup database.Backup) (*utils.BackupManifest, error) {
+	data, err := store.GetManifest(backup.ServerID, *backup.ID)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != backup.Checksum {
+		return nil, errors.New("backup is corrupt, its checksum doesn't match")
+	}
+	manifest, err := utils.DecodeManifest(data)
+	if err != nil {
+		return nil, err
+	}
+	return store.OpenManifest(manifest)
+}
+
+// openBackup gets the store a backup is kept in, reading it with the key the backup is encrypted
+// with, and the backup's manifest. The store is in use until done is called
+func openBackup(backup database.Backup, key *utils.BackupKey) (
+	store *utils.ChunkStore, manifest *utils.BackupManifest, done func(), err error,
+) {
+	store, err = backupStore(backup.TargetID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	store = store.WithKey(key)
+	done = store.Use()
+	manifest, err = loadManifest(store, backup)
+	if err != nil {
+		done()
+		return nil, nil, nil, err
+	}
+	return store, manifest, done, nil
+}
+
+// verifyBackup checks every chunk of a backup is there and intact
+func verifyBackup(backup database.Backup, passphrase string) (utils.ChunkReport, error) {
+	key, err := backupKey(backup, passphrase)
+	if err != nil {
+		return utils.ChunkReport{}, err
+	}
+	store, manifest, done, err := openBackup(backup, key)
+	if err != nil {
+		return utils.ChunkReport{}, err
+	}
+	defer done()
+	return manifest.Verify(store), nil
+}
+
+// Helper function to turn a report of bad chunks into an error
+func reportError(report utils.ChunkReport) error {
+	return fmt.Errorf(
+		"backup is corrupt, %d chunks are missing and %d are damaged", len(report.Missing), len(report.Corrupt),
+	)
+}
+
+// restoreBackup replaces the data of a stopped server with a backup
+func restoreBackup(backup database.Backup, key *utils.BackupKey) error {
+	// Don't throw away the server's data for a backup that can't be restored
+	store, manifest, done, err := openBackup(backup, key)
+	if err != nil {
+		return err
+	}
+	defer done()
+	report := manifest.Verify(store)
+	if !report.OK {
+		return reportError(report)
+	}
+
+	name := utils.GameName(backup.ServerID)
+	err = utils.ClearServerData(name, utils.ServerDataDir)
+	if err != nil {
+		return err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		_ = writer.CloseWithError(manifest.WriteTar(store, writer))
+	}()
+	err = utils.RestoreServerData(name, utils.ServerDataDir, reader)
+	// Stop the writer if docker gave up early
+	_ = reader.CloseWithError(io.ErrClosedPipe)
+	return err
+}
+
+// Helper function to delete a backup and its manifest. Its chunks stay until garbage is collected
+func deleteBackup(backup database.Backup) error {
+	store, err := backupStore(backup.TargetID)
+	if err != nil {
+		return err
+	}
+	err = store.DeleteManifest(backup.ServerID, *backup.ID)
+	if err != nil {
+		return err
+	}
+	return database.DB.Delete(&backup).Error
+}
+
+// deleteBackups throws away the backups of a server on every target, such as when it's deleted.
+// The database rows go with the server
+func deleteBackups(serverID int) {
+	targets := []*int{nil}
+	var ids []int
+	database.DB.Model(&database.BackupTarget{}).Pluck("id", &ids)
+	for i := range ids {
+		targets = append(targets, &ids[i])
+	}
+
+	// Remote targets can be slow, so don't hold up deleting the server
+	go func() {
+		for _, targetID := range targets {
+			store, err := backupStore(targetID)
+			if err == nil {
+				err = store.DeleteManifests(serverID)
+			}
+			if err != nil {
+				log.Printf("Could not delete the backups of server %d: %s\n", serverID, err)
+				continue
+			}
+			collectChunks(targetID)
+		}
+	}()
+}
+
+// retainedBackups picks out the backups a schedule keeps. Backups must be newest first
+func retainedBackups(backups []database.Backup, schedule database.BackupSchedule) map[int]bool {
+	keep := make(map[int]bool)
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	for i, backup := range backups {
+		if i < schedule.KeepLast {
+			keep[*backup.ID] = true
+		}
+
+		// The newest backup of a day or week is the first one seen
+		day := backup.Time.Format("2006-01-02")
+		if !days[day] && len(days) < schedule.KeepDaily {
+			days[day] = true
+			keep[*backup.ID] = true
+		}
+		year, number := backup.Time.ISOWeek()
+		week := fmt.Sprintf("%d-%d", year, number)
+		if !weeks[week] && len(weeks) < schedule.KeepWeekly {
+			weeks[week] = true
+			keep[*backup.ID] = true
+		}
+	}
+	return keep
+}
+
+// pruneBackups deletes the scheduled backups of a server its schedule doesn't keep
+func pruneBackups(schedule database.BackupSchedule) {
+	if schedule.KeepLast == 0 && schedule.KeepDaily == 0 && schedule.KeepWeekly == 0 {
+		return
+	}
+
+	var backups []database.Backup
+	err := database.DB.Where(
+		"backups.server_id = ? AND backups.reason = ? AND backups.status = ?",
+		schedule.ServerID, backupScheduled, backupComplete,
+	).Order("backups.time DESC").Find(&backups).Error
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	keep := retainedBackups(backups, schedule)
+	// Backups can be on whatever targets the server used before
+	deleted := make(map[int]*int)
+	for _, backup := range backups {
+		if keep[*backup.ID] {
+			continue
+		}
+		err = deleteBackup(backup)
+		if err != nil {
+			log.Printf("Could not delete backup %d: %s\n", *backup.ID, err)
+			continue
+		}
+		deleted[targetKey(backup.TargetID)] = backup.TargetID
+	}
+	for _, targetID := range deleted {
+		collectChunks(targetID)
+	}
+}
+
+// Helper function to start the backups that are due
+func runSchedules() {
+	var schedules []database.BackupSchedule
+	err := database.DB.Where("backup_schedules.interval > 0").Find(&schedules).Error
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	now := time.Now()
+	for _, schedule := range schedules {
+		interval := time.Duration(schedule.Interval) * time.Minute
+		if schedule.LastRun != nil && now.Sub(*schedule.LastRun) < interval {
+			continue
+		}
+
+		// A failed backup waits for the next one instead of trying again every check
+		database.DB.Model(&schedule).Update("last_run", now)
+		_, err = startBackup(schedule.ServerID, nil, backupScheduled)
+		if err != nil {
+			log.Printf("Could not back up server %d: %s\n", schedule.ServerID, err)
+		}
+	}
+}
+
+// WatchBackups backs servers up on their schedules. It never returns
+func WatchBackups() {
+	// Backups and jobs that were running when msmf stopped will never finish
+	database.DB.Model(&database.Backup{}).Where("backups.status = ?", backupRunning).Updates(
+		map[string]interface{}{"status": backupFailed, "error": "msmf stopped during the backup"},
+	)
+	database.DB.Model(&database.BackupJob{}).Where("backup_jobs.status = ?", backupRunning).Updates(
+		map[string]interface{}{"status": backupFailed, "error": "msmf stopped during the job"},
+	)
+
+	for {
+		runSchedules()
+		retryCollects()
+		time.Sleep(backupCheckInterval)
+	}
+}
+
+// Helper function to get the backup in a request
+func requestBackup(w http.ResponseWriter, r *http.Request, serverID int) (backup database.Backup, ok bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["backup"])
+	if err == nil {
+		database.DB.Where("backups.id = ? AND backups.server_id = ?", id, serverID).Find(&backup)
+	}
+	if backup.ID == nil {
+		utils.ErrorJSON(w, http.StatusNotFound, "Backup does not exist")
+		return backup, false
+	}
+	return backup, true
+}
+
+// GetBackups lists the backups of a server, newest first
+func GetBackups(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "manage_backups") {
+		return
+	}
+
+	query := database.DB.Preload("User").Where("backups.server_id = ?", serverID)
+	if status := r.URL.Query().Get("status"); len(status) > 0 {
+		query = query.Where("backups.status = ?", status)
+	}
+	query, err := pageLogs(query, r, "backups")
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	backups := make([]database.Backup, 0)
+	err = query.Find(&backups).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the backups
+	_, _ = w.Write(utils.ToJSON(&backups))
+}
+
+// CreateBackup starts backing up a server. The backup runs in the background, so it comes back
+// as running and the list of backups shows when it's done
+func CreateBackup(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "manage_backups") {
+		return
+	}
+	user, err := currentUser(r)
+	if err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	backup, err := startBackup(serverID, user.ID, backupManual)
+	if err == errServerBusy || err == errNoBackupKey {
+		utils.ErrorJSON(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the backup
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write(utils.ToJSON(&backup))
+}
+
+// Helper function to get the archive format a backup is asked for in, falling back to the
+// backup's own
+func archiveFormat(format string, backup database.Backup) (string, bool) {
+	if len(format) == 0 {
+		format = backup.Format
+	}
+	if len(format) == 0 {
+		format = utils.DefaultArchiveFormat
+	}
+	return format, len(utils.ArchiveContentType(format)) > 0
+}
+
+// Helper function to get the file name of a backup archive
+func archiveName(backup database.Backup, format string) string {
+	return fmt.Sprintf("server-%d-%s.%s", backup.ServerID, backup.Time.Format("20060102-150405"), format)
+}
+
+// GetBackup downloads a backup. The format can be picked with ?format=, otherwise it's the one
+// the backup was made with
+func GetBackup(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "manage_backups") {
+		return
+	}
+	backup, ok := requestBackup(w, r, serverID)
+	if !ok {
+		return
+	}
+	if backup.Status != backupComplete {
+		utils.ErrorJSON(w, http.StatusConflict, "Backup is "+backup.Status)
+		return
+	}
+	format, ok := archiveFormat(r.URL.Query().Get("format"), backup)
+	if !ok {
+		utils.ErrorJSON(w, http.StatusBadRequest, "Unknown archive format")
+		return
+	}
+
+	key, err := backupKey(backup, r.Header.Get(backupPassphraseHeader))
+	if err != nil {
+		backupReadError(w, err)
+		return
+	}
+	store, manifest, done, err := openBackup(backup, key)
+	if err != nil {
+		backupReadError(w, err)
+		return
+	}
+	defer done()
+
+	// The archive is put back together from its chunks as it's sent, which takes longer than the
+	// web server's write timeout for anything but the smallest worlds
+	w.Header().Set("Content-Type", utils.ArchiveContentType(format))
+	w.Header().Set("Content-Disposition", "attachment; filename="+archiveName(backup, format))
+	err = manifest.WriteArchive(store, format, newStreamWriter(w, r))
+	if err != nil {
+		// Too late to tell the client, the download will just be cut short
+		log.Printf("Could not send backup %d: %s\n", *backup.ID, err)
+	}
+}
+
+// exportBackup writes a backup out as a single archive on a backup target. The archive streams
+// straight to the target
+func exportBackup(backup database.Backup, key *utils.BackupKey, dest *utils.ChunkStore, format, name string) error {
+	store, manifest, done, err := openBackup(backup, key)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	reader, writer := io.Pipe()
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		_ = writer.CloseWithError(manifest.WriteArchive(store, format, writer))
+	}()
+	err = dest.Target().PutStream(name, reader)
+	// Stop the archive being written if the target gave up on it
+	_ = reader.CloseWithError(err)
+	<-written
+	return err
+}
+
+// ExportBackup starts writing a backup out as a single archive on a backup target, for keeping
+// somewhere that doesn't need msmf to read it back. The export runs in the background, so it
+// comes back as a running job and the job shows when it's done
+func ExportBackup(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "manage_backups") {
+		return
+	}
+	user, err := currentUser(r)
+	if err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	backup, ok := requestBackup(w, r, serverID)
+	if !ok {
+		return
+	}
+	if backup.Status != backupComplete {
+		utils.ErrorJSON(w, http.StatusConflict, "Backup is "+backup.Status)
+		return
+	}
+
+	// Get JSON of body
+	body := struct {
+		TargetID *int   `json:"target_id"`
+		Format   string `json:"format"`
+	}{}
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	format, ok := archiveFormat(body.Format, backup)
+	if !ok {
+		utils.ErrorJSON(w, http.StatusBadRequest, "Unknown archive format")
+		return
+	}
+	if len(backup.KeyFingerprint) > 0 && body.TargetID != nil {
+		// The archive isn't encrypted, so it can't leave msmf's own disk
+		utils.ErrorJSON(w, http.StatusConflict, "Encrypted backups can only be exported to msmf's own data directory")
+		return
+	}
+	dest, err := backupStore(body.TargetID)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, "Could not use backup target: "+err.Error())
+		return
+	}
+
+	key, err := backupKey(backup, r.Header.Get(backupPassphraseHeader))
+	if err != nil {
+		backupReadError(w, err)
+		return
+	}
+
+	name := fmt.Sprintf("archives/%d/%s", serverID, archiveName(backup, format))
+	job := database.BackupJob{
+		Kind:     jobExport,
+		TargetID: body.TargetID,
+		Format:   format,
+		Name:     name,
+		BackupID: backup.ID,
+		UserID:   user.ID,
+		ServerID: serverID,
+	}
+	job, err = startJob(job, func() error {
+		return exportBackup(backup, key, dest, format, name)
+	})
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the job
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write(utils.ToJSON(&job))
+}
+
+// VerifyBackup reads every chunk of a backup to make sure it can still be restored
+func VerifyBackup(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "manage_backups") {
+		return
+	}
+	backup, ok := requestBackup(w, r, serverID)
+	if !ok {
+		return
+	}
+	if backup.Status != backupComplete {
+		utils.ErrorJSON(w, http.StatusConflict, "Backup is "+backup.Status)
+		return
+	}
+
+	report, err := verifyBackup(backup, r.Header.Get(backupPassphraseHeader))
+	if err != nil {
+		backupReadError(w, err)
+		return
+	}
+
+	// Write out the report
+	_, _ = w.Write(utils.ToJSON(&report))
+}
+
+// DeleteBackup deletes a backup
+func DeleteBackup(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "manage_backups") {
+		return
+	}
+	backup, ok := requestBackup(w, r, serverID)
+	if !ok {
+		return
+	}
+	if backup.Status == backupRunning {
+		utils.ErrorJSON(w, http.StatusConflict, "Backup is still running")
+		return
+	}
+	if backupHasJob(*backup.ID) {
+		utils.ErrorJSON(w, http.StatusConflict, "Backup is being used by a job")
+		return
+	}
+
+	err := deleteBackup(backup)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	go collectChunks(backup.TargetID)
+
+	// Write out response
+	resp := make(map[string]string)
+	resp["status"] = "Success"
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
+
+// RestoreBackup starts replacing the data of a server with a backup. The server has to be
+// stopped. The restore runs in the background, so it comes back as a running job and the job
+// shows when it's done
+func RestoreBackup(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "manage_backups") {
+		return
+	}
+	user, err := currentUser(r)
+	if err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	backup, ok := requestBackup(w, r, serverID)
+	if !ok {
+		return
+	}
+	if backup.Status != backupComplete {
+		utils.ErrorJSON(w, http.StatusConflict, "Backup is "+backup.Status)
+		return
+	}
+	key, err := backupKey(backup, r.Header.Get(backupPassphraseHeader))
+	if err != nil {
+		backupReadError(w, err)
+		return
+	}
+	// The server can't be started from here until the restore is done, and one that was
+	// already starting has finished by the time it's checked
+	if !claimRestore(serverID) {
+		utils.ErrorJSON(w, http.StatusConflict, "Server is starting or already being restored")
+		return
+	}
+	if serverRunning(serverID) {
+		releaseRestore(serverID)
+		utils.ErrorJSON(w, http.StatusConflict, "Server must be stopped to restore a backup")
+		return
+	}
+	if !claimServer(serverID) {
+		releaseRestore(serverID)
+		utils.ErrorJSON(w, http.StatusConflict, errServerBusy.Error())
+		return
+	}
+
+	job := database.BackupJob{Kind: jobRestore, BackupID: backup.ID, UserID: user.ID, ServerID: serverID}
+	job, err = startJob(job, func() error {
+		defer releaseRestore(serverID)
+		defer releaseServer(serverID)
+		err := restoreBackup(backup, key)
+		if err == nil {
+			log.Printf("Restored backup %d on server %d\n", *backup.ID, serverID)
+		}
+		return err
+	})
+	if err != nil {
+		releaseServer(serverID)
+		releaseRestore(serverID)
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the job
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write(utils.ToJSON(&job))
+}
+
+// GetBackupSchedule gets the backup schedule of a server
+func GetBackupSchedule(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "manage_backups") {
+		return
+	}
+
+	// Servers without a schedule just aren't backed up on one
+	schedule := database.BackupSchedule{ServerID: serverID}
+	database.DB.Where("backup_schedules.server_id = ?", serverID).Find(&schedule)
+
+	// Write out the schedule
+	_, _ = w.Write(utils.ToJSON(&schedule))
+}
+
+// UpdateBackupSchedule sets how often a server is backed up, where to, whether it's encrypted,
+// and which scheduled backups are kept
+func UpdateBackupSchedule(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "manage_backups") {
+		return
+	}
+
+	// Get JSON of body. Leaving out the passphrase keeps the one the server has, and an empty one
+	// goes back to the portal's
+	body := struct {
+		database.BackupSchedule
+		Passphrase *string `json:"passphrase"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	schedule := body.BackupSchedule
+	if schedule.Interval < 0 || schedule.KeepLast < 0 || schedule.KeepDaily < 0 || schedule.KeepWeekly < 0 {
+		utils.ErrorJSON(w, http.StatusBadRequest, "Values can't be negative")
+		return
+	}
+	if schedule.Interval > 0 && schedule.Interval < minBackupInterval {
+		utils.ErrorJSON(w, http.StatusBadRequest, fmt.Sprintf(
+			"Interval must be at least %d minutes", minBackupInterval,
+		))
+		return
+	}
+	if len(schedule.Format) == 0 {
+		schedule.Format = utils.DefaultArchiveFormat
+	} else if len(utils.ArchiveContentType(schedule.Format)) == 0 {
+		utils.ErrorJSON(w, http.StatusBadRequest, "Unknown archive format")
+		return
+	}
+	schedule.ServerID = serverID
+	schedule.LastRun = nil
+	if schedule.TargetID != nil {
+		var target database.BackupTarget
+		database.DB.Where("backup_targets.id = ?", *schedule.TargetID).Find(&target)
+		if target.ID == nil {
+			utils.ErrorJSON(w, http.StatusBadRequest, "Backup target does not exist")
+			return
+		}
+	}
+
+	var current database.BackupSchedule
+	database.DB.Where("backup_schedules.server_id = ?", serverID).Find(&current)
+	schedule.Passphrase = current.Passphrase
+	schedule.KeyFingerprint = ""
+	schedule.KeySalt = nil
+	if len(current.Passphrase) > 0 {
+		schedule.KeyFingerprint = current.KeyFingerprint
+		schedule.KeySalt = current.KeySalt
+	}
+	if body.Passphrase != nil {
+		schedule.Passphrase = nil
+		schedule.KeyFingerprint = ""
+		schedule.KeySalt = nil
+		if len(*body.Passphrase) > 0 {
+			// A new passphrase is made into a new key with a salt of its own
+			key, err := utils.NewBackupKey(*body.Passphrase)
+			if err != nil {
+				utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			schedule.Passphrase, err = utils.EncryptSecret([]byte(*body.Passphrase))
+			if err != nil {
+				utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			schedule.KeyFingerprint = key.Fingerprint()
+			schedule.KeySalt = key.Info().Salt
+		}
+	}
+	// The ID of the server's own key is kept even when encryption is turned off, so backups made
+	// with it can still be read. Without one it's the portal's key, if backups are encrypted
+	if len(schedule.Passphrase) == 0 {
+		key, err := scheduleKey(schedule)
+		if err != nil {
+			utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if key != nil {
+			schedule.KeyFingerprint = key.Fingerprint()
+		}
+	}
+
+	err = database.DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "server_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"interval", "keep_last", "keep_daily", "keep_weekly", "target_id", "format",
+			"encrypted", "passphrase", "key_fingerprint", "key_salt",
+		}),
+	}).Create(&schedule).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	database.DB.Where("backup_schedules.server_id = ?", serverID).Find(&schedule)
+
+	// Write out the schedule
+	_, _ = w.Write(utils.ToJSON(&schedule))
+}
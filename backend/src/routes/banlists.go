@@ -0,0 +1,614 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm/clause"
+
+	"msmf/database"
+	"msmf/games"
+	"msmf/utils"
+)
+
+// How often expired bans are looked for
+const banExpiryInterval = time.Minute
+
+// How far apart the same ban can be shared by msmf and seen in the console, and still be merged
+const banMergeWindow = time.Minute
+
+// banLock stops bans from being shared twice when msmf and the console both report one
+var banLock sync.Mutex
+
+// Errors for bad bans
+var (
+	errBadTarget  = errors.New("must supply a valid player name or IP address")
+	errBadExpires = errors.New("expires must be an RFC 3339 time in the future")
+)
+
+// Helper function to get the IDs of the ban lists a server subscribes to
+func serverBanLists(serverID int) (ids []int, err error) {
+	err = database.DB.Model(&database.BanListServer{}).Where(
+		"ban_list_servers.server_id = ?", serverID,
+	).Pluck("ban_list_id", &ids).Error
+	return ids, err
+}
+
+// Helper function to get the servers subscribed to any of the ban lists, leaving one out
+func subscribedServers(listIDs []int, except int) (ids []int, err error) {
+	if len(listIDs) == 0 {
+		return nil, nil
+	}
+	err = database.DB.Model(&database.BanListServer{}).Distinct("server_id").Where(
+		"ban_list_servers.ban_list_id IN ? AND ban_list_servers.server_id <> ?", listIDs, except,
+	).Pluck("server_id", &ids).Error
+	return ids, err
+}
+
+// Helper function to parse an optional expiration for a ban
+func parseExpires(expires string) (*time.Time, error) {
+	if len(expires) == 0 {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, expires)
+	if err != nil || !t.After(time.Now()) {
+		return nil, errBadExpires
+	}
+	return &t, nil
+}
+
+// applyBan bans a player or IP on a server. Running servers get the command, stopped ones
+// have their ban list written
+func applyBan(serverID int, ban database.Ban) error {
+	name := "ban"
+	if ban.IP {
+		name = "ban-ip"
+	}
+	action := moderationActions[name]
+
+	if serverRunning(serverID) {
+		command := action.Command + " " + ban.Target
+		if len(ban.Reason) > 0 {
+			command += " " + ban.Reason
+		}
+		_, err := serverCommand(serverID, command, nil, utils.SourceMsmf)
+		return err
+	}
+
+	list := games.MCLists[action.List]
+	entry := games.MCListEntry{
+		UUID:    ban.UUID,
+		Name:    ban.Target,
+		Created: games.MCTime(ban.Created),
+		Source:  ban.Issuer,
+		Reason:  ban.Reason,
+	}
+	if ban.IP {
+		entry = games.MCListEntry{IP: ban.Target, Created: entry.Created, Source: entry.Source, Reason: entry.Reason}
+	}
+	if ban.Expires != nil {
+		entry.Expires = games.MCTime(*ban.Expires)
+	}
+	entries := []games.MCListEntry{entry}
+	err := prepareEntries(serverID, list, entries, ban.Issuer)
+	if err != nil {
+		return err
+	}
+	_, err = changeList(serverID, list, entries, nil)
+	return err
+}
+
+// liftBan pardons a player or IP on a server
+func liftBan(serverID int, ban database.Ban) error {
+	name := "pardon"
+	if ban.IP {
+		name = "pardon-ip"
+	}
+	action := moderationActions[name]
+
+	if serverRunning(serverID) {
+		_, err := serverCommand(serverID, action.Command+" "+ban.Target, nil, utils.SourceMsmf)
+		return err
+	}
+	_, err := changeList(serverID, games.MCLists[action.List], nil, []string{ban.Target, ban.UUID})
+	return err
+}
+
+// Helper function to check if a server still has a ban on a target from another of its lists
+func stillBanned(serverID int, ban database.Ban) bool {
+	var count int64
+	database.DB.Model(&database.Ban{}).Joins(
+		"INNER JOIN ban_list_servers bls ON bls.ban_list_id = bans.ban_list_id",
+	).Where(
+		"bls.server_id = ? AND LOWER(bans.target) = LOWER(?) AND bans.id <> ?", serverID, ban.Target, ban.ID,
+	).Count(&count)
+	return count > 0
+}
+
+// addBan puts a ban on each of the lists that don't have it yet and bans it on every server
+// subscribed to them, other than the one it came from
+func addBan(listIDs []int, ban database.Ban, originID int) {
+	banLock.Lock()
+	defer banLock.Unlock()
+
+	// Every server should end up with the same UUID, so work it out once
+	if !ban.IP && len(ban.UUID) == 0 && originID != 0 {
+		uuid, err := utils.PlayerUUID(originID, ban.Target)
+		if err != nil {
+			log.Printf("Could not find the UUID of %s: %s\n", ban.Target, err)
+		}
+		ban.UUID = uuid
+	}
+
+	var added []int
+	for _, listID := range listIDs {
+		var existing database.Ban
+		database.DB.Where(
+			"bans.ban_list_id = ? AND LOWER(bans.target) = LOWER(?)", listID, ban.Target,
+		).Limit(1).Find(&existing)
+		if existing.ID != nil {
+			mergeBan(existing, ban)
+			continue
+		}
+
+		record := ban
+		record.BanListID = listID
+		err := database.DB.Create(&record).Error
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		added = append(added, listID)
+	}
+
+	servers, err := subscribedServers(added, originID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, serverID := range servers {
+		err = applyBan(serverID, ban)
+		if err != nil {
+			log.Printf("Could not ban %s on server %d: %s\n", ban.Target, serverID, err)
+		}
+	}
+}
+
+// removeBans takes bans off their lists and pardons them on every server subscribed to them,
+// other than the one the pardon came from
+func removeBans(bans []database.Ban, originID int) {
+	for _, ban := range bans {
+		err := database.DB.Delete(&ban).Error
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		servers, err := subscribedServers([]int{ban.BanListID}, originID)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, serverID := range servers {
+			if stillBanned(serverID, ban) {
+				continue
+			}
+			err = liftBan(serverID, ban)
+			if err != nil {
+				log.Printf("Could not pardon %s on server %d: %s\n", ban.Target, serverID, err)
+			}
+		}
+	}
+}
+
+// Helper function to fill in what a ban already on a list is missing. A ban from msmf is seen
+// again in the console of the server it was done on, and either one can be shared first. Older
+// bans are left alone, so a permanent ban doesn't turn temporary
+func mergeBan(existing, ban database.Ban) {
+	if existing.ServerID == nil || ban.ServerID == nil || *existing.ServerID != *ban.ServerID ||
+		ban.Created.Sub(existing.Created) > banMergeWindow {
+		return
+	}
+	updates := make(map[string]interface{})
+	if existing.Expires == nil && ban.Expires != nil {
+		updates["expires"] = *ban.Expires
+	}
+	if len(existing.Reason) == 0 && len(ban.Reason) > 0 {
+		updates["reason"] = ban.Reason
+	}
+	if len(updates) == 0 {
+		return
+	}
+	err := database.DB.Model(&existing).Updates(updates).Error
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// shareBan shares a ban done on a server with every server subscribed to the same ban lists
+func shareBan(serverID int, ban database.Ban) {
+	listIDs, err := serverBanLists(serverID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if len(listIDs) == 0 {
+		return
+	}
+	ban.ServerID = &serverID
+	if ban.Created.IsZero() {
+		ban.Created = time.Now()
+	}
+	addBan(listIDs, ban, serverID)
+}
+
+// sharePardon shares a pardon done on a server with every server subscribed to the same ban lists
+func sharePardon(serverID int, target string) {
+	banLock.Lock()
+	defer banLock.Unlock()
+
+	var bans []database.Ban
+	err := database.DB.Joins(
+		"INNER JOIN ban_list_servers bls ON bls.ban_list_id = bans.ban_list_id",
+	).Where(
+		"bls.server_id = ? AND LOWER(bans.target) = LOWER(?)", serverID, target,
+	).Find(&bans).Error
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	removeBans(bans, serverID)
+}
+
+// shareConsoleBan shares a ban or pardon seen in the console output of a server. Ones done
+// over RCON came from msmf, which shares them itself
+func shareConsoleBan(serverID int, event *games.LogEvent) {
+	if event.Source == "Rcon" {
+		return
+	}
+	switch event.Action {
+	case games.ActionBan, games.ActionBanIP:
+		shareBan(serverID, database.Ban{
+			Target: event.Player,
+			IP:     event.Action == games.ActionBanIP,
+			Reason: event.Message,
+			Issuer: event.Source,
+		})
+	case games.ActionPardon, games.ActionPardonIP:
+		sharePardon(serverID, event.Player)
+	}
+}
+
+// expireBans pardons every ban that has run out
+func expireBans() {
+	banLock.Lock()
+	defer banLock.Unlock()
+
+	var bans []database.Ban
+	err := database.DB.Where("bans.expires < ?", time.Now()).Find(&bans).Error
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	removeBans(bans, 0)
+}
+
+// WatchBans lifts temporary bans on shared ban lists once they expire. It never returns
+func WatchBans() {
+	for {
+		expireBans()
+		time.Sleep(banExpiryInterval)
+	}
+}
+
+// Helper function to get the ban list in a request
+func requestBanList(w http.ResponseWriter, r *http.Request) (banList database.BanList, ok bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["list"])
+	if err == nil {
+		database.DB.Where("ban_lists.id = ?", id).Find(&banList)
+	}
+	if banList.ID == nil {
+		utils.ErrorJSON(w, http.StatusNotFound, "Ban list does not exist")
+		return banList, false
+	}
+	return banList, true
+}
+
+// Helper function to check a user can manage ban lists
+func checkBanListPerms(w http.ResponseWriter, r *http.Request) bool {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || !hasUserPerms(tokenCookie.Value, "administrator", "manage_ban_lists") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// GetBanLists lists every shared ban list so server owners can pick ones to subscribe to
+func GetBanLists(w http.ResponseWriter, r *http.Request) {
+	banLists := make([]database.BanList, 0)
+	err := database.DB.Order("ban_lists.name").Find(&banLists).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the ban lists
+	_, _ = w.Write(utils.ToJSON(&banLists))
+}
+
+// CreateBanList makes a new shared ban list
+func CreateBanList(w http.ResponseWriter, r *http.Request) {
+	// Check perms and bail if the perms aren't good
+	if !checkBanListPerms(w, r) {
+		return
+	}
+
+	var banList database.BanList
+	err := json.NewDecoder(r.Body).Decode(&banList)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	banList.ID = nil
+	banList.Name = strings.TrimSpace(banList.Name)
+	if len(banList.Name) == 0 || len(banList.Name) > 64 {
+		utils.ErrorJSON(w, http.StatusBadRequest, "Must supply a name of up to 64 characters")
+		return
+	}
+
+	result := database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&banList)
+	if result.Error != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, result.Error.Error())
+		return
+	}
+	if result.RowsAffected == 0 {
+		utils.ErrorJSON(w, http.StatusConflict, "Ban list already exists")
+		return
+	}
+
+	// Write out the ban list
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(utils.ToJSON(&banList))
+}
+
+// DeleteBanList deletes a shared ban list. Its bans stay on the servers that had them
+func DeleteBanList(w http.ResponseWriter, r *http.Request) {
+	// Check perms and bail if the perms aren't good
+	if !checkBanListPerms(w, r) {
+		return
+	}
+	banList, ok := requestBanList(w, r)
+	if !ok {
+		return
+	}
+
+	err := database.DB.Delete(&banList).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out response
+	resp := make(map[string]string)
+	resp["status"] = "Success"
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
+
+// GetBans lists the bans on a shared ban list
+func GetBans(w http.ResponseWriter, r *http.Request) {
+	// Check perms and bail if the perms aren't good
+	if !checkBanListPerms(w, r) {
+		return
+	}
+	banList, ok := requestBanList(w, r)
+	if !ok {
+		return
+	}
+
+	bans := make([]database.Ban, 0)
+	err := database.DB.Where("bans.ban_list_id = ?", banList.ID).Order("bans.created DESC").Find(&bans).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the bans
+	_, _ = w.Write(utils.ToJSON(&bans))
+}
+
+// AddBan bans a player or IP on every server subscribed to a shared ban list
+func AddBan(w http.ResponseWriter, r *http.Request) {
+	// Check perms and bail if the perms aren't good
+	if !checkBanListPerms(w, r) {
+		return
+	}
+	banList, ok := requestBanList(w, r)
+	if !ok {
+		return
+	}
+	user, _ := currentUser(r)
+
+	body := make(map[string]string)
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	target := body["target"]
+	isIP := net.ParseIP(target) != nil
+	if !isIP && !playerName.MatchString(target) {
+		utils.ErrorJSON(w, http.StatusBadRequest, errBadTarget.Error())
+		return
+	}
+	expires, err := parseExpires(body["expires"])
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Servers find the UUID themselves if it isn't known yet
+	var uuid string
+	if !isIP {
+		var player database.Player
+		database.DB.Where("LOWER(players.name) = LOWER(?)", target).Order("players.last_seen DESC").Limit(1).Find(&player)
+		uuid = player.UUID
+	}
+
+	go addBan([]int{*banList.ID}, database.Ban{
+		Target:  target,
+		UUID:    uuid,
+		IP:      isIP,
+		Reason:  strings.Join(strings.Fields(body["reason"]), " "),
+		Issuer:  user.Username,
+		Created: time.Now(),
+		Expires: expires,
+	}, 0)
+
+	// Write out response
+	w.WriteHeader(http.StatusAccepted)
+	resp := make(map[string]string)
+	resp["status"] = "Success"
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
+
+// RemoveBan pardons a ban on every server subscribed to a shared ban list
+func RemoveBan(w http.ResponseWriter, r *http.Request) {
+	// Check perms and bail if the perms aren't good
+	if !checkBanListPerms(w, r) {
+		return
+	}
+	banList, ok := requestBanList(w, r)
+	if !ok {
+		return
+	}
+
+	var ban database.Ban
+	database.DB.Where("bans.id = ? AND bans.ban_list_id = ?", mux.Vars(r)["ban"], banList.ID).Find(&ban)
+	if ban.ID == nil {
+		utils.ErrorJSON(w, http.StatusNotFound, "Ban does not exist")
+		return
+	}
+
+	go func() {
+		banLock.Lock()
+		defer banLock.Unlock()
+		removeBans([]database.Ban{ban}, 0)
+	}()
+
+	// Write out response
+	w.WriteHeader(http.StatusAccepted)
+	resp := make(map[string]string)
+	resp["status"] = "Success"
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
+
+// GetServerBanLists lists the ban lists a server subscribes to
+func GetServerBanLists(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "ban") {
+		return
+	}
+
+	banLists := make([]database.BanList, 0)
+	err := database.DB.Joins(
+		"INNER JOIN ban_list_servers bls ON bls.ban_list_id = ban_lists.id",
+	).Where("bls.server_id = ?", serverID).Order("ban_lists.name").Find(&banLists).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the ban lists
+	_, _ = w.Write(utils.ToJSON(&banLists))
+}
+
+// SubscribeBanList subscribes a server to a ban list. Everything already on the list is
+// banned on the server
+func SubscribeBanList(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "administrator") {
+		return
+	}
+	banList, ok := requestBanList(w, r)
+	if !ok {
+		return
+	}
+	if _, ok = requestList(w, serverID, "banned-players"); !ok {
+		return
+	}
+
+	result := database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&database.BanListServer{
+		BanListID: *banList.ID,
+		ServerID:  serverID,
+	})
+	if result.Error != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, result.Error.Error())
+		return
+	}
+
+	// Catch the server up on the list
+	if result.RowsAffected > 0 {
+		go func() {
+			banLock.Lock()
+			defer banLock.Unlock()
+
+			var bans []database.Ban
+			database.DB.Where("bans.ban_list_id = ?", banList.ID).Find(&bans)
+			for _, ban := range bans {
+				err := applyBan(serverID, ban)
+				if err != nil {
+					log.Printf("Could not ban %s on server %d: %s\n", ban.Target, serverID, err)
+				}
+			}
+		}()
+	}
+
+	// Write out response
+	resp := make(map[string]string)
+	resp["status"] = "Success"
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
+
+// UnsubscribeBanList unsubscribes a server from a ban list. Bans already on the server stay
+func UnsubscribeBanList(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "administrator") {
+		return
+	}
+	banList, ok := requestBanList(w, r)
+	if !ok {
+		return
+	}
+
+	result := database.DB.Where(
+		"ban_list_servers.ban_list_id = ? AND ban_list_servers.server_id = ?", banList.ID, serverID,
+	).Delete(&database.BanListServer{})
+	if result.Error != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, result.Error.Error())
+		return
+	}
+	if result.RowsAffected == 0 {
+		utils.ErrorJSON(w, http.StatusNotFound, "Server is not subscribed to the ban list")
+		return
+	}
+
+	// Write out response
+	resp := make(map[string]string)
+	resp["status"] = "Success"
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
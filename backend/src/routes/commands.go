@@ -0,0 +1,135 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"msmf/database"
+	"msmf/utils"
+)
+
+// Helper function to run a command on a server and record it in the server logs. RCON is used
+// when it can be so the response comes back, otherwise the command is typed into the console
+// and the response is empty
+func serverCommand(serverID int, command string, userID *int, source string) (string, error) {
+	utils.RecordCommand(serverID, userID, source, command)
+	output, err := utils.RconCommand(serverID, command)
+	if err == nil {
+		return output, nil
+	}
+	// Only fall back when the command never reached the server, otherwise it could run twice
+	if !errors.Is(err, utils.ErrNoRcon) && !utils.RconUnsent(err) {
+		return "", err
+	}
+
+	// Fall back to the console, which only works if the server is running
+	connDetails, consoleErr := AttachConsole(serverID)
+	if consoleErr != nil {
+		return "", errors.New("server is not running")
+	}
+	return "", connDetails.Input([]byte(command + "\n"))
+}
+
+// RunCommand runs a single command on a server over RCON and returns what the server said back
+func RunCommand(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.String())
+
+	// Anyone with a rule letting them run commands can use this, the command is checked below
+	user, err := currentUser(r)
+	if err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	checker, err := newCommandChecker(serverID, *user.ID)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !checker.CanWrite() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Get the command out of the body
+	body := make(map[string]string)
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Commands typed in game start with a slash, the console doesn't want it
+	command := strings.TrimPrefix(strings.TrimSpace(body["command"]), "/")
+	if len(command) == 0 {
+		utils.ErrorJSON(w, http.StatusBadRequest, "Must supply a command")
+		return
+	}
+
+	if !checker.Allowed(command) {
+		utils.RecordRejectedCommand(serverID, user.ID, utils.SourceAPI, command)
+		utils.ErrorJSON(w, http.StatusForbidden, "You are not allowed to run that command")
+		return
+	}
+
+	utils.RecordCommand(serverID, user.ID, utils.SourceAPI, command)
+	output, err := utils.RconCommand(serverID, command)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Write out response
+	resp := make(map[string]string)
+	resp["status"] = "Success"
+	resp["response"] = output
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
+
+// GetServerCommands lists the commands sent to a server. It can be filtered by a comma separated
+// list of sources with source, by portal user with user, by player with player, by whether
+// they were rejected with rejected, and by commands containing some text with search
+func GetServerCommands(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "view_logs") {
+		return
+	}
+
+	params := r.URL.Query()
+	query := database.DB.Preload("User").Preload("Player").Where("server_logs.server_id = ?", serverID)
+	if source := params.Get("source"); len(source) > 0 {
+		query = query.Where("server_logs.source IN ?", strings.Split(source, ","))
+	}
+	if username := params.Get("user"); len(username) > 0 {
+		query = query.Where("server_logs.user_id IN (SELECT id FROM users WHERE username = ?)", username)
+	}
+	if player := params.Get("player"); len(player) > 0 {
+		query = query.Where(
+			"server_logs.player_id IN (SELECT id FROM players WHERE uuid = ? OR name = ?)",
+			strings.ToLower(player), player,
+		)
+	}
+	if rejected := params.Get("rejected"); len(rejected) > 0 {
+		query = query.Where("server_logs.rejected = ?", rejected == "true")
+	}
+	if search := params.Get("search"); len(search) > 0 {
+		query = query.Where("server_logs.command ILIKE ?", "%"+search+"%")
+	}
+	query, err := pageLogs(query, r, "server_logs")
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	logs := make([]database.ServerLog, 0)
+	err = query.Find(&logs).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the logs
+	_, _ = w.Write(utils.ToJSON(&logs))
+}
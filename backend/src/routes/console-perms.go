@@ -0,0 +1,293 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+
+	"msmf/database"
+	"msmf/utils"
+)
+
+// errNotAllowed is returned when a user isn't allowed to send a command
+var errNotAllowed = errors.New("you are not allowed to run that command")
+
+// Helper function to get the names of the permissions a user has on a server
+func userServerPerms(serverID, userID int) (perms []string, err error) {
+	err = database.DB.Table("server_perms_per_users sppu").Joins(
+		"INNER JOIN server_perms sp ON sppu.server_perm_id = sp.id",
+	).Where("sppu.server_id = ? AND sppu.user_id = ?", serverID, userID).Pluck("sp.name", &perms).Error
+	return perms, err
+}
+
+// Commands can be given with the namespace they come from, like minecraft:op
+var commandNamespace = regexp.MustCompile(`(?i)^[a-z0-9_.-]+:`)
+
+// normalizeCommand strips what doesn't change which command runs, such as a leading slash,
+// extra spaces and the namespace
+func normalizeCommand(command string) string {
+	command = strings.Join(strings.Fields(strings.TrimPrefix(strings.TrimSpace(command), "/")), " ")
+	return commandNamespace.ReplaceAllString(command, "")
+}
+
+// commandsRun gets every command a line would run. Execute runs whatever comes after a run, so
+// everything after each run is counted in case a name in between happens to be run too
+func commandsRun(command string) []string {
+	command = normalizeCommand(command)
+	commands := []string{command}
+	words := strings.Fields(command)
+	if len(words) == 0 || !strings.EqualFold(words[0], "execute") {
+		return commands
+	}
+	for i, word := range words {
+		if strings.EqualFold(word, "run") && i+1 < len(words) {
+			commands = append(commands, normalizeCommand(strings.Join(words[i+1:], " ")))
+		}
+	}
+	return commands
+}
+
+// Helper function to check for characters that could sneak a second command onto a line, like
+// newlines
+func hasControl(command string) bool {
+	return strings.IndexFunc(command, unicode.IsControl) >= 0
+}
+
+// commandPattern turns a rule pattern into a regex. Patterns match the start of a command a
+// whole word at a time, and * matches anything, so "tp" matches "tp Steve" but not "tpa"
+func commandPattern(pattern string) (*regexp.Regexp, error) {
+	pattern = normalizeCommand(pattern)
+	if len(pattern) == 0 {
+		return nil, errors.New("must supply a pattern")
+	}
+	quoted := strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, `.*`)
+	return regexp.Compile(`(?i)^` + quoted + `(?:\s|$)`)
+}
+
+// commandChecker decides which console commands a user can send to a server
+type commandChecker struct {
+	// Administrators can send anything
+	admin bool
+	// What happens when no rule matches
+	allowed bool
+	// Rules for the user come before rules for their permissions
+	userRules []database.CommandRule
+	permRules []database.CommandRule
+}
+
+// newCommandChecker loads the permissions and command rules of a user on a server
+func newCommandChecker(serverID, userID int) (*commandChecker, error) {
+	perms, err := userServerPerms(serverID, userID)
+	if err != nil {
+		return nil, err
+	}
+	checker := &commandChecker{}
+	for _, perm := range perms {
+		switch perm {
+		case "administrator":
+			checker.admin = true
+		case "manage_server_console":
+			checker.allowed = true
+		}
+	}
+
+	err = database.DB.Where(
+		"command_rules.server_id = ? AND command_rules.user_id = ?", serverID, userID,
+	).Find(&checker.userRules).Error
+	if err != nil {
+		return nil, err
+	}
+	err = database.DB.Joins(
+		"INNER JOIN server_perms sp ON command_rules.server_perm_id = sp.id",
+	).Where("command_rules.server_id = ? AND sp.name IN ?", serverID, perms).Find(&checker.permRules).Error
+	return checker, err
+}
+
+// CanWrite reports whether the user can send any commands at all. Everyone else only gets to watch
+func (c *commandChecker) CanWrite() bool {
+	if c.admin || c.allowed {
+		return true
+	}
+	for _, rules := range [][]database.CommandRule{c.userRules, c.permRules} {
+		for _, rule := range rules {
+			if rule.Allow {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Allowed checks a command against the rules. A matching deny beats a matching allow. Commands
+// run by execute have to be allowed too, and anything spanning more than one line never is
+func (c *commandChecker) Allowed(command string) bool {
+	if c.admin {
+		return true
+	}
+	if hasControl(command) {
+		return false
+	}
+	for _, command := range commandsRun(command) {
+		if !c.matchRules(command) {
+			return false
+		}
+	}
+	return true
+}
+
+// Helper function to check a single command against the rules
+func (c *commandChecker) matchRules(command string) bool {
+	for _, rules := range [][]database.CommandRule{c.userRules, c.permRules} {
+		matched := false
+		for _, rule := range rules {
+			pattern, err := commandPattern(rule.Pattern)
+			if err != nil || !pattern.MatchString(command) {
+				continue
+			}
+			if !rule.Allow {
+				return false
+			}
+			matched = true
+		}
+		if matched {
+			return true
+		}
+	}
+	return c.allowed
+}
+
+// checkCommand checks a user can send a command to a server, recording it as rejected if not
+func checkCommand(serverID int, user database.User, source, command string) error {
+	if user.ID == nil {
+		return errNotAllowed
+	}
+	checker, err := newCommandChecker(serverID, *user.ID)
+	if err != nil {
+		return err
+	}
+	if !checker.Allowed(command) {
+		utils.RecordRejectedCommand(serverID, user.ID, source, command)
+		return errNotAllowed
+	}
+	return nil
+}
+
+// GetCommandRules lists the console command rules of a server
+func GetCommandRules(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "administrator") {
+		return
+	}
+
+	rules := make([]database.CommandRule, 0)
+	err := database.DB.Preload("User").Preload("ServerPerm").Where(
+		"command_rules.server_id = ?", serverID,
+	).Order("command_rules.id").Find(&rules).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the rules
+	_, _ = w.Write(utils.ToJSON(&rules))
+}
+
+// AddCommandRule allows or denies console commands on a server for a user, or for everyone
+// with a server permission
+func AddCommandRule(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "administrator") {
+		return
+	}
+
+	// Get JSON of body
+	body := struct {
+		Username   string `json:"username"`
+		Permission string `json:"permission"`
+		Pattern    string `json:"pattern"`
+		Allow      bool   `json:"allow"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if (len(body.Username) == 0) == (len(body.Permission) == 0) {
+		utils.ErrorJSON(w, http.StatusBadRequest, "Must supply either a username or a permission")
+		return
+	}
+	_, err = commandPattern(body.Pattern)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rule := database.CommandRule{
+		ServerID: serverID,
+		Pattern:  strings.TrimSpace(body.Pattern),
+		Allow:    body.Allow,
+	}
+	if len(body.Username) > 0 {
+		var user database.User
+		database.DB.Where("users.username = ?", body.Username).Find(&user)
+		if user.ID == nil {
+			utils.ErrorJSON(w, http.StatusNotFound, "User does not exist")
+			return
+		}
+		rule.UserID = user.ID
+	} else {
+		var perm database.ServerPerm
+		database.DB.Where("server_perms.name = ?", body.Permission).Find(&perm)
+		if perm.ID == nil {
+			utils.ErrorJSON(w, http.StatusBadRequest, "Permission does not exist")
+			return
+		}
+		rule.ServerPermID = perm.ID
+	}
+
+	err = database.DB.Create(&rule).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the rule
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(utils.ToJSON(&rule))
+}
+
+// DeleteCommandRule deletes a console command rule from a server
+func DeleteCommandRule(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "administrator") {
+		return
+	}
+
+	result := database.DB.Where(
+		"command_rules.id = ? AND command_rules.server_id = ?", mux.Vars(r)["rule"], serverID,
+	).Delete(&database.CommandRule{})
+	if result.Error != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, result.Error.Error())
+		return
+	}
+	if result.RowsAffected == 0 {
+		utils.ErrorJSON(w, http.StatusNotFound, "Rule does not exist")
+		return
+	}
+
+	// Write out response
+	resp := make(map[string]string)
+	resp["status"] = "Success"
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
@@ -0,0 +1,47 @@
+package routes
+
+import (
+	"testing"
+
+	"msmf/database"
+)
+
+func TestCommandCheckerAllowed(t *testing.T) {
+	checker := &commandChecker{
+		allowed: true,
+		permRules: []database.CommandRule{
+			{Pattern: "op", Allow: false},
+			{Pattern: "stop", Allow: false},
+		},
+	}
+	tests := []struct {
+		command string
+		allowed bool
+	}{
+		{"say hi", true},
+		{"/say hi", true},
+		{"op me", false},
+		{"/OP me", false},
+		{"minecraft:op me", false},
+		{"/minecraft:op me", false},
+		{"execute as @s run op me", false},
+		{"execute as @s run minecraft:op me", false},
+		{"execute as run run op me", false},
+		{"execute as @s run execute at @s run stop", false},
+		{"execute as @s run say hi", true},
+		{"say hi\nop me", false},
+		{"say hi\rop me", false},
+		{"say hi\x00", false},
+		{"opera", true},
+	}
+	for _, test := range tests {
+		if allowed := checker.Allowed(test.command); allowed != test.allowed {
+			t.Errorf("Allowed(%q) = %v, want %v", test.command, allowed, test.allowed)
+		}
+	}
+
+	admin := &commandChecker{admin: true}
+	if !admin.Allowed("op me") {
+		t.Error("administrators should be able to send anything")
+	}
+}
@@ -0,0 +1,412 @@
+package routes
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"msmf/utils"
+)
+
+// consoleProtocolVersion is the version of the JSON console protocol. It goes up whenever a
+// change would break existing clients
+const consoleProtocolVersion = 1
+
+// Types of console messages. Clients send input, resize, ping, subscribe and unsubscribe,
+// everything else comes from msmf
+const (
+	// The first message on a socket, with the protocol version and what the client can do
+	msgHello = "hello"
+	// A line of console output
+	msgOutput = "output"
+	// A command someone typed, echoed to everyone watching
+	msgInput = "input"
+	// The server started or stopped
+	msgState = "state"
+	// Something the client sent didn't work
+	msgError = "error"
+	// The client's terminal changed size
+	msgResize = "resize"
+	msgPing   = "ping"
+	msgPong   = "pong"
+	// Start or stop watching a server on a multiplexed websocket. msmf answers an unsubscribe, or
+	// a server going away, with an unsubscribe of its own
+	msgSubscribe   = "subscribe"
+	msgUnsubscribe = "unsubscribe"
+	// Never sent, it tells the writer to close the websocket once everything before it is out
+	msgClose = "close"
+)
+
+// Server states sent to consoles
+const (
+	stateRunning = "running"
+	stateStopped = "stopped"
+	// The server is still running but msmf lost its console and is reattaching
+	stateDetached = "detached"
+)
+
+// consoleMessage is a message in the JSON console protocol. Only the fields that make sense for
+// the type are filled in
+type consoleMessage struct {
+	Type    string    `json:"type"`
+	Version int       `json:"version,omitempty"`
+	Time    time.Time `json:"time"`
+	// Output only
+	Stream string `json:"stream,omitempty"`
+	// Output is what the server wrote, input is the command and errors are what went wrong
+	Data string `json:"data,omitempty"`
+	// Who typed an input
+	Author string `json:"author,omitempty"`
+	// State changes, and the state when the socket opened
+	State string `json:"state,omitempty"`
+	// Whether the client can only watch
+	ReadOnly bool `json:"read_only,omitempty"`
+	// Output from before the client connected
+	Replay bool `json:"replay,omitempty"`
+	// Terminal size for resizes
+	Cols int `json:"cols,omitempty"`
+	Rows int `json:"rows,omitempty"`
+	// How many messages a slow client missed
+	Dropped int `json:"dropped,omitempty"`
+	// Which server a message on a multiplexed websocket is about
+	Server int `json:"server,omitempty"`
+	// How much scrollback to replay when subscribing, all of it if left out
+	Lines *int `json:"lines,omitempty"`
+}
+
+// Helper functions to make the messages msmf sends
+func outputMessage(stream string, data []byte) consoleMessage {
+	return consoleMessage{Type: msgOutput, Time: time.Now(), Stream: stream, Data: string(data)}
+}
+
+func inputMessage(author, command string) consoleMessage {
+	return consoleMessage{Type: msgInput, Time: time.Now(), Author: author, Data: command}
+}
+
+func stateMessage(state string) consoleMessage {
+	return consoleMessage{Type: msgState, Time: time.Now(), State: state}
+}
+
+func errorMessage(err string) consoleMessage {
+	return consoleMessage{Type: msgError, Time: time.Now(), Data: err}
+}
+
+func closeMessage(reason string) consoleMessage {
+	return consoleMessage{Type: msgClose, Data: reason}
+}
+
+// Timings for keeping websockets alive
+const (
+	// How long a single write can take before the client is given up on
+	consoleWriteWait = 10 * time.Second
+	// How long to wait for a pong before the client is given up on
+	consolePongWait = 60 * time.Second
+	// How often to ping, this has to be less than consolePongWait
+	consolePingPeriod = consolePongWait * 9 / 10
+)
+
+// consoleQueueSize is how many messages can wait for each websocket before they are dropped
+var consoleQueueSize = func() int {
+	size := utils.EnvInt("CONSOLE_QUEUE", 256)
+	if size < 1 {
+		size = 1
+	}
+	return size
+}()
+
+// consoleDisconnectSlow is whether websockets that fall behind are disconnected instead of
+// having messages dropped
+var consoleDisconnectSlow = os.Getenv("CONSOLE_SLOW_CLIENTS") == "disconnect"
+
+// consoleStats counts console output that didn't make it to a websocket on a server
+type consoleStats struct {
+	Dropped         int64 `json:"dropped"`
+	SlowDisconnects int64 `json:"slow_disconnects"`
+}
+
+// consoleMetrics holds the stats of every server since msmf started
+var consoleMetrics = make(map[int]*consoleStats)
+
+// metricsLock is a lock for accessing the consoleMetrics map
+var metricsLock sync.Mutex
+
+// getConsoleStats gets the stats of a server
+func getConsoleStats(serverID int) *consoleStats {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	stats, exists := consoleMetrics[serverID]
+	if !exists {
+		stats = &consoleStats{}
+		consoleMetrics[serverID] = stats
+	}
+	return stats
+}
+
+// consoleSubscriber is a websocket, or an SSH session, watching a server console
+type consoleSubscriber struct {
+	// The websocket, which is nil for consoles that aren't watched over a websocket
+	conn *websocket.Conn
+	// Closes whatever the subscriber is writing to
+	hangup func()
+	// Raw mode sends output as plain frames, stdout as text and stderr as binary, like before
+	// there was a JSON protocol. Only output, input and errors are sent
+	raw bool
+	// Messages waiting to be written out, in the order they happened
+	messages chan consoleMessage
+	// Where dropped messages are counted
+	stats *consoleStats
+	// Records the session if it's being recorded, even what the websocket was too slow for
+	recorder *recorder
+	// The server messages are tagged with on a multiplexed websocket
+	server int
+	// Closed once the writer stops
+	done chan struct{}
+
+	// Lock for dropped
+	lock sync.Mutex
+	// Messages dropped since the client was last told
+	dropped int
+	// While holding, messages are kept back until the replay before them has been queued
+	holding bool
+	held    []consoleMessage
+}
+
+// newConsoleSubscriber makes a subscriber for a websocket on a server
+func newConsoleSubscriber(conn *websocket.Conn, serverID int, raw bool) *consoleSubscriber {
+	// Clients that stop answering pings are dropped
+	_ = conn.SetReadDeadline(time.Now().Add(consolePongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(consolePongWait))
+	})
+
+	// Multiplexed websockets count what they drop on each server they watch instead
+	stats := &consoleStats{}
+	if serverID != 0 {
+		stats = getConsoleStats(serverID)
+	}
+	return &consoleSubscriber{
+		conn:     conn,
+		hangup:   func() { _ = conn.Close() },
+		raw:      raw,
+		messages: make(chan consoleMessage, consoleQueueSize),
+		stats:    stats,
+		done:     make(chan struct{}),
+	}
+}
+
+// child makes a subscriber for one server on a multiplexed websocket. It shares the websocket
+// and queue but tags its messages with the server. Output is held until flush is called
+func (s *consoleSubscriber) child(serverID int) *consoleSubscriber {
+	return &consoleSubscriber{
+		conn:     s.conn,
+		hangup:   s.hangup,
+		messages: s.messages,
+		stats:    getConsoleStats(serverID),
+		server:   serverID,
+		done:     s.done,
+		holding:  true,
+	}
+}
+
+// flush stops holding messages back and queues the ones that were
+func (s *consoleSubscriber) flush() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.holding = false
+	for _, msg := range s.held {
+		s.queue(msg)
+	}
+	s.held = nil
+}
+
+// wait queues a message, blocking until there is room or the writer stops. It returns whether
+// the message was queued
+func (s *consoleSubscriber) wait(msg consoleMessage) bool {
+	select {
+	case s.messages <- msg:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// send queues a message for the websocket without ever blocking. If the queue is full the
+// message is dropped, or the websocket is disconnected if slow clients aren't tolerated
+func (s *consoleSubscriber) send(msg consoleMessage) {
+	if s.recorder != nil {
+		s.recorder.Record(msg)
+	}
+
+	// A server going away only ends its own subscription on a multiplexed websocket
+	if s.server != 0 {
+		msg.Server = s.server
+		if msg.Type == msgClose {
+			msg = consoleMessage{Type: msgUnsubscribe, Time: time.Now(), Server: s.server, Data: msg.Data}
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.holding {
+		if len(s.held) < consoleQueueSize {
+			s.held = append(s.held, msg)
+		} else {
+			s.dropped++
+			atomic.AddInt64(&s.stats.Dropped, 1)
+		}
+		return
+	}
+	s.queue(msg)
+}
+
+// queue puts a message in the queue, or handles it not fitting. Lock must already be held
+func (s *consoleSubscriber) queue(msg consoleMessage) {
+	// Let the client know what it missed once there is room again
+	if s.dropped > 0 && msg.Type != msgClose {
+		notice := errorMessage("Messages were dropped because the connection is too slow")
+		notice.Dropped = s.dropped
+		notice.Server = s.server
+		select {
+		case s.messages <- notice:
+			s.dropped = 0
+		default:
+		}
+	}
+
+	select {
+	case s.messages <- msg:
+		return
+	default:
+	}
+
+	// Closing still has to happen, so do it now
+	if msg.Type == msgClose {
+		s.hangup()
+		return
+	}
+	if consoleDisconnectSlow {
+		if s.dropped == 0 {
+			atomic.AddInt64(&s.stats.SlowDisconnects, 1)
+			log.Println("websocket too slow, disconnecting")
+		}
+		s.hangup()
+	}
+	s.dropped++
+	atomic.AddInt64(&s.stats.Dropped, 1)
+}
+
+// encode turns a message into a websocket frame. Messages raw mode has no way to show are skipped
+func (s *consoleSubscriber) encode(msg consoleMessage) (messageType int, data []byte, ok bool) {
+	if !s.raw {
+		data, err := json.Marshal(msg)
+		return websocket.TextMessage, data, err == nil
+	}
+	switch msg.Type {
+	case msgOutput:
+		if msg.Stream == streamStderr {
+			return websocket.BinaryMessage, []byte(msg.Data), true
+		}
+		return websocket.TextMessage, []byte(msg.Data), true
+	case msgInput:
+		return websocket.TextMessage, []byte(msg.Data + "\n"), true
+	case msgError:
+		return websocket.BinaryMessage, []byte(msg.Data + "\n"), true
+	}
+	return 0, nil, false
+}
+
+// write writes a message straight to the websocket. Only one goroutine can write at a time
+func (s *consoleSubscriber) write(msg consoleMessage) error {
+	messageType, data, ok := s.encode(msg)
+	if !ok {
+		return nil
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(consoleWriteWait))
+	return s.conn.WriteMessage(messageType, data)
+}
+
+// writeLoop writes out queued messages and keeps the websocket alive with pings until the queue
+// is closed. If the websocket fails it's closed so the reader notices and cleans up
+func (s *consoleSubscriber) writeLoop() {
+	ticker := time.NewTicker(consolePingPeriod)
+	defer ticker.Stop()
+	defer close(s.done)
+
+	for {
+		var err error
+		select {
+		case msg, ok := <-s.messages:
+			if !ok {
+				return
+			}
+			if msg.Type == msgClose {
+				_ = s.conn.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, msg.Data),
+					time.Now().Add(consoleWriteWait),
+				)
+				_ = s.conn.Close()
+				return
+			}
+			err = s.write(msg)
+		case <-ticker.C:
+			err = s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(consoleWriteWait))
+		}
+		if err != nil {
+			log.Println("websocket err:", err)
+			_ = s.conn.Close()
+			return
+		}
+	}
+}
+
+// decode reads a message a client sent. Every text frame in raw mode is a command
+func (s *consoleSubscriber) decode(messageType int, data []byte) (msg consoleMessage, ok bool) {
+	if s.raw {
+		if messageType != websocket.TextMessage {
+			return msg, false
+		}
+		return consoleMessage{Type: msgInput, Data: string(data)}, true
+	}
+	return msg, json.Unmarshal(data, &msg) == nil
+}
+
+// GetConsoleMetrics shows how many websockets are watching a server console and how much output
+// didn't reach them because they were too slow
+func GetConsoleMetrics(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "view_logs") {
+		return
+	}
+
+	subscribers := 0
+	attached := false
+	WsLock.Lock()
+	connDetails, exists := AttachedServers[serverID]
+	WsLock.Unlock()
+	if exists {
+		connDetails.SLock.Lock()
+		subscribers = len(connDetails.SPMC)
+		attached = connDetails.attached
+		connDetails.SLock.Unlock()
+	}
+	stats := getConsoleStats(serverID)
+
+	// Write out the metrics
+	resp := make(map[string]interface{})
+	resp["attached"] = attached
+	resp["subscribers"] = subscribers
+	resp["queue_size"] = consoleQueueSize
+	resp["disconnect_slow"] = consoleDisconnectSlow
+	resp["dropped"] = atomic.LoadInt64(&stats.Dropped)
+	resp["slow_disconnects"] = atomic.LoadInt64(&stats.SlowDisconnects)
+	_, _ = w.Write(utils.ToJSON(resp))
+}
@@ -0,0 +1,199 @@
+package routes
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"msmf/database"
+	"msmf/utils"
+)
+
+// muxedConsole is one server console watched on a multiplexed websocket
+type muxedConsole struct {
+	sub         *consoleSubscriber
+	connDetails *ConnDetails
+	readOnly    bool
+}
+
+// consoleMux is a websocket watching many server consoles at once
+type consoleMux struct {
+	root *consoleSubscriber
+	user database.User
+	// Only the reader touches this, so it needs no lock
+	consoles map[int]*muxedConsole
+}
+
+// WsConsolesHandler accepts websockets that watch many server consoles at once. Clients
+// subscribe to servers by ID and every message is tagged with the server it's about. Messages
+// always use the JSON console protocol
+func WsConsolesHandler(w http.ResponseWriter, r *http.Request) {
+	// Commands are recorded against whoever typed them
+	user, err := currentUser(r)
+	if err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Upgrade the http connection to a websocket
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	m := &consoleMux{
+		root:     newConsoleSubscriber(conn, 0, false),
+		user:     user,
+		consoles: make(map[int]*muxedConsole),
+	}
+	go m.root.writeLoop()
+	m.root.send(consoleMessage{Type: msgHello, Version: consoleProtocolVersion, Time: time.Now()})
+	m.read()
+}
+
+// read reads in messages from the websocket until it closes, then unsubscribes from everything
+func (m *consoleMux) read() {
+	for {
+		messageType, data, err := m.root.conn.ReadMessage()
+		if err != nil {
+			log.Println("websocket err:", err)
+			break
+		}
+
+		msg, ok := m.root.decode(messageType, data)
+		if !ok {
+			m.root.send(errorMessage("messages must be JSON"))
+			continue
+		}
+
+		switch msg.Type {
+		case msgSubscribe:
+			lines := -1
+			if msg.Lines != nil {
+				lines = *msg.Lines
+			}
+			m.subscribe(msg.Server, lines)
+		case msgUnsubscribe:
+			if !m.unsubscribe(msg.Server) {
+				m.error(msg.Server, "not subscribed")
+				continue
+			}
+			m.root.send(consoleMessage{Type: msgUnsubscribe, Time: time.Now(), Server: msg.Server})
+		case msgInput:
+			console, exists := m.consoles[msg.Server]
+			if !exists {
+				m.error(msg.Server, "not subscribed")
+				continue
+			}
+			sendInput(console.sub, console.connDetails, m.user, console.readOnly, utils.SourceConsole, msg.Data)
+		case msgPing:
+			m.root.send(consoleMessage{Type: msgPong, Time: time.Now()})
+		case msgResize:
+			// The game console isn't a terminal, so there is nothing to resize
+		default:
+			m.root.send(errorMessage("unknown message type " + msg.Type))
+		}
+	}
+
+	// Everything has to be out of the SPMCs before the queue can be closed
+	for serverID := range m.consoles {
+		m.unsubscribe(serverID)
+	}
+	close(m.root.messages)
+	// Best effort close the connection since something is wrong
+	_ = m.root.conn.Close()
+}
+
+// error tells the client something went wrong with a server
+func (m *consoleMux) error(serverID int, err string) {
+	msg := errorMessage(err)
+	msg.Server = serverID
+	m.root.send(msg)
+}
+
+// subscribe starts watching a server console, checking permissions the same way a websocket for
+// a single server does. The client gets a hello for the server and its scrollback before any
+// new output
+func (m *consoleMux) subscribe(serverID, lines int) {
+	// A server that went away leaves a subscription behind that can be replaced
+	if console, exists := m.consoles[serverID]; exists {
+		console.connDetails.SLock.Lock()
+		released := console.connDetails.released
+		console.connDetails.SLock.Unlock()
+		if !released {
+			m.error(serverID, "already subscribed")
+			return
+		}
+		m.unsubscribe(serverID)
+	}
+
+	// Check perms and bail if the perms aren't good
+	if serverID <= 0 || !canWatchConsole(*m.user.ID, serverID) {
+		m.error(serverID, "Forbidden")
+		return
+	}
+
+	// Users that can't send any commands only get to watch
+	checker, err := newCommandChecker(serverID, *m.user.ID)
+	if err != nil {
+		m.error(serverID, err.Error())
+		return
+	}
+	readOnly := !checker.CanWrite()
+
+	connDetails, err := AttachConsole(serverID)
+	if err != nil {
+		m.error(serverID, err.Error())
+		return
+	}
+
+	// New output is held back until the scrollback is queued
+	sub := m.root.child(serverID)
+	recordSession(sub, checker, serverID, m.user)
+	connDetails, replay, state, err := watchConsole(connDetails, sub, lines)
+	if err != nil {
+		m.error(serverID, err.Error())
+		if sub.recorder != nil {
+			sub.recorder.Close()
+		}
+		return
+	}
+	m.consoles[serverID] = &muxedConsole{sub: sub, connDetails: connDetails, readOnly: readOnly}
+
+	// Say hello and catch the client up on what it missed
+	ok := sub.wait(consoleMessage{
+		Type:     msgHello,
+		Version:  consoleProtocolVersion,
+		Time:     time.Now(),
+		State:    state,
+		ReadOnly: readOnly,
+		Server:   serverID,
+	})
+	for _, line := range replay {
+		if !ok {
+			break
+		}
+		msg := replayMessage(line)
+		msg.Server = serverID
+		ok = sub.wait(msg)
+	}
+	sub.flush()
+}
+
+// unsubscribe stops watching a server console. It returns whether the client was watching it
+func (m *consoleMux) unsubscribe(serverID int) bool {
+	console, exists := m.consoles[serverID]
+	if !exists {
+		return false
+	}
+	delete(m.consoles, serverID)
+
+	console.connDetails.SLock.Lock()
+	delete(console.connDetails.SPMC, console.sub)
+	console.connDetails.SLock.Unlock()
+	if console.sub.recorder != nil {
+		console.sub.recorder.Close()
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/ssh"
+
+	"msmf/database"
+	"msmf/utils"
+)
+
+// GetSSHKeys lists the SSH public keys of the current user
+func GetSSHKeys(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(r)
+	if err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	keys := make([]database.UserKey, 0)
+	err = database.DB.Where("user_keys.user_id = ?", *user.ID).Order("user_keys.id").Find(&keys).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the keys
+	_, _ = w.Write(utils.ToJSON(&keys))
+}
+
+// AddSSHKey registers an SSH public key for the current user to log in to consoles with. The
+// key is in the same format as a line of authorized_keys
+func AddSSHKey(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(r)
+	if err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Get JSON of body
+	body := struct {
+		Name string `json:"name"`
+		Key  string `json:"key"`
+	}{}
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(body.Key))
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, "Invalid public key")
+		return
+	}
+
+	// Default to the comment on the key
+	name := strings.TrimSpace(body.Name)
+	if len(name) == 0 {
+		name = comment
+	}
+	if len(name) > 64 {
+		utils.ErrorJSON(w, http.StatusBadRequest, "Name must be at most 64 characters")
+		return
+	}
+
+	userKey := database.UserKey{
+		UserID:      *user.ID,
+		Name:        name,
+		Key:         strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+		Fingerprint: ssh.FingerprintSHA256(key),
+		Created:     time.Now(),
+	}
+	var count int64
+	database.DB.Model(&database.UserKey{}).Where(
+		"user_keys.fingerprint = ?", userKey.Fingerprint,
+	).Count(&count)
+	if count > 0 {
+		utils.ErrorJSON(w, http.StatusConflict, "Key is already registered")
+		return
+	}
+
+	err = database.DB.Create(&userKey).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the key
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(utils.ToJSON(&userKey))
+}
+
+// DeleteSSHKey removes one of the current user's SSH public keys
+func DeleteSSHKey(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(r)
+	if err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	result := database.DB.Where(
+		"user_keys.id = ? AND user_keys.user_id = ?", mux.Vars(r)["key"], *user.ID,
+	).Delete(&database.UserKey{})
+	if result.Error != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, result.Error.Error())
+		return
+	}
+	if result.RowsAffected == 0 {
+		utils.ErrorJSON(w, http.StatusNotFound, "Key does not exist")
+		return
+	}
+
+	// Write out response
+	resp := make(map[string]string)
+	resp["status"] = "Success"
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
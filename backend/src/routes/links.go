@@ -0,0 +1,253 @@
+package routes
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	"msmf/database"
+	"msmf/utils"
+)
+
+// Characters link codes are made of. Ones that look alike are left out since people type them in game
+const linkCodeChars = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// How long a link code is good for
+const linkCodeExpiration = 10 * time.Minute
+
+// How many codes are tried before giving up on finding one that isn't taken
+const linkCodeAttempts = 5
+
+// Helper function to make a random link code
+func makeLinkCode() (string, error) {
+	code := make([]byte, 8)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(linkCodeChars))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = linkCodeChars[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// Helper function to send a message to a player in game. It's only a courtesy so errors are ignored
+func tellPlayer(serverID int, name, msg string) {
+	go func() {
+		_, err := utils.RconCommand(serverID, fmt.Sprintf("tell %s %s", name, msg))
+		if err != nil {
+			log.Printf("Could not message %s on server %d: %s\n", name, serverID, err)
+		}
+	}()
+}
+
+// Helper function to link a player to a user. A player can only belong to one user, so
+// any existing link is replaced
+func linkPlayer(userID, playerID int) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_players.player_id = ?", playerID).Delete(&database.UserPlayer{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&database.UserPlayer{
+			UserID:   userID,
+			PlayerID: playerID,
+		}).Error
+	})
+}
+
+// confirmLink links a player to whoever made the code they typed in game
+func confirmLink(serverID int, player database.Player, code string) {
+	var linkCode database.PlayerLinkCode
+	database.DB.Preload("User").Where(
+		"player_link_codes.code = ? AND player_link_codes.expiration > ?",
+		strings.ToUpper(code), time.Now(),
+	).Find(&linkCode)
+	if linkCode.UserID == nil {
+		tellPlayer(serverID, player.Name, "That link code is invalid or has expired")
+		return
+	}
+
+	err := linkPlayer(*linkCode.UserID, *player.ID)
+	if err != nil {
+		log.Println(err)
+		tellPlayer(serverID, player.Name, "Something went wrong linking your account, try again later")
+		return
+	}
+
+	// Codes are one time use
+	database.DB.Delete(&linkCode)
+	log.Printf("Linked player %s to user %s\n", player.Name, linkCode.User.Username)
+	tellPlayer(serverID, player.Name, "Linked to portal account "+linkCode.User.Username)
+
+	// The user's permissions apply to the player now
+	syncServers()
+}
+
+// CreateLinkCode makes a code the user can type in game to link their player to their account
+func CreateLinkCode(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(r)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// Remove expired codes first
+	database.DB.Where("expiration < ?", time.Now()).Delete(&database.PlayerLinkCode{})
+
+	// Try new codes until one isn't taken. Anything other than a taken code won't go away by
+	// trying again
+	var linkCode database.PlayerLinkCode
+	for i := 0; ; i++ {
+		code, err := makeLinkCode()
+		if err != nil {
+			utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		linkCode = database.PlayerLinkCode{
+			Code:       code,
+			Expiration: time.Now().Add(linkCodeExpiration),
+			UserID:     user.ID,
+		}
+		err = database.DB.Create(&linkCode).Error
+		if err == nil {
+			break
+		}
+		if !database.IsUniqueViolation(err) || i+1 >= linkCodeAttempts {
+			log.Println(err)
+			utils.ErrorJSON(w, http.StatusInternalServerError, "Could not make a link code")
+			return
+		}
+	}
+
+	// Write out response
+	resp := make(map[string]interface{})
+	resp["status"] = "Success"
+	resp["code"] = linkCode.Code
+	resp["expiration"] = linkCode.Expiration
+	resp["command"] = "!msmf link " + linkCode.Code
+	_, _ = w.Write(utils.ToJSON(resp))
+}
+
+// GetLinkedPlayers lists the players linked to the user. Administrators can look at other
+// users with the username query parameter
+func GetLinkedPlayers(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(r)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	username := r.URL.Query().Get("username")
+	if len(username) > 0 && username != user.Username {
+		if !hasUserPerms(user.Token, "administrator") {
+			utils.ErrorJSON(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+		user = database.User{}
+		database.DB.Where("users.username = ?", username).Find(&user)
+		if user.ID == nil {
+			utils.ErrorJSON(w, http.StatusNotFound, "User does not exist")
+			return
+		}
+	}
+
+	players := make([]database.Player, 0)
+	err = database.DB.Joins(
+		"INNER JOIN user_players up ON up.player_id = players.id",
+	).Where("up.user_id = ?", user.ID).Order("players.name").Find(&players).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the players
+	_, _ = w.Write(utils.ToJSON(&players))
+}
+
+// LinkPlayer lets an administrator link a player to any user without the player confirming it
+func LinkPlayer(w http.ResponseWriter, r *http.Request) {
+	// Check perms and bail if the perms aren't good
+	if !checkPerms(w, r, "administrator", false) {
+		return
+	}
+
+	// Get the user to link to
+	body := make(map[string]string)
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var user database.User
+	database.DB.Where("users.username = ?", body["username"]).Find(&user)
+	if user.ID == nil {
+		utils.ErrorJSON(w, http.StatusNotFound, "User does not exist")
+		return
+	}
+
+	// Players only exist once they have been seen on a server
+	var player database.Player
+	database.DB.Where("players.uuid = ?", strings.ToLower(mux.Vars(r)["uuid"])).Find(&player)
+	if player.ID == nil {
+		utils.ErrorJSON(w, http.StatusNotFound, "Player does not exist")
+		return
+	}
+
+	err = linkPlayer(*user.ID, *player.ID)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// The user's permissions apply to the player now
+	syncServers()
+
+	// Write out response
+	resp := make(map[string]string)
+	resp["status"] = "Success"
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
+
+// UnlinkPlayer removes the link between a player and the user. Administrators can unlink
+// a player from whoever it belongs to
+func UnlinkPlayer(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(r)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	query := database.DB.Where(
+		"user_players.player_id IN (SELECT id FROM players WHERE uuid = ?)",
+		strings.ToLower(mux.Vars(r)["uuid"]),
+	)
+	if !hasUserPerms(user.Token, "administrator") {
+		query = query.Where("user_players.user_id = ?", user.ID)
+	}
+	result := query.Delete(&database.UserPlayer{})
+	if result.Error != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, result.Error.Error())
+		return
+	}
+	if result.RowsAffected == 0 {
+		utils.ErrorJSON(w, http.StatusNotFound, "Player is not linked")
+		return
+	}
+
+	// The player loses whatever the user's permissions gave them
+	syncServers()
+
+	// Write out response
+	resp := make(map[string]string)
+	resp["status"] = "Success"
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
@@ -0,0 +1,219 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	"msmf/database"
+	"msmf/games"
+	"msmf/utils"
+)
+
+// The server permission needed to change each player list
+var listPerms = map[string]string{
+	"whitelist":      "edit_configuration",
+	"ops":            "manage_server_console",
+	"banned-players": "ban",
+	"banned-ips":     "ban",
+}
+
+// listLock stops two requests from editing the same list file at once
+var listLock sync.Mutex
+
+// listChange is the body of a request to change a player list. Entries to add only need a
+// name or IP, everything else is filled in
+type listChange struct {
+	Add    []games.MCListEntry `json:"add"`
+	Remove []string            `json:"remove"`
+}
+
+// Helper function to get the list from a request and make sure the server can have it
+func requestList(w http.ResponseWriter, serverID int, name string) (games.MCList, bool) {
+	list, exists := games.MCLists[name]
+	if !exists {
+		utils.ErrorJSON(w, http.StatusNotFound, "Unknown list")
+		return list, false
+	}
+
+	var server database.Server
+	database.DB.Preload("Game").Where("servers.id = ?", serverID).Find(&server)
+	if server.ID == nil {
+		utils.ErrorJSON(w, http.StatusNotFound, "Server does not exist")
+		return list, false
+	}
+	if server.Game.Name != "Minecraft" {
+		utils.ErrorJSON(w, http.StatusBadRequest, "Server does not have player lists")
+		return list, false
+	}
+	return list, true
+}
+
+// prepareEntries fills in and validates entries before they are put in a list. Missing
+// UUIDs are worked out from the player name
+func prepareEntries(serverID int, list games.MCList, entries []games.MCListEntry, source string) error {
+	for i := range entries {
+		entry := &entries[i]
+		if !list.ByIP && len(entry.UUID) == 0 {
+			if !playerName.MatchString(entry.Name) {
+				return fmt.Errorf("%q is not a valid player name", entry.Name)
+			}
+			uuid, err := utils.PlayerUUID(serverID, entry.Name)
+			if err != nil {
+				return fmt.Errorf("could not find the UUID of %s: %w", entry.Name, err)
+			}
+			entry.UUID = uuid
+		}
+		err := list.Prepare(entry, source)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changeList merges entries into a list and takes out the targets in one go. It reports
+// whether the list changed
+func changeList(serverID int, list games.MCList, add []games.MCListEntry, remove []string) (bool, error) {
+	listLock.Lock()
+	defer listLock.Unlock()
+
+	entries, err := utils.ReadServerList(serverID, list)
+	if err != nil {
+		return false, err
+	}
+	removed := false
+	if len(remove) > 0 {
+		entries, removed = list.Remove(entries, remove...)
+	}
+	entries = list.Merge(entries, add...)
+	if len(add) == 0 && !removed {
+		return false, nil
+	}
+	return true, utils.WriteServerList(serverID, list, entries)
+}
+
+// GetServerList reads one of the player lists of a server. This works whether the server is
+// running or not
+func GetServerList(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+	name := mux.Vars(r)["list"]
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, listPerms[name], "view_logs") {
+		return
+	}
+	list, ok := requestList(w, serverID, name)
+	if !ok {
+		return
+	}
+
+	entries, err := utils.ReadServerList(serverID, list)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the entries
+	_, _ = w.Write(utils.ToJSON(&entries))
+}
+
+// ReplaceServerList replaces the whole of one of the player lists of a stopped server
+func ReplaceServerList(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+	name := mux.Vars(r)["list"]
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, listPerms[name]) {
+		return
+	}
+	list, ok := requestList(w, serverID, name)
+	if !ok {
+		return
+	}
+	user, _ := currentUser(r)
+
+	entries := make([]games.MCListEntry, 0)
+	err := json.NewDecoder(r.Body).Decode(&entries)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// A running server would write its own copy over the file
+	if serverRunning(serverID) {
+		utils.ErrorJSON(w, http.StatusConflict, "Server is running, use the moderation API instead")
+		return
+	}
+
+	err = prepareEntries(serverID, list, entries, user.Username)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Merging into nothing drops duplicates
+	entries = list.Merge(nil, entries...)
+
+	listLock.Lock()
+	err = utils.WriteServerList(serverID, list, entries)
+	listLock.Unlock()
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out response
+	resp := make(map[string]string)
+	resp["status"] = "Success"
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
+
+// UpdateServerList adds and removes entries in one of the player lists of a stopped server.
+// Entries that are already there are replaced
+func UpdateServerList(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+	name := mux.Vars(r)["list"]
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, listPerms[name]) {
+		return
+	}
+	list, ok := requestList(w, serverID, name)
+	if !ok {
+		return
+	}
+	user, _ := currentUser(r)
+
+	var change listChange
+	err := json.NewDecoder(r.Body).Decode(&change)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// A running server would write its own copy over the file
+	if serverRunning(serverID) {
+		utils.ErrorJSON(w, http.StatusConflict, "Server is running, use the moderation API instead")
+		return
+	}
+
+	err = prepareEntries(serverID, list, change.Add, user.Username)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, err = changeList(serverID, list, change.Add, change.Remove)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out response
+	resp := make(map[string]string)
+	resp["status"] = "Success"
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
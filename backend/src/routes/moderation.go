@@ -0,0 +1,290 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"msmf/database"
+	"msmf/games"
+	"msmf/utils"
+)
+
+// moderationAction describes a moderation action and what it takes to do it
+type moderationAction struct {
+	// The server permission needed to do it
+	Perm string
+	// The console command, the target and reason are added on the end
+	Command string
+	// Whether a reason can be given
+	HasReason bool
+	// Whether the target can be an IP address instead of a player
+	AllowIP bool
+	// The player list it changes, so it can be done while the server is stopped
+	List string
+	// Whether it takes the target off the list instead of putting it on
+	Remove bool
+}
+
+// All of the moderation actions the API supports
+var moderationActions = map[string]moderationAction{
+	"kick":        {Perm: "kick", Command: "kick", HasReason: true},
+	"ban":         {Perm: "ban", Command: "ban", HasReason: true, List: "banned-players"},
+	"pardon":      {Perm: "ban", Command: "pardon", List: "banned-players", Remove: true},
+	"ban-ip":      {Perm: "ban", Command: "ban-ip", HasReason: true, AllowIP: true, List: "banned-ips"},
+	"pardon-ip":   {Perm: "ban", Command: "pardon-ip", AllowIP: true, List: "banned-ips", Remove: true},
+	"op":          {Perm: "manage_server_console", Command: "op", List: "ops"},
+	"deop":        {Perm: "manage_server_console", Command: "deop", List: "ops", Remove: true},
+	"whitelist":   {Perm: "edit_configuration", Command: "whitelist add", List: "whitelist"},
+	"unwhitelist": {Perm: "edit_configuration", Command: "whitelist remove", List: "whitelist", Remove: true},
+}
+
+// Player names that are safe to put in a command
+var playerName = regexp.MustCompile(`^[A-Za-z0-9_]{1,16}$`)
+
+// Matches the response of the list command, "There are 1 of a max of 20 players online: Steve"
+var listResponse = regexp.MustCompile(`players online:(.*)$`)
+
+// onlinePlayer is a player on a server right now
+type onlinePlayer struct {
+	Name string `json:"name"`
+	UUID string `json:"uuid,omitempty"`
+}
+
+// GetOnlinePlayers lists the players on a server right now
+func GetOnlinePlayers(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	tokenCookie, _ := r.Cookie("token")
+	token := tokenCookie.Value
+	// Get server ID
+	serverID := getServer(r.URL.Path)
+
+	// If error, there was a database error
+	viewable, err := canViewServer(serverID, token)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// If they can't view it, tell them it's not found
+	if !viewable {
+		utils.ErrorJSON(w, http.StatusNotFound, "Server does not exist")
+		return
+	}
+
+	// Join and leave messages give UUIDs
+	uuids := make(map[string]string)
+	WsLock.Lock()
+	connDetails, exists := AttachedServers[serverID]
+	WsLock.Unlock()
+	if exists {
+		uuids = connDetails.Players.Online()
+	}
+
+	// Ask the server itself since msmf might not have seen everyone join
+	players := make([]onlinePlayer, 0)
+	output, err := utils.RconCommand(serverID, "list")
+	if err == nil {
+		match := listResponse.FindStringSubmatch(strings.TrimSpace(output))
+		if match != nil {
+			for _, name := range strings.Split(match[1], ",") {
+				name = strings.TrimSpace(name)
+				if len(name) > 0 {
+					players = append(players, onlinePlayer{Name: name, UUID: uuids[name]})
+				}
+			}
+		}
+	} else if exists {
+		// No RCON, so all we have is what the console said
+		for name, uuid := range uuids {
+			players = append(players, onlinePlayer{Name: name, UUID: uuid})
+		}
+		sort.Slice(players, func(i, j int) bool {
+			return players[i].Name < players[j].Name
+		})
+	} else {
+		utils.ErrorJSON(w, http.StatusBadRequest, "Server is not running")
+		return
+	}
+
+	// Write out the players
+	_, _ = w.Write(utils.ToJSON(&players))
+}
+
+// ModeratePlayer kicks, bans, pardons, ops, deops or whitelists a player on a server.
+// Each action needs its matching server permission
+func ModeratePlayer(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+	vars := mux.Vars(r)
+	target := vars["player"]
+
+	action, exists := moderationActions[vars["action"]]
+	if !exists {
+		utils.ErrorJSON(w, http.StatusNotFound, "Unknown action")
+		return
+	}
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, action.Perm) {
+		return
+	}
+	user, _ := currentUser(r)
+
+	// Make sure nothing extra can sneak into the command
+	if !playerName.MatchString(target) && !(action.AllowIP && net.ParseIP(target) != nil) {
+		utils.ErrorJSON(w, http.StatusBadRequest, "Must supply a valid player name")
+		return
+	}
+
+	// A body is optional, it only holds the reason and when a ban expires
+	body := make(map[string]string)
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	reason := strings.Join(strings.Fields(body["reason"]), " ")
+	expires, err := parseExpires(body["expires"])
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if expires != nil && action.Command != "ban" && action.Command != "ban-ip" {
+		utils.ErrorJSON(w, http.StatusBadRequest, "Only bans can expire")
+		return
+	}
+	running := serverRunning(serverID)
+	if expires != nil && running {
+		// The ban command can't set when a ban expires, so msmf lifts it through a shared ban
+		// list. Stopped servers have it written into their ban file, which the game honours
+		listIDs, err := serverBanLists(serverID)
+		if err != nil {
+			utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(listIDs) == 0 {
+			utils.ErrorJSON(w, http.StatusBadRequest, "Temporary bans on a running server need it to share a ban list")
+			return
+		}
+	}
+
+	command := action.Command + " " + target
+	if action.HasReason && len(reason) > 0 {
+		command += " " + reason
+	}
+
+	// Stopped servers have their files changed instead
+	var output string
+	if running {
+		output, err = serverCommand(serverID, command, user.ID, utils.SourceModeration)
+	} else {
+		output, err = moderateStopped(serverID, action, target, reason, user.Username, expires)
+	}
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Bans apply to every server sharing a ban list with this one. An IP ban of a player by name
+	// bans whatever address they're on here, which other servers can't know, so it isn't shared
+	isIP := net.ParseIP(target) != nil
+	switch {
+	case action.Command == "ban" || (action.Command == "ban-ip" && isIP):
+		go shareBan(serverID, database.Ban{
+			Target:  target,
+			IP:      isIP,
+			Reason:  reason,
+			Issuer:  user.Username,
+			Expires: expires,
+		})
+	case action.Command == "pardon" || action.Command == "pardon-ip":
+		go sharePardon(serverID, target)
+	}
+
+	// Record who did it
+	database.DB.Create(&database.ModerationAction{
+		Time:     time.Now(),
+		Action:   vars["action"],
+		Target:   target,
+		Reason:   reason,
+		Response: output,
+		ServerID: &serverID,
+		UserID:   user.ID,
+	})
+
+	// Write out response
+	resp := make(map[string]string)
+	resp["status"] = "Success"
+	resp["response"] = output
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
+
+// moderateStopped does a moderation action on a stopped server by editing its player lists
+func moderateStopped(
+	serverID int, action moderationAction, target, reason, source string, expires *time.Time,
+) (string, error) {
+	if len(action.List) == 0 {
+		return "", errors.New("server is not running")
+	}
+	list, exists := games.MCLists[action.List]
+	if !exists {
+		return "", errors.New("unknown list " + action.List)
+	}
+
+	if action.Remove {
+		changed, err := changeList(serverID, list, nil, []string{target})
+		if err != nil {
+			return "", err
+		} else if !changed {
+			return "Nothing changed, " + target + " was not on the " + action.List + " list", nil
+		}
+		return "Removed " + target + " from the " + action.List + " list", nil
+	}
+
+	// Player bans by IP need the address the player last used, which msmf doesn't know
+	entry := games.MCListEntry{Name: target, Reason: reason}
+	if list.ByIP {
+		if net.ParseIP(target) == nil {
+			return "", errors.New("only IP addresses can be banned while the server is stopped")
+		}
+		entry = games.MCListEntry{IP: target, Reason: reason}
+	}
+	if expires != nil {
+		entry.Expires = games.MCTime(*expires)
+	}
+	entries := []games.MCListEntry{entry}
+	err := prepareEntries(serverID, list, entries, source)
+	if err != nil {
+		return "", err
+	}
+	_, err = changeList(serverID, list, entries, nil)
+	if err != nil {
+		return "", err
+	}
+	return "Added " + target + " to the " + action.List + " list", nil
+}
+
+// GetModerationActions lists the moderation done on a server through the portal
+func GetModerationActions(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "view_logs", "kick", "ban") {
+		return
+	}
+
+	actions := make([]database.ModerationAction, 0)
+	err := database.DB.Preload("User").Where(
+		"moderation_actions.server_id = ?", serverID,
+	).Order("moderation_actions.time DESC").Limit(maxLogLimit).Find(&actions).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the actions
+	_, _ = w.Write(utils.ToJSON(&actions))
+}
@@ -1,6 +1,8 @@
 package routes
 
 import (
+	"encoding/json"
+	"gorm.io/gorm/clause"
 	"msmf/database"
 	"msmf/utils"
 	"net/http"
@@ -52,3 +54,117 @@ func GetPerms(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Write(utils.ToJSON(resp))
 }
+
+// Helper function to read and check a server permission change
+func serverPermChange(w http.ResponseWriter, r *http.Request) (
+	perm database.ServerPermsPerUser, ok bool,
+) {
+	// Get JSON of body
+	body := struct {
+		Username   string `json:"username"`
+		ServerID   int    `json:"server_id"`
+		Permission string `json:"permission"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return perm, false
+	}
+
+	// Server administrators can manage their own server, otherwise it needs the user permission
+	tokenCookie, _ := r.Cookie("token")
+	if !hasServerPerms(tokenCookie.Value, body.ServerID) &&
+		!hasUserPerms(tokenCookie.Value, "manage_server_permission") {
+		utils.ErrorJSON(w, http.StatusForbidden, "Forbidden")
+		return perm, false
+	}
+
+	// Make sure everything exists
+	database.DB.Where("servers.id = ?", body.ServerID).Find(&perm.Server)
+	if perm.Server.ID == nil {
+		utils.ErrorJSON(w, http.StatusNotFound, "Server does not exist")
+		return perm, false
+	}
+	database.DB.Where("users.username = ?", body.Username).Find(&perm.User)
+	if perm.User.ID == nil {
+		utils.ErrorJSON(w, http.StatusNotFound, "User does not exist")
+		return perm, false
+	}
+	database.DB.Where("server_perms.name = ?", body.Permission).Find(&perm.ServerPerm)
+	if perm.ServerPerm.ID == nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, "Permission does not exist")
+		return perm, false
+	}
+	// A shell in the container gets around every other permission, so only portal administrators
+	// can hand it out or take it away
+	if perm.ServerPerm.Name == "container_shell" && !hasUserPerms(tokenCookie.Value, "administrator") {
+		utils.ErrorJSON(w, http.StatusForbidden, "Forbidden")
+		return perm, false
+	}
+
+	perm.ServerID = *perm.Server.ID
+	perm.UserID = *perm.User.ID
+	perm.ServerPermID = *perm.ServerPerm.ID
+	return perm, true
+}
+
+// AddServerPerm gives a user a permission on a server
+func AddServerPerm(w http.ResponseWriter, r *http.Request) {
+	perm, ok := serverPermChange(w, r)
+	if !ok {
+		return
+	}
+
+	// Giving someone a permission they already have is fine
+	err := database.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "server_id"}, {Name: "server_perm_id"}, {Name: "user_id"}},
+		DoNothing: true,
+	}).Create(&database.ServerPermsPerUser{
+		ServerID:     perm.ServerID,
+		ServerPermID: perm.ServerPermID,
+		UserID:       perm.UserID,
+	}).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Their players might need to be whitelisted or opped now
+	syncServer(perm.ServerID)
+
+	// Write out response
+	resp := make(map[string]string)
+	resp["status"] = "Success"
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
+
+// RemoveServerPerm takes a permission on a server away from a user
+func RemoveServerPerm(w http.ResponseWriter, r *http.Request) {
+	perm, ok := serverPermChange(w, r)
+	if !ok {
+		return
+	}
+
+	// Owners always keep their permissions
+	if *perm.Server.OwnerID == perm.UserID {
+		utils.ErrorJSON(w, http.StatusBadRequest, "Cannot remove permissions from the server owner")
+		return
+	}
+
+	err := database.DB.Where(
+		"server_id = ? AND server_perm_id = ? AND user_id = ?",
+		perm.ServerID, perm.ServerPermID, perm.UserID,
+	).Delete(&database.ServerPermsPerUser{}).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Their players might need to be taken off the whitelist or deopped now
+	syncServer(perm.ServerID)
+
+	// Write out response
+	resp := make(map[string]string)
+	resp["status"] = "Success"
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
@@ -0,0 +1,405 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"msmf/database"
+	"msmf/games"
+	"msmf/utils"
+)
+
+// Default and max number of log entries returned at once
+const (
+	defaultLogLimit = 100
+	maxLogLimit     = 1000
+)
+
+// The servers whose logs the user with a token can view, for use as a subquery
+const viewableLogServers = "SELECT sppu.server_id FROM server_perms_per_users sppu " +
+	"INNER JOIN server_perms sp ON sppu.server_perm_id = sp.id " +
+	"INNER JOIN users u ON sppu.user_id = u.id " +
+	"WHERE u.token = ? AND sp.name IN ('administrator', 'view_logs')"
+
+// Errors for bad log filters
+var (
+	errBadLimit  = errors.New("limit must be a positive integer")
+	errBadTime   = errors.New("before must be an RFC 3339 time")
+	errBadServer = errors.New("server id must be an integer value")
+)
+
+// How much player activity can wait to be recorded before consoles have to wait for it
+const playerQueueSize = 1024
+
+// playerEvent is player activity waiting to be recorded, along with when it happened and the
+// UUID of the player if the tracker knew it
+type playerEvent struct {
+	tracker *playerTracker
+	event   *games.LogEvent
+	uuid    string
+	time    time.Time
+}
+
+// playerQueue holds player activity for recordPlayers, so consoles never wait on the database
+// while a tracker is locked. Everything is recorded in the order it happened
+var playerQueue = make(chan playerEvent, playerQueueSize)
+
+// recordOnce starts recordPlayers when the first tracker is made
+var recordOnce sync.Once
+
+// recordPlayers records player activity from the queue as it comes in. It never returns
+func recordPlayers() {
+	for queued := range playerQueue {
+		queued.tracker.record(queued.event, queued.uuid, queued.time)
+	}
+}
+
+// playerTracker follows what players are doing on a server from its console output
+type playerTracker struct {
+	serverID int
+	game     string
+
+	// Lock for access to the maps
+	lock sync.Mutex
+	// Names of players on the server to their UUIDs, which are empty until they're looked up
+	online map[string]string
+	// UUIDs the server authenticated that haven't finished joining yet
+	pending map[string]string
+}
+
+// newPlayerTracker makes a tracker for a server running a game
+func newPlayerTracker(serverID int, game string) *playerTracker {
+	recordOnce.Do(func() {
+		go recordPlayers()
+	})
+	return &playerTracker{
+		serverID: serverID,
+		game:     game,
+		online:   make(map[string]string),
+		pending:  make(map[string]string),
+	}
+}
+
+// isOnline reports whether a player is on the server. Lock must already be held
+func (t *playerTracker) isOnline(name string) bool {
+	_, exists := t.online[name]
+	return exists
+}
+
+// Online returns the names of the players on the server mapped to their UUIDs
+func (t *playerTracker) Online() map[string]string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	online := make(map[string]string, len(t.online))
+	for name, uuid := range t.online {
+		online[name] = uuid
+	}
+	return online
+}
+
+// Reset forgets everyone on the server, such as when it stops
+func (t *playerTracker) Reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.online = make(map[string]string)
+	t.pending = make(map[string]string)
+}
+
+// Track parses a line of console output and queues any player activity in it to be recorded
+func (t *playerTracker) Track(line string) {
+	t.lock.Lock()
+	event := games.ParseLine(t.game, line, t.isOnline)
+	if event == nil {
+		t.lock.Unlock()
+		return
+	}
+	uuid, track := t.follow(event)
+	t.lock.Unlock()
+	if track {
+		playerQueue <- playerEvent{tracker: t, event: event, uuid: uuid, time: time.Now()}
+	}
+}
+
+// follow keeps track of who's online from an event, returning the UUID of the player if it's
+// known and whether the event needs recording. Lock must already be held
+func (t *playerTracker) follow(event *games.LogEvent) (string, bool) {
+	var uuid string
+	switch event.Action {
+	case games.ActionBan, games.ActionBanIP, games.ActionPardon, games.ActionPardonIP:
+		// Bans name whoever was banned, who might never have been on the server
+		go shareConsoleBan(t.serverID, event)
+		return "", false
+	case games.ActionUUID:
+		// The join message comes right after, so hold on to it until then
+		t.pending[event.Player] = event.UUID
+		return "", false
+	case games.ActionJoin:
+		var exists bool
+		uuid, exists = t.pending[event.Player]
+		if !exists {
+			// Some servers don't log the UUID, so assume it's an offline server
+			uuid = games.MCOfflineUUID(event.Player)
+		}
+		delete(t.pending, event.Player)
+		t.online[event.Player] = uuid
+	case games.ActionLeave:
+		uuid = t.online[event.Player]
+		delete(t.online, event.Player)
+	default:
+		uuid = t.online[event.Player]
+		// Players already on the server when msmf attached have never been seen joining. They're
+		// online now, and their UUID is looked up when this is recorded
+		if len(uuid) == 0 {
+			t.online[event.Player] = ""
+		}
+	}
+	return uuid, true
+}
+
+// record writes player activity to the database
+func (t *playerTracker) record(event *games.LogEvent, uuid string, now time.Time) {
+	// Players whose UUID isn't known are found by their name
+	if len(uuid) == 0 {
+		var player database.Player
+		database.DB.Where("players.name = ?", event.Player).Order("players.last_seen DESC").Limit(1).Find(&player)
+		if player.ID == nil {
+			log.Printf("Server %d has unknown player %s\n", t.serverID, event.Player)
+			return
+		}
+		uuid = player.UUID
+
+		// Only fill it in if they haven't left since
+		t.lock.Lock()
+		if current, exists := t.online[event.Player]; exists && len(current) == 0 {
+			t.online[event.Player] = uuid
+		}
+		t.lock.Unlock()
+	}
+
+	// Create the player or update their name since they might have changed it
+	player := database.Player{
+		UUID:     uuid,
+		Name:     event.Player,
+		LastSeen: now,
+	}
+	err := database.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "uuid"}},
+		DoUpdates: clause.AssignmentColumns([]string{"name", "last_seen"}),
+	}).Create(&player).Error
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// Commands go in the server logs with everything else sent to the console
+	if event.Action == games.ActionCommand {
+		err = database.DB.Create(&database.ServerLog{
+			Time:     now,
+			Command:  event.Message,
+			Source:   utils.SourceGame,
+			PlayerID: player.ID,
+			ServerID: &t.serverID,
+		}).Error
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	// Log what they did, but never keep link codes around
+	message := event.Message
+	if event.Action == games.ActionLink {
+		message = ""
+	}
+	err = database.DB.Create(&database.PlayerLog{
+		Time:     now,
+		Action:   event.Action,
+		Message:  message,
+		PlayerID: player.ID,
+		ServerID: &t.serverID,
+	}).Error
+	if err != nil {
+		log.Println(err)
+	}
+
+	if event.Action == games.ActionLink {
+		confirmLink(t.serverID, player, event.Message)
+	}
+}
+
+// Helper function to apply the paging in the query string to a query on a log table
+func pageLogs(query *gorm.DB, r *http.Request, table string) (*gorm.DB, error) {
+	params := r.URL.Query()
+
+	limit := defaultLogLimit
+	if len(params.Get("limit")) > 0 {
+		var err error
+		limit, err = strconv.Atoi(params.Get("limit"))
+		if err != nil || limit < 1 {
+			return nil, errBadLimit
+		}
+		if limit > maxLogLimit {
+			limit = maxLogLimit
+		}
+	}
+	query = query.Limit(limit)
+
+	// Allow paging back through older entries
+	if len(params.Get("before")) > 0 {
+		before, err := time.Parse(time.RFC3339, params.Get("before"))
+		if err != nil {
+			return nil, errBadTime
+		}
+		query = query.Where(table+".time < ?", before)
+	}
+	return query.Order(table + ".time DESC"), nil
+}
+
+// Helper function to apply the filters and paging in the query string to a player log query
+func filterPlayerLogs(query *gorm.DB, r *http.Request) (*gorm.DB, error) {
+	if action := r.URL.Query().Get("action"); len(action) > 0 {
+		query = query.Where("player_logs.action IN ?", strings.Split(action, ","))
+	}
+	return pageLogs(query, r, "player_logs")
+}
+
+// GetServerPlayers lists every player that has been seen on a server
+func GetServerPlayers(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	tokenCookie, _ := r.Cookie("token")
+	token := tokenCookie.Value
+	// Get server ID
+	serverID := getServer(r.URL.Path)
+
+	// If error, there was a database error
+	viewable, err := canViewServer(serverID, token)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// If they can't view it, tell them it's not found
+	if !viewable {
+		utils.ErrorJSON(w, http.StatusNotFound, "Server does not exist")
+		return
+	}
+
+	players := make([]database.Player, 0)
+	err = database.DB.Where(
+		"players.id IN (SELECT player_id FROM player_logs WHERE server_id = ?)", serverID,
+	).Order("players.last_seen DESC").Find(&players).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the players
+	_, _ = w.Write(utils.ToJSON(&players))
+}
+
+// GetServerPlayerLogs shows player activity on a server. It can be filtered by player with
+// the player query parameter, and by a comma separated list of actions with action
+func GetServerPlayerLogs(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "view_logs") {
+		return
+	}
+
+	query := database.DB.Joins("Player").Where("player_logs.server_id = ?", serverID)
+	if player := r.URL.Query().Get("player"); len(player) > 0 {
+		query = query.Where("\"Player\".uuid = ? OR \"Player\".name = ?", strings.ToLower(player), player)
+	}
+	query, err := filterPlayerLogs(query, r)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	logs := make([]database.PlayerLog, 0)
+	err = query.Find(&logs).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the logs
+	_, _ = w.Write(utils.ToJSON(&logs))
+}
+
+// GetPlayer gets a player by their UUID, if they were seen on a server the user can view logs on
+func GetPlayer(w http.ResponseWriter, r *http.Request) {
+	var player database.Player
+	database.DB.Where("players.uuid = ?", strings.ToLower(mux.Vars(r)["uuid"])).Find(&player)
+	if player.ID == nil {
+		utils.ErrorJSON(w, http.StatusNotFound, "Player does not exist")
+		return
+	}
+
+	// Portal administrators can see anyone, everyone else only players seen on a server they can
+	// view logs on
+	tokenCookie, _ := r.Cookie("token")
+	if !hasUserPerms(tokenCookie.Value, "administrator") {
+		var seen int64
+		database.DB.Model(&database.PlayerLog{}).Where(
+			"player_logs.player_id = ? AND player_logs.server_id IN ("+viewableLogServers+")",
+			*player.ID, tokenCookie.Value,
+		).Count(&seen)
+		if seen == 0 {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	// Write out the player
+	_, _ = w.Write(utils.ToJSON(&player))
+}
+
+// GetPlayerLogs shows a player's activity across every server the user can view logs for
+func GetPlayerLogs(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	tokenCookie, _ := r.Cookie("token")
+	token := tokenCookie.Value
+
+	query := database.DB.Joins("Player").Where(
+		"\"Player\".uuid = ?", strings.ToLower(mux.Vars(r)["uuid"]),
+	)
+
+	// Portal administrators can see everything, everyone else only sees servers they can view logs on
+	if !hasUserPerms(token, "administrator") {
+		query = query.Where("player_logs.server_id IN ("+viewableLogServers+")", token)
+	}
+	if len(r.URL.Query().Get("server_id")) > 0 {
+		serverID, err := strconv.Atoi(r.URL.Query().Get("server_id"))
+		if err != nil {
+			utils.ErrorJSON(w, http.StatusBadRequest, errBadServer.Error())
+			return
+		}
+		query = query.Where("player_logs.server_id = ?", serverID)
+	}
+	query, err := filterPlayerLogs(query, r)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	logs := make([]database.PlayerLog, 0)
+	err = query.Find(&logs).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the logs
+	_, _ = w.Write(utils.ToJSON(&logs))
+}
@@ -0,0 +1,561 @@
+package routes
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"msmf/database"
+	"msmf/utils"
+)
+
+// Recordings are kept in the asciicast v2 format so existing players can show them. msmf adds
+// stderr, input and state events, which players skip
+const (
+	castVersion = 2
+	castStdout  = "o"
+	castStderr  = "e"
+	castInput   = "i"
+	castState   = "s"
+)
+
+// recordConsoles is whether console sessions of users that can manage the console are recorded
+var recordConsoles = os.Getenv("CONSOLE_RECORDING") != "false"
+
+// recordingRetention is how long recordings are kept, or forever if it's zero
+var recordingRetention = time.Duration(utils.EnvInt("CONSOLE_RECORDING_RETENTION", 30)) * 24 * time.Hour
+
+// How often old recordings are looked for
+const recordingPruneInterval = time.Hour
+
+// The fastest a recording can be replayed
+const maxReplaySpeed = 100
+
+// Recordings are buffered so a slow disk doesn't hold up the console, and flushed this often
+const recordingFlushInterval = time.Second
+
+// castHeader is the first line of a recording
+type castHeader struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Title     string `json:"title,omitempty"`
+	// Extra details about the session
+	ServerID int    `json:"server_id"`
+	User     string `json:"user,omitempty"`
+}
+
+// Helper function to get where a recording is kept
+func recordingPath(serverID, id int) (string, error) {
+	return utils.DataPath("recordings", strconv.Itoa(serverID), strconv.Itoa(id)+".cast")
+}
+
+// recorder writes a console session out as it happens
+type recorder struct {
+	lock      sync.Mutex
+	recording database.ConsoleRecording
+	file      *os.File
+	writer    *bufio.Writer
+	// Closed when the recording is done, which stops the flushing
+	stop chan struct{}
+}
+
+// startRecording starts recording the console session of a user on a server
+func startRecording(serverID int, user database.User) (*recorder, error) {
+	rec := &recorder{
+		recording: database.ConsoleRecording{
+			Time:     time.Now(),
+			UserID:   user.ID,
+			ServerID: serverID,
+		},
+		stop: make(chan struct{}),
+	}
+	err := database.DB.Create(&rec.recording).Error
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := recordingPath(serverID, *rec.recording.ID)
+	if err == nil {
+		rec.file, err = os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	}
+	if err != nil {
+		database.DB.Delete(&rec.recording)
+		return nil, err
+	}
+	rec.writer = bufio.NewWriter(rec.file)
+
+	header, _ := json.Marshal(castHeader{
+		Version:   castVersion,
+		Width:     80,
+		Height:    24,
+		Timestamp: rec.recording.Time.Unix(),
+		Title:     "Server " + strconv.Itoa(serverID) + " console",
+		ServerID:  serverID,
+		User:      user.Username,
+	})
+	rec.write(append(header, '\n'))
+	go rec.flushLoop()
+	return rec, nil
+}
+
+// write writes to the recording file. Lock must already be held
+func (rec *recorder) write(data []byte) {
+	if rec.file == nil {
+		return
+	}
+	n, err := rec.writer.Write(data)
+	rec.recording.Size += int64(n)
+	if err != nil {
+		rec.fail(err)
+	}
+}
+
+// flush writes out what's buffered. Lock must already be held
+func (rec *recorder) flush() {
+	if rec.file == nil {
+		return
+	}
+	err := rec.writer.Flush()
+	if err != nil {
+		rec.fail(err)
+	}
+}
+
+// fail stops writing the recording after an error. Lock must already be held
+func (rec *recorder) fail(err error) {
+	log.Println("console recording error:", err)
+	_ = rec.file.Close()
+	rec.file = nil
+}
+
+// flushLoop flushes the recording every so often until it's closed
+func (rec *recorder) flushLoop() {
+	ticker := time.NewTicker(recordingFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rec.lock.Lock()
+			rec.flush()
+			rec.lock.Unlock()
+		case <-rec.stop:
+			return
+		}
+	}
+}
+
+// Record adds a console message to the recording. Only output, input and state changes are kept
+func (rec *recorder) Record(msg consoleMessage) {
+	var event []interface{}
+	elapsed := func() float64 {
+		return msg.Time.Sub(rec.recording.Time).Seconds()
+	}
+	switch msg.Type {
+	case msgOutput:
+		code := castStdout
+		if msg.Stream == streamStderr {
+			code = castStderr
+		}
+		event = []interface{}{elapsed(), code, msg.Data + "\r\n"}
+	case msgInput:
+		event = []interface{}{elapsed(), castInput, msg.Data + "\n", msg.Author}
+	case msgState:
+		event = []interface{}{elapsed(), castState, msg.State}
+	default:
+		return
+	}
+	data, _ := json.Marshal(event)
+
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	rec.write(append(data, '\n'))
+	rec.recording.Events++
+}
+
+// Close finishes the recording
+func (rec *recorder) Close() {
+	close(rec.stop)
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	rec.flush()
+	if rec.file != nil {
+		_ = rec.file.Close()
+		rec.file = nil
+	}
+	now := time.Now()
+	rec.recording.Ended = &now
+	database.DB.Model(&rec.recording).Updates(map[string]interface{}{
+		"ended":  rec.recording.Ended,
+		"events": rec.recording.Events,
+		"size":   rec.recording.Size,
+	})
+}
+
+// Helper function to turn a recorded event back into a console message
+func castMessage(start time.Time, line []byte) (msg consoleMessage, delay time.Duration, ok bool) {
+	var event []interface{}
+	if json.Unmarshal(line, &event) != nil || len(event) < 3 {
+		return msg, 0, false
+	}
+	elapsed, ok1 := event[0].(float64)
+	code, ok2 := event[1].(string)
+	data, ok3 := event[2].(string)
+	if !ok1 || !ok2 || !ok3 {
+		return msg, 0, false
+	}
+	delay = time.Duration(elapsed * float64(time.Second))
+	at := start.Add(delay)
+
+	switch code {
+	case castStdout:
+		msg = outputMessage(streamStdout, []byte(strings.TrimSuffix(data, "\r\n")))
+	case castStderr:
+		msg = outputMessage(streamStderr, []byte(strings.TrimSuffix(data, "\r\n")))
+	case castInput:
+		author := ""
+		if len(event) > 3 {
+			author, _ = event[3].(string)
+		}
+		msg = inputMessage(author, strings.TrimSuffix(data, "\n"))
+	case castState:
+		msg = stateMessage(data)
+	default:
+		return msg, 0, false
+	}
+	msg.Time = at
+	msg.Replay = true
+	return msg, delay, true
+}
+
+// Helper function to get the recording in a request
+func requestRecording(w http.ResponseWriter, r *http.Request, serverID int) (recording database.ConsoleRecording, ok bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["recording"])
+	if err == nil {
+		database.DB.Where(
+			"console_recordings.id = ? AND console_recordings.server_id = ?", id, serverID,
+		).Find(&recording)
+	}
+	if recording.ID == nil {
+		utils.ErrorJSON(w, http.StatusNotFound, "Recording does not exist")
+		return recording, false
+	}
+	return recording, true
+}
+
+// GetRecordings lists the recorded console sessions of a server, newest first
+func GetRecordings(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "view_logs") {
+		return
+	}
+
+	query := database.DB.Preload("User").Where("console_recordings.server_id = ?", serverID)
+	if username := r.URL.Query().Get("user"); len(username) > 0 {
+		query = query.Joins(
+			"INNER JOIN users ON console_recordings.user_id = users.id",
+		).Where("users.username = ?", username)
+	}
+	query, err := pageLogs(query, r, "console_recordings")
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	recordings := make([]database.ConsoleRecording, 0)
+	err = query.Find(&recordings).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the recordings
+	_, _ = w.Write(utils.ToJSON(&recordings))
+}
+
+// GetRecording downloads a recorded console session as an asciicast file
+func GetRecording(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "view_logs") {
+		return
+	}
+	recording, ok := requestRecording(w, r, serverID)
+	if !ok {
+		return
+	}
+
+	path, err := recordingPath(serverID, *recording.ID)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", "attachment; filename="+filepath.Base(path))
+	http.ServeFile(w, r, path)
+}
+
+// DeleteRecording deletes a recorded console session
+func DeleteRecording(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "administrator") {
+		return
+	}
+	recording, ok := requestRecording(w, r, serverID)
+	if !ok {
+		return
+	}
+
+	err := deleteRecording(recording)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out response
+	resp := make(map[string]string)
+	resp["status"] = "Success"
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
+
+// Helper function to delete a recording and its file
+func deleteRecording(recording database.ConsoleRecording) error {
+	path, err := recordingPath(recording.ServerID, *recording.ID)
+	if err == nil {
+		err = os.Remove(path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return database.DB.Delete(&recording).Error
+}
+
+// deleteRecordings throws away the recording files of a server, such as when it's deleted. The
+// database rows go with the server
+func deleteRecordings(serverID int) {
+	path, err := utils.DataPath("recordings", strconv.Itoa(serverID))
+	if err == nil {
+		_ = os.RemoveAll(path)
+	}
+}
+
+// Helper function to delete recordings older than the retention
+func pruneRecordings() {
+	var recordings []database.ConsoleRecording
+	err := database.DB.Where(
+		"console_recordings.time < ? AND console_recordings.ended IS NOT NULL",
+		time.Now().Add(-recordingRetention),
+	).Find(&recordings).Error
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, recording := range recordings {
+		err = deleteRecording(recording)
+		if err != nil {
+			log.Printf("Could not delete console recording %d: %s\n", *recording.ID, err)
+		}
+	}
+}
+
+// Helper function to finish recordings that were still going when msmf stopped. They end when
+// their file was last written, and the events and size are counted from the file
+func closeRecordings() {
+	var recordings []database.ConsoleRecording
+	err := database.DB.Where("console_recordings.ended IS NULL").Find(&recordings).Error
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, recording := range recordings {
+		ended, events, size := recording.Time, 0, int64(0)
+		path, err := recordingPath(recording.ServerID, *recording.ID)
+		if err == nil {
+			ended, events, size = recordingFileStats(path, ended)
+		}
+		database.DB.Model(&recording).Updates(map[string]interface{}{
+			"ended":  ended,
+			"events": events,
+			"size":   size,
+		})
+	}
+}
+
+// Helper function to get when a recording file was last written, how many events it has and how
+// big it is. A missing file has no events and ends when it started
+func recordingFileStats(path string, started time.Time) (time.Time, int, int64) {
+	file, err := os.Open(path)
+	if err != nil {
+		return started, 0, 0
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return started, 0, 0
+	}
+
+	// Every line after the header is an event
+	events := -1
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		events++
+	}
+	if events < 0 {
+		events = 0
+	}
+	return info.ModTime(), events, info.Size()
+}
+
+// WatchRecordings deletes console recordings once they are older than the retention. It never
+// returns
+func WatchRecordings() {
+	// Recordings that were going when msmf stopped will never be closed
+	closeRecordings()
+
+	if recordingRetention <= 0 {
+		return
+	}
+	for {
+		pruneRecordings()
+		time.Sleep(recordingPruneInterval)
+	}
+}
+
+// WsRecordingHandler replays a recorded console session over a websocket with the same protocol
+// as a live console. The speed query parameter speeds it up or slows it down
+func WsRecordingHandler(w http.ResponseWriter, r *http.Request) {
+	// Can't error due to regex checking on route
+	serverID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	raw := r.URL.Query().Get("mode") == "raw"
+
+	speed := 1.0
+	if len(r.URL.Query().Get("speed")) > 0 {
+		var err error
+		speed, err = strconv.ParseFloat(r.URL.Query().Get("speed"), 64)
+		if err != nil || speed <= 0 || speed > maxReplaySpeed {
+			http.Error(w, "speed must be a number between 0 and "+strconv.Itoa(maxReplaySpeed), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "view_logs") {
+		return
+	}
+	recording, ok := requestRecording(w, r, serverID)
+	if !ok {
+		return
+	}
+	path, err := recordingPath(serverID, *recording.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "Recording is missing", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	// Upgrade the http connection to a websocket
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sub := newConsoleSubscriber(conn, serverID, raw)
+	go sub.writeLoop()
+
+	// The replay stops when the client goes away
+	done := make(chan struct{})
+	queue := func(msg consoleMessage) bool {
+		select {
+		case sub.messages <- msg:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	go func() {
+		defer close(done)
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				_ = conn.Close()
+				return
+			}
+			// Replays can only be watched
+			msg, ok := sub.decode(messageType, data)
+			if ok && msg.Type == msgPing {
+				queue(consoleMessage{Type: msgPong, Time: time.Now()})
+			}
+		}
+	}()
+
+	if !queue(consoleMessage{
+		Type:     msgHello,
+		Version:  consoleProtocolVersion,
+		Time:     recording.Time,
+		ReadOnly: true,
+		Replay:   true,
+	}) {
+		return
+	}
+
+	// Play the events back as far apart as they happened, divided by the speed
+	err = replayRecording(file, recording.Time, speed, queue, done)
+	reason := "end of recording"
+	if err != nil {
+		reason = err.Error()
+	}
+	queue(closeMessage(reason))
+}
+
+// Helper function to send the events of a recording at the pace they were recorded
+func replayRecording(file *os.File, start time.Time, speed float64, queue func(consoleMessage) bool, done chan struct{}) error {
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	// Skip the header
+	if !scanner.Scan() {
+		return errors.New("recording is empty")
+	}
+
+	began := time.Now()
+	for scanner.Scan() {
+		msg, delay, ok := castMessage(start, scanner.Bytes())
+		if !ok {
+			continue
+		}
+		wait := time.Duration(float64(delay)/speed) - time.Since(began)
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-done:
+				return nil
+			}
+		}
+		if !queue(msg) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
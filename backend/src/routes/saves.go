@@ -0,0 +1,125 @@
+package routes
+
+import (
+	"log"
+	"time"
+
+	"msmf/games"
+	"msmf/utils"
+)
+
+// How sure a backup is that the server wasn't halfway through writing its files
+const (
+	// The server was stopped
+	consistencyOffline = "offline"
+	// Saving was paused and the server said everything was written first
+	consistencyFlushed = "flushed"
+	// Saving was paused but the server never said the save finished before the timeout
+	consistencyUnconfirmed = "unconfirmed"
+	// Saving couldn't be paused, so files may have been copied while they were being written
+	consistencyLive = "live"
+)
+
+// How long a server gets to finish saving before it's backed up anyway
+var backupSaveTimeout = time.Duration(utils.EnvInt("BACKUP_SAVE_TIMEOUT", 60)) * time.Second
+
+// saveWatcher watches a server console for the game saying it finished saving
+type saveWatcher struct {
+	connDetails *ConnDetails
+	sub         *consoleSubscriber
+	game        string
+}
+
+// watchSaves starts watching a server console. It has to be started before the save is asked
+// for so the line saying it finished can't be missed
+func watchSaves(serverID int) (*saveWatcher, error) {
+	connDetails, err := AttachConsole(serverID)
+	if err != nil {
+		return nil, err
+	}
+	// Nothing reads this fast enough to fall behind, and nothing needs hanging up
+	sub := &consoleSubscriber{
+		hangup:   func() {},
+		messages: make(chan consoleMessage, consoleQueueSize),
+		stats:    &consoleStats{},
+		done:     make(chan struct{}),
+	}
+	connDetails, _, _, err = watchConsole(connDetails, sub, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &saveWatcher{connDetails: connDetails, sub: sub, game: connDetails.Players.game}, nil
+}
+
+// wait waits for the game to say it finished saving. It returns false if it didn't in time or
+// the console went away
+func (w *saveWatcher) wait(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case msg := <-w.sub.messages:
+			if msg.Type == msgClose {
+				return false
+			}
+			if msg.Type == msgOutput && msg.Stream == streamStdout && games.IsSaved(w.game, msg.Data) {
+				return true
+			}
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// Close stops watching the console
+func (w *saveWatcher) Close() {
+	// Lock to remove the watcher from the SPMC and clean up
+	w.connDetails.SLock.Lock()
+	delete(w.connDetails.SPMC, w.sub)
+	close(w.sub.messages)
+	w.connDetails.SLock.Unlock()
+	close(w.sub.done)
+}
+
+// pauseSaving stops a running server from writing its world and flushes everything it has to
+// disk so the files hold still while they're copied. It returns how consistent a backup taken
+// now will be. Unless the server is offline, resumeSaving has to be called afterwards
+func pauseSaving(serverID int, userID *int, source string) string {
+	if !serverRunning(serverID) {
+		return consistencyOffline
+	}
+
+	// Without the console there's no way to see the save finish when RCON isn't set up
+	watcher, err := watchSaves(serverID)
+	if err != nil {
+		log.Printf("Could not watch the console of server %d: %s\n", serverID, err)
+	} else {
+		defer watcher.Close()
+	}
+
+	_, err = serverCommand(serverID, games.McSaveOff, userID, source)
+	if err != nil {
+		log.Printf("Could not pause saving on server %d: %s\n", serverID, err)
+		return consistencyLive
+	}
+	resp, err := serverCommand(serverID, games.McSaveFlush, userID, source)
+	if err != nil {
+		log.Printf("Could not save server %d: %s\n", serverID, err)
+		return consistencyUnconfirmed
+	}
+
+	// RCON answers once the save is done, the console has to be watched for it
+	if games.MCSavedResponse(resp) || (watcher != nil && watcher.wait(backupSaveTimeout)) {
+		return consistencyFlushed
+	}
+	log.Printf("Server %d didn't finish saving within %s, backing it up anyway\n", serverID, backupSaveTimeout)
+	return consistencyUnconfirmed
+}
+
+// resumeSaving lets a server write its world again after pauseSaving
+func resumeSaving(serverID int, userID *int, source string) {
+	_, err := serverCommand(serverID, games.McSaveOn, userID, source)
+	if err != nil {
+		log.Printf("Could not resume saving on server %d: %s\n", serverID, err)
+	}
+}
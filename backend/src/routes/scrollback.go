@@ -0,0 +1,214 @@
+package routes
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"msmf/utils"
+)
+
+// Streams console output can come from
+const (
+	streamStdout = "stdout"
+	streamStderr = "stderr"
+)
+
+// scrollbackSize is how many lines of console output are kept for each server
+var scrollbackSize = func() int {
+	size := utils.EnvInt("CONSOLE_SCROLLBACK", 1000)
+	if size < 1 {
+		size = 1
+	}
+	return size
+}()
+
+// scrollLine is a line of console output kept for new viewers
+type scrollLine struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Data   string    `json:"data"`
+}
+
+// scrollback is a ring buffer of the most recent console output of a server. Every line is also
+// appended to a file so the history survives msmf restarting
+type scrollback struct {
+	lock sync.Mutex
+	// The ring itself, start is the oldest line
+	lines []scrollLine
+	start int
+	// Where the lines are kept on disk, and how many lines the file holds. The path is empty if
+	// they aren't, such as once the server is deleted
+	path    string
+	file    *os.File
+	written int
+}
+
+// scrollbacks holds the scrollback of every server that has had output since msmf started
+var scrollbacks = make(map[int]*scrollback)
+
+// scrollbackLock is a lock for accessing the scrollbacks map
+var scrollbackLock sync.Mutex
+
+// getScrollback gets the scrollback of a server, loading it from disk the first time
+func getScrollback(serverID int) *scrollback {
+	scrollbackLock.Lock()
+	defer scrollbackLock.Unlock()
+
+	s, exists := scrollbacks[serverID]
+	if exists {
+		return s
+	}
+	s = &scrollback{lines: make([]scrollLine, 0, scrollbackSize)}
+	scrollbacks[serverID] = s
+
+	path, err := utils.DataPath("consoles", strconv.Itoa(serverID)+".jsonl")
+	if err != nil {
+		log.Printf("Could not keep console history for server %d: %s\n", serverID, err)
+		return s
+	}
+	s.path = path
+	s.load()
+	return s
+}
+
+// deleteScrollback throws away the scrollback of a server, such as when it's deleted
+func deleteScrollback(serverID int) {
+	scrollbackLock.Lock()
+	s, exists := scrollbacks[serverID]
+	delete(scrollbacks, serverID)
+	scrollbackLock.Unlock()
+
+	// The console can still be read from until its supervisor notices it's stopped, so make sure
+	// nothing more is written
+	if exists {
+		s.lock.Lock()
+		if s.file != nil {
+			_ = s.file.Close()
+			s.file = nil
+		}
+		s.path = ""
+		s.lock.Unlock()
+	}
+	path, err := utils.DataPath("consoles", strconv.Itoa(serverID)+".jsonl")
+	if err == nil {
+		_ = os.Remove(path)
+	}
+}
+
+// load reads the lines kept on disk into the ring
+func (s *scrollback) load() {
+	file, err := os.Open(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var line scrollLine
+		if json.Unmarshal(scanner.Bytes(), &line) == nil {
+			s.push(line)
+		}
+	}
+}
+
+// push puts a line in the ring, pushing out the oldest one if it's full. Lock must already be held
+func (s *scrollback) push(line scrollLine) {
+	if len(s.lines) < scrollbackSize {
+		s.lines = append(s.lines, line)
+		return
+	}
+	s.lines[s.start] = line
+	s.start = (s.start + 1) % len(s.lines)
+}
+
+// ordered returns the lines in the ring from oldest to newest. Lock must already be held
+func (s *scrollback) ordered() []scrollLine {
+	lines := make([]scrollLine, 0, len(s.lines))
+	lines = append(lines, s.lines[s.start:]...)
+	return append(lines, s.lines[:s.start]...)
+}
+
+// Add keeps a line of console output
+func (s *scrollback) Add(stream string, data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	line := scrollLine{Time: time.Now(), Stream: stream, Data: string(data)}
+	s.push(line)
+	if len(s.path) == 0 {
+		return
+	}
+
+	// Once the file gets twice as long as the ring, start it over from the ring
+	if s.file == nil || s.written >= 2*scrollbackSize {
+		s.rewrite()
+		return
+	}
+	out, _ := json.Marshal(line)
+	_, err := s.file.Write(append(out, '\n'))
+	if err != nil {
+		log.Println("console history error:", err)
+		_ = s.file.Close()
+		s.file = nil
+		return
+	}
+	s.written++
+}
+
+// rewrite writes the whole ring out to a fresh file. Lock must already be held
+func (s *scrollback) rewrite() {
+	if len(s.path) == 0 {
+		return
+	}
+	if s.file != nil {
+		_ = s.file.Close()
+		s.file = nil
+	}
+
+	// Write to the side and swap it in so a crash never loses the history
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		log.Println("console history error:", err)
+		return
+	}
+	writer := bufio.NewWriter(file)
+	lines := s.ordered()
+	for _, line := range lines {
+		out, _ := json.Marshal(line)
+		_, _ = writer.Write(append(out, '\n'))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		log.Println("console history error:", err)
+		_ = file.Close()
+		return
+	}
+	s.file = file
+	s.written = len(lines)
+}
+
+// Last returns up to the last n lines of output, oldest first. A negative n returns everything
+func (s *scrollback) Last(n int) []scrollLine {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	lines := s.ordered()
+	if n >= 0 && n < len(lines) {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
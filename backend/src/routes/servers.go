@@ -3,14 +3,23 @@ package routes
 import (
 	"encoding/json"
 	"gorm.io/gorm/clause"
+	"log"
 	"msmf/database"
 	"msmf/games"
 	"msmf/utils"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 )
 
+// The server fields UpdateServer won't touch, lower case without underscores so both column and
+// field names match
+var rconServerFields = map[string]bool{
+	"rconpassword": true,
+	"rconport":     true,
+}
+
 // Helper function to check permissions of a user
 func checkPerms(w http.ResponseWriter, r *http.Request, perm string, isServerPerm bool) bool {
 	// Get user token
@@ -50,6 +59,53 @@ func checkPerms(w http.ResponseWriter, r *http.Request, perm string, isServerPer
 	return true
 }
 
+// Helper function to get the user making a request
+func currentUser(r *http.Request) (user database.User, err error) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil {
+		return user, err
+	}
+	err = database.DB.Where("users.token = ?", tokenCookie.Value).First(&user).Error
+	return user, err
+}
+
+// Helper function to check if a user has any of the user level permissions
+func hasUserPerms(token string, perms ...string) bool {
+	return utils.CheckPermissions(&utils.PermCheck{
+		FKTable:     "perms_per_users",
+		Perms:       perms,
+		PermTable:   "user_perms",
+		Search:      token,
+		SearchCol:   "token",
+		SearchTable: "users",
+	})
+}
+
+// Helper function to check if a user has any of the permissions on a specific server
+func hasServerPerms(token string, serverID int, perms ...string) bool {
+	var count int64
+	err := database.DB.Table("server_perms_per_users sppu").Joins(
+		"INNER JOIN server_perms sp ON sppu.server_perm_id = sp.id",
+	).Joins(
+		"INNER JOIN users u ON sppu.user_id = u.id",
+	).Where(
+		"u.token = ? AND sppu.server_id = ? AND sp.name IN ?",
+		token, serverID, append(perms, "administrator"),
+	).Count(&count).Error
+	return err == nil && count > 0
+}
+
+// Helper function to check permissions of a user on a specific server
+func checkServerPerms(w http.ResponseWriter, r *http.Request, serverID int, perms ...string) bool {
+	// Get user token
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || !hasServerPerms(tokenCookie.Value, serverID, perms...) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 // Gets a server id from the url
 func getServer(url string) (serverID int) {
 	parts := strings.SplitN(url, "/", 5)
@@ -115,14 +171,25 @@ func runServer(w http.ResponseWriter, r *http.Request, action string) {
 	if !checkPerms(w, r, "restart", true) {
 		return
 	}
+	// Starting a server while a backup is restored onto it would run the game on half a world
+	if action != "stop" {
+		if !claimStart(getServer(r.URL.String())) {
+			utils.ErrorJSON(w, http.StatusConflict, errServerRestoring.Error())
+			return
+		}
+		defer releaseStart(getServer(r.URL.String()))
+	}
+
 	var err error
 	if action == "start" {
+		syncBeforeStart(getServer(r.URL.String()))
 		err = utils.StartServer(utils.GameName(getServer(r.URL.String())))
 	} else if action == "stop" {
 		err = utils.StopServer(utils.GameName(getServer(r.URL.String())))
 	} else {
 		// Ignore the first since if there was a problem the second would catch it anyways
 		_ = utils.StopServer(utils.GameName(getServer(r.URL.String())))
+		syncBeforeStart(getServer(r.URL.String()))
 		err = utils.StartServer(utils.GameName(getServer(r.URL.String())))
 	}
 
@@ -134,6 +201,12 @@ func runServer(w http.ResponseWriter, r *http.Request, action string) {
 	// Get server id
 	serverID := getServer(r.URL.String())
 
+	// Any open RCON connection and the last status died with the old server process
+	if action != "start" {
+		utils.CloseRcon(serverID)
+		utils.ForgetStatus(serverID)
+	}
+
 	// Update the running status in the db
 	if action == "stop" {
 		database.DB.Model(&database.Server{}).Where(
@@ -143,6 +216,12 @@ func runServer(w http.ResponseWriter, r *http.Request, action string) {
 		database.DB.Model(&database.Server{}).Where(
 			"servers.id = ?", serverID,
 		).Update("running", true)
+
+		// Attach to the console so player activity is tracked even when nobody is watching
+		_, err = AttachConsole(serverID)
+		if err != nil {
+			log.Printf("Could not attach to server %d: %s\n", serverID, err)
+		}
 	}
 
 	// Write out response
@@ -253,13 +332,32 @@ func CreateServer(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	image := game.Image
+	// Get parameters
+	parameters := games.MakeParameters(body, &image)
+
+	// Turn on RCON so msmf can run commands and get their output
+	var rconPassword []byte
+	if gameName == "Minecraft" {
+		var rconParameters []string
+		rconParameters, rconPassword, err = utils.RconParameters()
+		if err != nil {
+			utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		parameters = append(parameters, rconParameters...)
+		// Turn on query so the full player list can be seen
+		parameters = append(parameters, utils.QueryParameters()...)
+	}
+
 	// Create the new server in the db
 	server := database.Server{
-		Port:    port,
-		Name:    name,
-		Game:    game,
-		Owner:   user,
-		Version: version,
+		Port:         port,
+		Name:         name,
+		Game:         game,
+		Owner:        user,
+		Version:      version,
+		RconPassword: rconPassword,
 	}
 	database.DB.Create(&server)
 
@@ -274,10 +372,6 @@ func CreateServer(w http.ResponseWriter, r *http.Request) {
 		User:       user,
 	})
 
-	image := game.Image
-	// Get parameters
-	parameters := games.MakeParameters(body, &image)
-
 	// See if server already exists
 	servers := utils.GetGameServers()
 	for _, s := range servers {
@@ -297,8 +391,62 @@ func CreateServer(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(utils.ToJSON(&resp))
 }
 
+// serverWithStatus is a server along with what it reports about itself while it's running
+type serverWithStatus struct {
+	database.Server
+	Status *games.MCStatus `json:"status"`
+}
+
+// Helper function to attach the live status to a server. Servers that aren't running or
+// don't answer just get no status
+func withStatus(server database.Server) serverWithStatus {
+	s := serverWithStatus{Server: server}
+	if server.Running && server.ID != nil {
+		s.Status, _ = utils.ServerStatus(*server.ID)
+	}
+	return s
+}
+
+// GetServers lists all of the servers a user can view
 func GetServers(w http.ResponseWriter, r *http.Request) {
-	http.Error(w, "Not implemented", http.StatusNotImplemented)
+	// Get user token
+	tokenCookie, _ := r.Cookie("token")
+	token := tokenCookie.Value
+
+	// See if this user has any user level permissions to be able to view every server
+	allServers := hasUserPerms(token, "manage_server_permission", "delete_server")
+
+	var servers []database.Server
+	query := database.DB.Preload(clause.Associations).Order("servers.id")
+	if !allServers {
+		// Only get servers they own or have a permission on
+		query = query.Where(
+			"servers.owner_id IN (SELECT id FROM users WHERE token = ?) OR "+
+				"servers.id IN (SELECT sppu.server_id FROM server_perms_per_users sppu "+
+				"INNER JOIN users u ON sppu.user_id = u.id WHERE u.token = ?)",
+			token, token,
+		)
+	}
+	err := query.Find(&servers).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Get all of the statuses at once so one slow server doesn't hold up the rest
+	resp := make([]serverWithStatus, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server database.Server) {
+			defer wg.Done()
+			resp[i] = withStatus(server)
+		}(i, server)
+	}
+	wg.Wait()
+
+	// Write out the servers
+	_, _ = w.Write(utils.ToJSON(&resp))
 }
 
 func GetServer(w http.ResponseWriter, r *http.Request) {
@@ -330,7 +478,51 @@ func GetServer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Write out the server data
-	_, _ = w.Write(utils.ToJSON(&server))
+	resp := withStatus(server)
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
+
+// GetServerStatus gets the MOTD, version and players of a running server
+func GetServerStatus(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	tokenCookie, _ := r.Cookie("token")
+	token := tokenCookie.Value
+	// Get server ID
+	serverID := getServer(r.URL.String())
+
+	// If error, there was a database error
+	viewable, err := canViewServer(serverID, token)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// If they can't view it, tell them it's not found
+	if !viewable {
+		utils.ErrorJSON(w, http.StatusNotFound, "Server does not exist")
+		return
+	}
+
+	// Get the server to see if it actually exists
+	var server database.Server
+	database.DB.Where("servers.id = ?", serverID).Find(&server)
+	if server.ID == nil {
+		utils.ErrorJSON(w, http.StatusNotFound, "Server does not exist")
+		return
+	}
+	if !server.Running {
+		utils.ErrorJSON(w, http.StatusBadRequest, "Server is not running")
+		return
+	}
+
+	status, err := utils.ServerStatus(serverID)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Write out the status
+	_, _ = w.Write(utils.ToJSON(status))
 }
 
 func UpdateServer(w http.ResponseWriter, r *http.Request) {
@@ -369,6 +561,22 @@ func UpdateServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The RCON details are msmf's, changing them would lock it out of the server
+	for field := range body {
+		if rconServerFields[strings.ToLower(strings.ReplaceAll(field, "_", ""))] {
+			utils.ErrorJSON(w, http.StatusBadRequest, "Field "+field+" can't be changed")
+			return
+		}
+	}
+
+	// Player management is on or off
+	if managePlayers, exists := body["manage_players"]; exists {
+		if _, ok := managePlayers.(bool); !ok {
+			utils.ErrorJSON(w, http.StatusBadRequest, "manage_players must be true or false")
+			return
+		}
+	}
+
 	// Update the server with requested fields
 	database.DB.Model(&server).Updates(body)
 
@@ -378,6 +586,11 @@ func UpdateServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Turning on player management should bring the lists in line right away
+	if _, exists := body["manage_players"]; exists {
+		syncServer(serverID)
+	}
+
 	// Write out the new updated server data
 	_, _ = w.Write(utils.ToJSON(&server))
 }
@@ -404,6 +617,11 @@ func DeleteServer(w http.ResponseWriter, r *http.Request) {
 
 	// Delete the server
 	utils.DeleteServer(utils.GameName(getServer(r.URL.String())))
+	utils.CloseRcon(serverID)
+	StopConsole(serverID)
+	deleteScrollback(serverID)
+	deleteRecordings(serverID)
+	deleteBackups(serverID)
 
 	// Delete it from the database
 	database.DB.Delete(&database.Server{}, serverID)
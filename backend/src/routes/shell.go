@@ -0,0 +1,223 @@
+package routes
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+
+	"msmf/database"
+	"msmf/utils"
+)
+
+// The biggest terminal a shell can be resized to
+const maxShellSize = 1000
+
+// shellMessage is a control message on a shell websocket. Terminal data goes in binary frames
+// both ways, and control messages go in text frames as JSON
+type shellMessage struct {
+	Type string `json:"type"`
+	// Resizes only
+	Cols int `json:"cols,omitempty"`
+	Rows int `json:"rows,omitempty"`
+	// Exits only
+	Code *int `json:"code,omitempty"`
+}
+
+// Types of shell control messages. Clients send resize and msmf sends exit when the shell ends
+const (
+	shellResize = "resize"
+	shellExit   = "exit"
+)
+
+// Helper function to see if a user can open a shell in a server container. Only portal
+// administrators and users given the permission for it can, server administrators don't get
+// it for free
+func canOpenShell(r *http.Request, user database.User, serverID int) bool {
+	tokenCookie, err := r.Cookie("token")
+	if err == nil && hasUserPerms(tokenCookie.Value, "administrator") {
+		return true
+	}
+	perms, err := userServerPerms(serverID, *user.ID)
+	if err != nil {
+		return false
+	}
+	for _, perm := range perms {
+		if perm == "container_shell" {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper function to read a terminal size from the query string
+func shellSize(r *http.Request, name string, def int) (int, bool) {
+	str := r.URL.Query().Get(name)
+	if len(str) == 0 {
+		return def, true
+	}
+	size, err := strconv.Atoi(str)
+	return size, err == nil && size > 0 && size <= maxShellSize
+}
+
+// WsShellHandler opens a shell with a TTY inside a server container. The cols and rows query
+// parameters set the starting size of the terminal
+func WsShellHandler(w http.ResponseWriter, r *http.Request) {
+	// Can't error due to regex checking on route
+	serverID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	user, err := currentUser(r)
+	if err != nil || !canOpenShell(r, user, serverID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	cols, okCols := shellSize(r, "cols", 80)
+	rows, okRows := shellSize(r, "rows", 24)
+	if !okCols || !okRows {
+		http.Error(w, "cols and rows must be between 1 and "+strconv.Itoa(maxShellSize), http.StatusBadRequest)
+		return
+	}
+	if !serverRunning(serverID) {
+		http.Error(w, "Server is not running", http.StatusBadRequest)
+		return
+	}
+
+	shell, err := utils.OpenShell(utils.GameName(serverID), cols, rows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer shell.Close()
+
+	// Upgrade the http connection to a websocket
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	// Every shell is logged
+	session := database.ShellSession{
+		Time:       time.Now(),
+		RemoteAddr: r.RemoteAddr,
+		UserID:     user.ID,
+		ServerID:   serverID,
+	}
+	err = database.DB.Create(&session).Error
+	if err != nil {
+		log.Println(err)
+	}
+	log.Printf("%s opened a shell on server %d from %s\n", user.Username, serverID, r.RemoteAddr)
+
+	// Only one goroutine can write to the websocket at a time
+	var writeLock sync.Mutex
+	write := func(messageType int, data []byte) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		_ = conn.SetWriteDeadline(time.Now().Add(consoleWriteWait))
+		return conn.WriteMessage(messageType, data)
+	}
+
+	// Send everything the shell writes out until it ends
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := shell.Read(buf)
+			if n > 0 {
+				if write(websocket.BinaryMessage, buf[:n]) != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Type whatever comes in from the websocket until either side hangs up
+	go func() {
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				_ = shell.Close()
+				return
+			}
+			if messageType == websocket.BinaryMessage {
+				_, err = shell.Write(data)
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			var msg shellMessage
+			if json.Unmarshal(data, &msg) != nil || msg.Type != shellResize {
+				continue
+			}
+			if msg.Cols > 0 && msg.Cols <= maxShellSize && msg.Rows > 0 && msg.Rows <= maxShellSize {
+				_ = shell.Resize(msg.Cols, msg.Rows)
+			}
+		}
+	}()
+	<-done
+
+	// Say how the shell ended and log it
+	now := time.Now()
+	session.Ended = &now
+	code, err := shell.ExitCode()
+	if err == nil {
+		session.ExitCode = &code
+	}
+	if session.ID != nil {
+		database.DB.Model(&session).Updates(map[string]interface{}{
+			"ended":     session.Ended,
+			"exit_code": session.ExitCode,
+		})
+	}
+	log.Printf("%s closed a shell on server %d\n", user.Username, serverID)
+
+	out, _ := json.Marshal(shellMessage{Type: shellExit, Code: session.ExitCode})
+	_ = write(websocket.TextMessage, out)
+	writeLock.Lock()
+	_ = conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "shell exited"),
+		time.Now().Add(consoleWriteWait),
+	)
+	writeLock.Unlock()
+}
+
+// GetShellSessions lists the shells opened inside a server container, newest first
+func GetShellSessions(w http.ResponseWriter, r *http.Request) {
+	serverID := getServer(r.URL.Path)
+
+	// Check perms and bail if the perms aren't good
+	if !checkServerPerms(w, r, serverID, "administrator") {
+		return
+	}
+
+	query, err := pageLogs(
+		database.DB.Preload("User").Where("shell_sessions.server_id = ?", serverID), r, "shell_sessions",
+	)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sessions := make([]database.ShellSession, 0)
+	err = query.Find(&sessions).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Write out the sessions
+	_, _ = w.Write(utils.ToJSON(&sessions))
+}
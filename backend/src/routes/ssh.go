@@ -0,0 +1,597 @@
+package routes
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+
+	"msmf/database"
+	"msmf/utils"
+)
+
+// sshListen is the address the SSH server listens on. The SSH server only runs if it's set
+var sshListen = os.Getenv("SSH_LISTEN")
+
+// How many lines of scrollback an SSH session starts with
+const sshReplayLines = 100
+
+// errSSHAuth is returned for every failed SSH login so nothing is given away
+var errSSHAuth = errors.New("authentication failed")
+
+// Limits on guessing passwords. A failed password login makes the next one from the same address
+// or for the same user wait, doubling every time up to the max. Failures are forgotten once
+// nothing has failed for the max
+const (
+	sshMaxAuthTries = 3
+	sshMinBackoff   = time.Second
+	sshMaxBackoff   = 5 * time.Minute
+)
+
+// sshFailure is the failed password logins from an address or for a user
+type sshFailure struct {
+	count int
+	last  time.Time
+}
+
+// sshFailures holds the failed password logins by address and by user
+var sshFailures = make(map[string]*sshFailure)
+
+// sshFailuresLock is a lock for accessing the sshFailures map
+var sshFailuresLock sync.Mutex
+
+// sshDummyHash is checked against when a user doesn't exist, so it takes as long as when they do
+var sshDummyHash []byte
+
+// sshDummyOnce makes sshDummyHash the first time it's needed
+var sshDummyOnce sync.Once
+
+// ServeSSH runs an SSH server so users can get to server consoles from a terminal. It does
+// nothing unless SSH_LISTEN is set, and otherwise never returns
+func ServeSSH() {
+	if len(sshListen) == 0 {
+		return
+	}
+
+	config := &ssh.ServerConfig{
+		MaxAuthTries:      sshMaxAuthTries,
+		PasswordCallback:  sshPassword,
+		PublicKeyCallback: sshPublicKey,
+	}
+	hostKey, err := sshHostKey()
+	if err != nil {
+		log.Println("Could not start SSH server:", err)
+		return
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", sshListen)
+	if err != nil {
+		log.Println("Could not start SSH server:", err)
+		return
+	}
+	log.Println("SSH server listening on", sshListen)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("ssh err:", err)
+			continue
+		}
+		go handleSSH(conn, config)
+	}
+}
+
+// sshHostKey loads the host key of the SSH server, making one the first time
+func sshHostKey() (ssh.Signer, error) {
+	path, err := utils.DataPath("ssh_host_key")
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		err = ioutil.WriteFile(path, data, 0600)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+// Helper function to remember who logged in for the rest of the connection
+func sshPermissions(user database.User) *ssh.Permissions {
+	return &ssh.Permissions{Extensions: map[string]string{"user_id": strconv.Itoa(*user.ID)}}
+}
+
+// sshPassword logs a user in with their portal password
+func sshPassword(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	keys := sshFailureKeys(meta)
+	if sshThrottled(keys) {
+		return nil, errSSHAuth
+	}
+
+	var user database.User
+	database.DB.Where("users.username = ?", meta.User()).Find(&user)
+	hash := user.Password
+	if user.ID == nil {
+		sshDummyOnce.Do(func() {
+			sshDummyHash, _ = bcrypt.GenerateFromPassword([]byte("msmf"), bcrypt.DefaultCost)
+		})
+		hash = sshDummyHash
+	}
+	if bcrypt.CompareHashAndPassword(hash, password) != nil || user.ID == nil {
+		sshFailed(keys)
+		return nil, errSSHAuth
+	}
+	sshSucceeded(keys)
+	return sshPermissions(user), nil
+}
+
+// Helper function to get what failed password logins of a connection are counted under
+func sshFailureKeys(meta ssh.ConnMetadata) []string {
+	keys := []string{"user " + meta.User()}
+	host, _, err := net.SplitHostPort(meta.RemoteAddr().String())
+	if err == nil {
+		keys = append(keys, "address "+host)
+	}
+	return keys
+}
+
+// Helper function to get how long to wait after a number of failed password logins
+func sshBackoff(count int) time.Duration {
+	backoff := sshMinBackoff
+	for i := 1; i < count && backoff < sshMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > sshMaxBackoff {
+		backoff = sshMaxBackoff
+	}
+	return backoff
+}
+
+// sshThrottled checks if password logins have to wait after failing. They're turned away
+// without the password being checked
+func sshThrottled(keys []string) bool {
+	sshFailuresLock.Lock()
+	defer sshFailuresLock.Unlock()
+	for _, key := range keys {
+		failure, exists := sshFailures[key]
+		if exists && time.Since(failure.last) < sshBackoff(failure.count) {
+			return true
+		}
+	}
+	return false
+}
+
+// sshFailed counts a failed password login
+func sshFailed(keys []string) {
+	sshFailuresLock.Lock()
+	defer sshFailuresLock.Unlock()
+
+	// Forget failures from long enough ago so the map doesn't grow forever
+	now := time.Now()
+	for key, failure := range sshFailures {
+		if now.Sub(failure.last) >= sshMaxBackoff {
+			delete(sshFailures, key)
+		}
+	}
+	for _, key := range keys {
+		failure, exists := sshFailures[key]
+		if !exists {
+			failure = &sshFailure{}
+			sshFailures[key] = failure
+		}
+		failure.count++
+		failure.last = now
+	}
+}
+
+// sshSucceeded forgets the failed password logins of a connection once it logs in
+func sshSucceeded(keys []string) {
+	sshFailuresLock.Lock()
+	defer sshFailuresLock.Unlock()
+	for _, key := range keys {
+		delete(sshFailures, key)
+	}
+}
+
+// sshPublicKey logs a user in with one of the public keys they registered
+func sshPublicKey(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	var userKey database.UserKey
+	database.DB.Preload("User").Joins(
+		"INNER JOIN users ON user_keys.user_id = users.id",
+	).Where(
+		"users.username = ? AND user_keys.fingerprint = ?", meta.User(), ssh.FingerprintSHA256(key),
+	).Find(&userKey)
+	if userKey.ID == nil {
+		return nil, errSSHAuth
+	}
+
+	// Make sure it's really the same key and not just the same fingerprint
+	registered, _, _, _, err := ssh.ParseAuthorizedKey([]byte(userKey.Key))
+	if err != nil || !bytes.Equal(registered.Marshal(), key.Marshal()) {
+		return nil, errSSHAuth
+	}
+	return sshPermissions(userKey.User), nil
+}
+
+// handleSSH handles an SSH connection. Every session on it gets a console
+func handleSSH(conn net.Conn, config *ssh.ServerConfig) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	userID, _ := strconv.Atoi(sshConn.Permissions.Extensions["user_id"])
+	var user database.User
+	err = database.DB.Where("users.id = ?", userID).First(&user).Error
+	if err != nil {
+		return
+	}
+	log.Printf("%s logged in over SSH from %s\n", user.Username, sshConn.RemoteAddr())
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			_ = newChan.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go sshSession(channel, requests, user)
+	}
+}
+
+// sshSession waits for a session to ask for a shell, or to run a command naming a server, then
+// attaches it to a console until either side hangs up
+func sshSession(channel ssh.Channel, requests <-chan *ssh.Request, user database.User) {
+	defer channel.Close()
+	term := &sshTerminal{channel: channel, reader: bufio.NewReader(channel)}
+
+	// The terminal only echoes and edits lines if the client asked for a pty
+	started := make(chan string, 1)
+	go func() {
+		for req := range requests {
+			ok := false
+			switch req.Type {
+			case "pty-req":
+				term.setPty()
+				ok = true
+			case "env", "window-change":
+				ok = true
+			case "shell", "exec":
+				// Only the first one counts
+				payload := struct{ Command string }{}
+				if req.Type == "exec" {
+					_ = ssh.Unmarshal(req.Payload, &payload)
+				}
+				select {
+				case started <- strings.TrimSpace(payload.Command):
+					ok = true
+				default:
+				}
+			}
+			if req.WantReply {
+				_ = req.Reply(ok, nil)
+			}
+		}
+		close(started)
+	}()
+	target, ok := <-started
+	if !ok {
+		return
+	}
+
+	status := uint32(0)
+	err := sshConsole(term, user, target)
+	if err != nil && err != io.EOF {
+		term.Print(err.Error())
+		status = 1
+	}
+	_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+}
+
+// Helper function to list the servers a user can watch the console of
+func watchableServers(userID int) (servers []database.Server, err error) {
+	perms := database.DB.Table("server_perms_per_users sp").Select("sp.server_id").Joins(
+		"INNER JOIN server_perms p ON sp.server_perm_id = p.id",
+	).Where(
+		"sp.user_id = ? AND p.name IN ?", userID,
+		[]string{"administrator", "view_logs", "manage_server_console"},
+	)
+	err = database.DB.Where("servers.id IN (?)", perms).Order("servers.id").Find(&servers).Error
+	return servers, err
+}
+
+// pickServer finds the server a session wants by ID or name, asking for it if it wasn't given
+func pickServer(term *sshTerminal, user database.User, target string) (database.Server, error) {
+	servers, err := watchableServers(*user.ID)
+	if err != nil {
+		return database.Server{}, err
+	}
+	if len(servers) == 0 {
+		return database.Server{}, errors.New("you can't watch any server consoles")
+	}
+
+	find := func(target string) (database.Server, bool) {
+		for _, server := range servers {
+			if strconv.Itoa(*server.ID) == target || strings.EqualFold(server.Name, target) {
+				return server, true
+			}
+		}
+		return database.Server{}, false
+	}
+	if len(target) > 0 {
+		server, exists := find(target)
+		if !exists {
+			return server, errors.New("no server " + target + " you can watch")
+		}
+		return server, nil
+	}
+
+	// Let them pick from the servers they can watch
+	term.Print("Servers you can watch:")
+	for _, server := range servers {
+		term.Print(fmt.Sprintf("  %4d  %s", *server.ID, server.Name))
+	}
+	term.SetPrompt("Server: ")
+	defer term.SetPrompt("")
+	for tries := 0; tries < 3; tries++ {
+		line, err := term.ReadLine()
+		if err != nil {
+			return database.Server{}, err
+		}
+		server, exists := find(strings.TrimSpace(line))
+		if exists {
+			return server, nil
+		}
+		term.Print("No server " + strings.TrimSpace(line) + " you can watch")
+	}
+	return database.Server{}, errors.New("no server picked")
+}
+
+// sshConsole attaches a session to a server console, under the same rules as a websocket
+func sshConsole(term *sshTerminal, user database.User, target string) error {
+	server, err := pickServer(term, user, target)
+	if err != nil {
+		return err
+	}
+	serverID := *server.ID
+
+	// Users that can't send any commands only get to watch
+	checker, err := newCommandChecker(serverID, *user.ID)
+	if err != nil {
+		return err
+	}
+	readOnly := !checker.CanWrite()
+
+	connDetails, err := AttachConsole(serverID)
+	if err != nil {
+		return err
+	}
+	sub := &consoleSubscriber{
+		hangup:   func() { _ = term.channel.Close() },
+		messages: make(chan consoleMessage, consoleQueueSize),
+		stats:    getConsoleStats(serverID),
+		done:     make(chan struct{}),
+	}
+	recordSession(sub, checker, serverID, user)
+	connDetails, replay, state, err := watchConsole(connDetails, sub, sshReplayLines)
+	if err != nil {
+		if sub.recorder != nil {
+			sub.recorder.Close()
+		}
+		return err
+	}
+	defer func() {
+		// Lock to remove this session from the SPMC and clean up
+		connDetails.SLock.Lock()
+		delete(connDetails.SPMC, sub)
+		close(sub.messages)
+		connDetails.SLock.Unlock()
+		if sub.recorder != nil {
+			sub.recorder.Close()
+		}
+	}()
+
+	// Catch the session up before anything new is written
+	term.Print(fmt.Sprintf("Watching %s (%d), the server is %s. Ctrl-D to leave", server.Name, serverID, state))
+	if readOnly {
+		term.Print("This console is read only")
+	}
+	for _, line := range replay {
+		term.Print(sshFormat(replayMessage(line)))
+	}
+	go func() {
+		defer close(sub.done)
+		for msg := range sub.messages {
+			if msg.Type == msgClose {
+				term.Print("* " + msg.Data)
+				sub.hangup()
+				return
+			}
+			if text := sshFormat(msg); len(text) > 0 {
+				term.Print(text)
+			}
+		}
+	}()
+
+	// Send everything typed in as commands
+	if !readOnly {
+		term.SetPrompt("> ")
+	}
+	for {
+		line, err := term.ReadLine()
+		if err != nil {
+			return err
+		}
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		sendInput(sub, connDetails, user, readOnly, utils.SourceSSH, line)
+	}
+}
+
+// sshFormat turns a console message into a line for a terminal
+func sshFormat(msg consoleMessage) string {
+	switch msg.Type {
+	case msgOutput:
+		if msg.Stream == streamStderr {
+			return "\x1b[31m" + msg.Data + "\x1b[0m"
+		}
+		return msg.Data
+	case msgInput:
+		return msg.Author + "> " + msg.Data
+	case msgError:
+		return "! " + msg.Data
+	case msgState:
+		return "* The server is " + msg.State
+	}
+	return ""
+}
+
+// sshTerminal is a minimal line editor over an SSH channel. Output is printed above the line
+// being typed so the two don't get mixed up
+type sshTerminal struct {
+	channel ssh.Channel
+	reader  *bufio.Reader
+
+	// Lock for everything below, and for writing to the channel
+	lock sync.Mutex
+	// Whether the client has a pty, so typing has to be echoed back
+	pty    bool
+	prompt string
+	line   []rune
+}
+
+// setPty turns on echoing and line editing
+func (t *sshTerminal) setPty() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pty = true
+}
+
+// SetPrompt changes the prompt shown in front of the line being typed
+func (t *sshTerminal) SetPrompt(prompt string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.prompt = prompt
+	if t.pty {
+		_, _ = io.WriteString(t.channel, "\r\x1b[K"+t.prompt+string(t.line))
+	}
+}
+
+// Print writes a line of text above the line being typed
+func (t *sshTerminal) Print(text string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	text = strings.ReplaceAll(strings.TrimRight(text, "\r\n"), "\n", "\r\n")
+	if !t.pty {
+		_, _ = io.WriteString(t.channel, text+"\r\n")
+		return
+	}
+	_, _ = io.WriteString(t.channel, "\r\x1b[K"+text+"\r\n"+t.prompt+string(t.line))
+}
+
+// echo writes typing back to the client if it has a pty. Lock must already be held
+func (t *sshTerminal) echo(text string) {
+	if t.pty {
+		_, _ = io.WriteString(t.channel, text)
+	}
+}
+
+// ReadLine reads a line typed into the terminal. Ctrl-D on an empty line returns io.EOF
+func (t *sshTerminal) ReadLine() (string, error) {
+	for {
+		r, _, err := t.reader.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		t.lock.Lock()
+		switch {
+		case r == '\r' || r == '\n':
+			// Terminals send \r\n, so skip the \n
+			if r == '\r' && t.reader.Buffered() > 0 {
+				next, _ := t.reader.Peek(1)
+				if next[0] == '\n' {
+					_, _ = t.reader.ReadByte()
+				}
+			}
+			line := string(t.line)
+			t.line = t.line[:0]
+			t.echo("\r\n" + t.prompt)
+			t.lock.Unlock()
+			return line, nil
+		case r == 0x7f || r == '\b':
+			if len(t.line) > 0 {
+				t.line = t.line[:len(t.line)-1]
+				t.echo("\b \b")
+			}
+		case r == 0x03:
+			// Ctrl-C throws the line away
+			t.line = t.line[:0]
+			t.echo("^C\r\n" + t.prompt)
+		case r == 0x04:
+			if len(t.line) == 0 {
+				t.echo("\r\n")
+				t.lock.Unlock()
+				return "", io.EOF
+			}
+		case r == 0x1b:
+			// Skip escape sequences like the arrow keys, there's no history to move through
+			t.lock.Unlock()
+			t.skipEscape()
+			continue
+		case r >= 0x20 && r != utf8.RuneError:
+			t.line = append(t.line, r)
+			t.echo(string(r))
+		}
+		t.lock.Unlock()
+	}
+}
+
+// skipEscape reads the rest of an escape sequence and throws it away
+func (t *sshTerminal) skipEscape() {
+	b, err := t.reader.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return
+	}
+	for {
+		b, err = t.reader.ReadByte()
+		if err != nil || (b >= 0x40 && b <= 0x7e) {
+			return
+		}
+	}
+}
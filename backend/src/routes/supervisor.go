@@ -0,0 +1,421 @@
+package routes
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"msmf/database"
+	"msmf/utils"
+)
+
+// Timings for supervising server consoles
+const (
+	// How long to wait before reattaching to a console that keeps failing. It doubles every time
+	// up to the max, and starts over once a console stays attached longer than the max
+	attachMinBackoff = time.Second
+	attachMaxBackoff = 30 * time.Second
+	// How often a stopped server is looked at while websockets are watching it
+	stoppedPollInterval = 5 * time.Second
+)
+
+// errNotAttached is returned when input is sent to a console msmf isn't attached to
+var errNotAttached = errors.New("server is not running")
+
+// AttachConsole gets the console of a server, starting a supervisor for it if there isn't one
+// already. The supervisor attaches to the console whenever the server is running, so output is
+// read even when no websockets are connected and player activity is always tracked
+func AttachConsole(serverID int) (*ConnDetails, error) {
+	WsLock.Lock()
+	defer WsLock.Unlock()
+
+	// See if server console is already being supervised
+	connDetails, exists := AttachedServers[serverID]
+	if exists {
+		// The server was most likely just started, so don't make it wait for the next check
+		connDetails.nudge()
+		return connDetails, nil
+	}
+
+	// Get the game so output can be parsed properly
+	var server database.Server
+	err := database.DB.Preload("Game").Where("servers.id = ?", serverID).First(&server).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// Only containers docker knows about can be supervised
+	running, err := utils.ContainerRunning(utils.GameName(serverID))
+	if err != nil {
+		return nil, errors.New("server does not exist")
+	}
+
+	// Create the ConnDetails struct
+	connDetails = &ConnDetails{
+		ServerID: serverID,
+		MChan:    make(chan []byte, 5), // Take up to 5 messages before blocking
+		SPMC:     make(map[*consoleSubscriber]struct{}),
+		SLock:    &sync.Mutex{},
+		running:  running,
+		Players:  newPlayerTracker(serverID, server.Game.Name),
+
+		Scrollback: getScrollback(serverID),
+
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+
+	// Attach right away so the console can be used as soon as this returns. If it doesn't work
+	// the supervisor keeps trying
+	if running && !serverRestoring(serverID) {
+		console, err := utils.AttachServer(utils.GameName(serverID))
+		if err != nil {
+			log.Printf("Could not attach to server %d: %s\n", serverID, err)
+		} else {
+			connDetails.Pipes = console
+			connDetails.attached = true
+		}
+	}
+	connDetails.reported = connDetails.state()
+
+	// Add it into the map and start looking after it
+	AttachedServers[serverID] = connDetails
+	go connDetails.supervise()
+	return connDetails, nil
+}
+
+// StopConsole stops supervising a server console, such as when the server is deleted. Every
+// websocket watching it is closed
+func StopConsole(serverID int) {
+	WsLock.Lock()
+	connDetails, exists := AttachedServers[serverID]
+	WsLock.Unlock()
+	if exists {
+		connDetails.stopOnce.Do(func() {
+			close(connDetails.stop)
+		})
+	}
+}
+
+// supervise owns the console attachment of a server until it's no longer needed. Only docker
+// decides whether the server is running, a console pipe failing just means reattaching
+func (connDetails *ConnDetails) supervise() {
+	name := utils.GameName(connDetails.ServerID)
+	backoff := attachMinBackoff
+	retry := false
+
+	for {
+		// Handle the pipes until they fail
+		if connDetails.isAttached() {
+			start := time.Now()
+			connDetails.pump()
+			connDetails.detach()
+			// Consoles that stayed up a while get reattached straight away
+			retry = time.Since(start) < attachMaxBackoff
+			if !retry {
+				backoff = attachMinBackoff
+			}
+		}
+		if connDetails.stopping() {
+			connDetails.shutdown("server deleted")
+			return
+		}
+
+		// See what the container is actually doing
+		running, err := utils.ContainerRunning(name)
+		if err != nil {
+			log.Printf("Server %d no longer exists in docker\n", connDetails.ServerID)
+			connDetails.setRunning(false)
+			connDetails.shutdown("server no longer exists")
+			return
+		}
+		connDetails.setRunning(running)
+
+		// Servers having a backup restored onto them are left alone until it's done, even if
+		// their container was started outside msmf
+		if running && serverRestoring(connDetails.ServerID) {
+			retry = false
+			if !connDetails.wait(stoppedPollInterval) {
+				connDetails.shutdown("server deleted")
+				return
+			}
+			continue
+		}
+
+		// Stopped servers are only looked after while somebody is watching them
+		if !running {
+			retry = false
+			backoff = attachMinBackoff
+			if connDetails.release() {
+				return
+			}
+			if !connDetails.wait(stoppedPollInterval) {
+				connDetails.shutdown("server deleted")
+				return
+			}
+			continue
+		}
+
+		// Don't hammer docker when attaching keeps failing
+		if retry {
+			log.Printf("Reattaching to server %d in %s\n", connDetails.ServerID, backoff)
+			if !connDetails.wait(backoff) {
+				connDetails.shutdown("server deleted")
+				return
+			}
+			backoff *= 2
+			if backoff > attachMaxBackoff {
+				backoff = attachMaxBackoff
+			}
+		}
+
+		console, err := utils.AttachServer(name)
+		if err != nil {
+			log.Printf("Could not attach to server %d: %s\n", connDetails.ServerID, err)
+			retry = true
+			continue
+		}
+		connDetails.attach(console)
+	}
+}
+
+// pump moves data between the console pipes and everyone using them until a pipe fails or the
+// supervisor is stopped
+func (connDetails *ConnDetails) pump() {
+	connDetails.SLock.Lock()
+	console := connDetails.Pipes
+	connDetails.SLock.Unlock()
+
+	// Room for both readers so neither is stuck once this returns
+	errChan := make(chan error, 2)
+	go connDetails.read(console.Stdout, streamStdout, errChan)
+	go connDetails.read(console.Stderr, streamStderr, errChan)
+
+	// Forever write into stdin
+	for {
+		select {
+		// If data received from any websockets, send it into stdin
+		case data := <-connDetails.MChan:
+			_, err := console.Stdin.Write(data)
+			if err != nil {
+				log.Printf("Server %d stdin error: %s\n", connDetails.ServerID, err)
+				return
+			}
+		case err := <-errChan:
+			if err != io.EOF {
+				log.Printf("Server %d console error: %s\n", connDetails.ServerID, err)
+			}
+			return
+		case <-connDetails.stop:
+			return
+		}
+	}
+}
+
+// read scans output from a console pipe and hands each line out until the pipe closes
+func (connDetails *ConnDetails) read(pipe io.Reader, stream string, errChan chan<- error) {
+	scanner := bufio.NewScanner(pipe)
+	for scanner.Scan() {
+		data := scanner.Bytes()
+
+		// Keep track of what players are doing
+		if stream == streamStdout {
+			connDetails.Players.Track(string(data))
+		}
+
+		// Only one producer can do this at a time
+		// This ensures everyone gets their messages in the same order
+		connDetails.SLock.Lock()
+		connDetails.Scrollback.Add(stream, data)
+		connDetails.broadcast(outputMessage(stream, data))
+		connDetails.SLock.Unlock()
+	}
+
+	// The pipe closed, most likely because the server stopped
+	err := scanner.Err()
+	if err == nil {
+		err = io.EOF
+	}
+	errChan <- err
+}
+
+// Input sends data to the server's stdin. It fails if msmf isn't attached to the console
+func (connDetails *ConnDetails) Input(data []byte) error {
+	if !connDetails.isAttached() {
+		return errNotAttached
+	}
+	select {
+	case connDetails.MChan <- data:
+		return nil
+	case <-time.After(consoleWriteWait):
+		return errors.New("server console is not taking input")
+	}
+}
+
+// state is the server state websockets are told about. SLock must already be held
+func (connDetails *ConnDetails) state() string {
+	if !connDetails.running {
+		return stateStopped
+	}
+	if !connDetails.attached {
+		return stateDetached
+	}
+	return stateRunning
+}
+
+// report tells every websocket when the state changes. SLock must already be held
+func (connDetails *ConnDetails) report() {
+	state := connDetails.state()
+	if state == connDetails.reported {
+		return
+	}
+	connDetails.reported = state
+	if state == stateDetached {
+		connDetails.broadcast(errorMessage("Lost the server console, reattaching"))
+	}
+	connDetails.broadcast(stateMessage(state))
+}
+
+// isAttached reports whether msmf is attached to the console right now
+func (connDetails *ConnDetails) isAttached() bool {
+	connDetails.SLock.Lock()
+	defer connDetails.SLock.Unlock()
+	return connDetails.attached
+}
+
+// attach starts using a new attachment to the console
+func (connDetails *ConnDetails) attach(console utils.Console) {
+	connDetails.SLock.Lock()
+	defer connDetails.SLock.Unlock()
+	connDetails.Pipes = console
+	connDetails.attached = true
+	connDetails.report()
+}
+
+// detach closes the current attachment. The server itself is left alone, and whatever input
+// didn't make it is thrown away
+func (connDetails *ConnDetails) detach() {
+	connDetails.SLock.Lock()
+	console := connDetails.Pipes
+	connDetails.attached = false
+	connDetails.SLock.Unlock()
+
+	err := console.Close()
+	if err != nil {
+		log.Printf("Server %d detached: %s\n", connDetails.ServerID, err)
+	}
+	for {
+		select {
+		case <-connDetails.MChan:
+		default:
+			return
+		}
+	}
+}
+
+// setRunning records what docker says the server is doing. The database is only ever updated
+// from here so it follows the container and not the console
+func (connDetails *ConnDetails) setRunning(running bool) {
+	connDetails.SLock.Lock()
+	changed := connDetails.running != running
+	connDetails.running = running
+	connDetails.report()
+	connDetails.SLock.Unlock()
+	if !changed {
+		return
+	}
+
+	// Nobody is on a server that isn't running
+	if !running {
+		connDetails.Players.Reset()
+	}
+	database.DB.Model(&database.Server{}).Where(
+		"servers.id = ?", connDetails.ServerID,
+	).Update("running", running)
+}
+
+// nudge wakes the supervisor up if it's waiting
+func (connDetails *ConnDetails) nudge() {
+	select {
+	case connDetails.wake <- struct{}{}:
+	default:
+	}
+}
+
+// wait sleeps until the timeout or a nudge. It returns false if the supervisor was stopped
+func (connDetails *ConnDetails) wait(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-connDetails.wake:
+	case <-connDetails.stop:
+		return false
+	}
+	return true
+}
+
+// stopping reports whether the supervisor was told to stop
+func (connDetails *ConnDetails) stopping() bool {
+	select {
+	case <-connDetails.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// release stops supervising a stopped server if nobody is watching it. It returns whether the
+// supervisor is done
+func (connDetails *ConnDetails) release() bool {
+	WsLock.Lock()
+	defer WsLock.Unlock()
+	connDetails.SLock.Lock()
+	defer connDetails.SLock.Unlock()
+
+	if len(connDetails.SPMC) > 0 {
+		return false
+	}
+	connDetails.released = true
+	if AttachedServers[connDetails.ServerID] == connDetails {
+		delete(AttachedServers, connDetails.ServerID)
+	}
+	return true
+}
+
+// shutdown stops supervising the server and closes every websocket watching it
+func (connDetails *ConnDetails) shutdown(reason string) {
+	WsLock.Lock()
+	if AttachedServers[connDetails.ServerID] == connDetails {
+		delete(AttachedServers, connDetails.ServerID)
+	}
+	WsLock.Unlock()
+
+	connDetails.SLock.Lock()
+	connDetails.released = true
+	connDetails.broadcast(closeMessage(reason))
+	connDetails.SLock.Unlock()
+}
+
+// subscribe adds a websocket to the console, returning the output it missed and the state of
+// the server. It fails if the supervisor already let go of the server
+func (connDetails *ConnDetails) subscribe(sub *consoleSubscriber, lines int) ([]scrollLine, string, bool) {
+	// Output is added to the scrollback under the same lock, so taking the replay here means no
+	// line is missed or sent twice
+	connDetails.SLock.Lock()
+	defer connDetails.SLock.Unlock()
+	if connDetails.released {
+		return nil, "", false
+	}
+	connDetails.SPMC[sub] = struct{}{}
+	return connDetails.Scrollback.Last(lines), connDetails.state(), true
+}
+
+// serverRunning checks with docker to see if a server container is running
+func serverRunning(serverID int) bool {
+	running, err := utils.ContainerRunning(utils.GameName(serverID))
+	return err == nil && running
+}
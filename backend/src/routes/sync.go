@@ -0,0 +1,236 @@
+package routes
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+
+	"msmf/database"
+	"msmf/games"
+	"msmf/utils"
+)
+
+// Server permissions that make a linked player an operator
+var opPerms = []string{"administrator", "manage_server_console"}
+
+// syncLocks holds a lock per server, so a server is never synced twice at once
+var syncLocks = make(map[int]*sync.Mutex)
+
+// syncLocksLock is a lock for accessing the syncLocks map
+var syncLocksLock sync.Mutex
+
+// Helper function to get the lock for syncing a server
+func syncLock(serverID int) *sync.Mutex {
+	syncLocksLock.Lock()
+	defer syncLocksLock.Unlock()
+	lock, exists := syncLocks[serverID]
+	if !exists {
+		lock = &sync.Mutex{}
+		syncLocks[serverID] = lock
+	}
+	return lock
+}
+
+// Helper function to get the players linked to users with permissions on a server.
+// With no permissions given, any permission counts
+func permittedPlayers(serverID int, perms ...string) (players []database.Player, err error) {
+	query := database.DB.Distinct("players.*").Joins(
+		"INNER JOIN user_players up ON up.player_id = players.id",
+	).Joins(
+		"INNER JOIN server_perms_per_users sppu ON sppu.user_id = up.user_id",
+	).Joins(
+		"INNER JOIN server_perms sp ON sppu.server_perm_id = sp.id",
+	).Where("sppu.server_id = ?", serverID)
+	if len(perms) > 0 {
+		query = query.Where("sp.name IN ?", perms)
+	}
+	err = query.Find(&players).Error
+	return players, err
+}
+
+// SyncServerPlayers makes the whitelist and operators of a server follow portal permissions.
+// Linked players of users with any permission on the server are whitelisted, and ones with
+// console access are opped. Players that aren't linked to anyone are left alone so lists
+// can still be managed by hand. Running servers are changed with commands, otherwise the
+// files are written directly
+func SyncServerPlayers(serverID int) error {
+	lock := syncLock(serverID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	var server database.Server
+	err := database.DB.Preload("Game").Where("servers.id = ?", serverID).First(&server).Error
+	if err != nil {
+		return err
+	}
+	if !server.ManagePlayers || server.Game.Name != "Minecraft" {
+		return nil
+	}
+
+	// Figure out who should be on each list
+	whitelisted, err := permittedPlayers(serverID)
+	if err != nil {
+		return err
+	}
+	opped, err := permittedPlayers(serverID, opPerms...)
+	if err != nil {
+		return err
+	}
+
+	// Only players msmf put on the lists are taken off again
+	var synced []database.SyncedPlayer
+	err = database.DB.Preload("Player").Where("synced_players.server_id = ?", serverID).Find(&synced).Error
+	if err != nil {
+		return err
+	}
+	managedWhitelist := make(map[string]bool)
+	managedOps := make(map[string]bool)
+	for _, s := range synced {
+		managedWhitelist[s.Player.UUID] = s.Whitelisted
+		managedOps[s.Player.UUID] = s.Opped
+	}
+
+	// See who is on each list right now, and keep anyone else from changing them until done
+	listLock.Lock()
+	defer listLock.Unlock()
+	name := utils.GameName(serverID)
+	var whitelist []games.MCListEntry
+	err = utils.ReadServerJSON(name, games.McWhitelistFile, &whitelist)
+	if err != nil {
+		return err
+	}
+	var ops []games.MCListEntry
+	err = utils.ReadServerJSON(name, games.McOpsFile, &ops)
+	if err != nil {
+		return err
+	}
+
+	// Work out what needs to change
+	var commands []string
+	newWhitelist := make([]games.MCListEntry, 0, len(whitelist))
+	wanted := make(map[string]database.Player)
+	for _, player := range whitelisted {
+		wanted[player.UUID] = player
+	}
+	for _, entry := range whitelist {
+		uuid := strings.ToLower(entry.UUID)
+		if _, exists := wanted[uuid]; exists {
+			delete(wanted, uuid)
+		} else if managedWhitelist[uuid] {
+			commands = append(commands, "whitelist remove "+entry.Name)
+			continue
+		}
+		newWhitelist = append(newWhitelist, entry)
+	}
+	for _, player := range wanted {
+		commands = append(commands, "whitelist add "+player.Name)
+		newWhitelist = append(newWhitelist, games.MCListEntry{UUID: player.UUID, Name: player.Name})
+	}
+
+	newOps := make([]games.MCListEntry, 0, len(ops))
+	wanted = make(map[string]database.Player)
+	for _, player := range opped {
+		wanted[player.UUID] = player
+	}
+	for _, entry := range ops {
+		uuid := strings.ToLower(entry.UUID)
+		if _, exists := wanted[uuid]; exists {
+			delete(wanted, uuid)
+		} else if managedOps[uuid] {
+			commands = append(commands, "deop "+entry.Name)
+			continue
+		}
+		newOps = append(newOps, entry)
+	}
+	for _, player := range wanted {
+		commands = append(commands, "op "+player.Name)
+		entry := games.MCListEntry{UUID: player.UUID, Name: player.Name}
+		_ = games.MCLists["ops"].Prepare(&entry, "")
+		newOps = append(newOps, entry)
+	}
+
+	if len(commands) > 0 {
+		// A running server keeps the lists in memory and would overwrite any changes to the files
+		if serverRunning(serverID) {
+			for _, command := range commands {
+				_, err = serverCommand(serverID, command, nil, utils.SourceMsmf)
+				if err != nil {
+					return fmt.Errorf("could not run %q: %w", command, err)
+				}
+			}
+		} else {
+			err = utils.WriteServerJSON(name, games.McWhitelistFile, newWhitelist)
+			if err != nil {
+				return err
+			}
+			err = utils.WriteServerJSON(name, games.McOpsFile, newOps)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Remember who msmf is managing now
+	records := make(map[int]*database.SyncedPlayer)
+	for _, player := range whitelisted {
+		records[*player.ID] = &database.SyncedPlayer{ServerID: serverID, PlayerID: *player.ID, Whitelisted: true}
+	}
+	for _, player := range opped {
+		record, exists := records[*player.ID]
+		if !exists {
+			record = &database.SyncedPlayer{ServerID: serverID, PlayerID: *player.ID}
+			records[*player.ID] = record
+		}
+		record.Opped = true
+	}
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("synced_players.server_id = ?", serverID).Delete(&database.SyncedPlayer{}).Error
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			err = tx.Create(record).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// syncServers syncs the players of every server in the background, such as when a player
+// is linked and could be on any of them
+func syncServers() {
+	go func() {
+		var servers []database.Server
+		database.DB.Where("servers.manage_players = ?", true).Find(&servers)
+		for _, server := range servers {
+			err := SyncServerPlayers(*server.ID)
+			if err != nil {
+				log.Printf("Could not sync players on server %d: %s\n", *server.ID, err)
+			}
+		}
+	}()
+}
+
+// syncServer syncs the players of a server in the background
+func syncServer(serverID int) {
+	go func() {
+		err := SyncServerPlayers(serverID)
+		if err != nil {
+			log.Printf("Could not sync players on server %d: %s\n", serverID, err)
+		}
+	}()
+}
+
+// syncBeforeStart syncs the players of a server that is about to start. The files are
+// written while it's stopped so it starts up with the right lists
+func syncBeforeStart(serverID int) {
+	err := SyncServerPlayers(serverID)
+	if err != nil {
+		log.Printf("Could not sync players on server %d: %s\n", serverID, err)
+	}
+}
@@ -0,0 +1,274 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm/clause"
+
+	"msmf/database"
+	"msmf/utils"
+)
+
+// backupStores holds a chunk store for each backup target that has been used. msmf's own data
+// directory is kept under 0
+var backupStores = make(map[int]*utils.ChunkStore)
+
+// storesLock is a lock for accessing the backupStores map
+var storesLock sync.Mutex
+
+// Helper function to get the key of a target in backupStores
+func targetKey(targetID *int) int {
+	if targetID == nil {
+		return 0
+	}
+	return *targetID
+}
+
+// backupStore gets the chunk store on a backup target, or in msmf's own data directory if there
+// is no target
+func backupStore(targetID *int) (*utils.ChunkStore, error) {
+	storesLock.Lock()
+	defer storesLock.Unlock()
+	if store, exists := backupStores[targetKey(targetID)]; exists {
+		return store, nil
+	}
+
+	var target utils.BackupTarget
+	var err error
+	if targetID == nil {
+		var dir string
+		dir, err = utils.DataPath("backups")
+		if err == nil {
+			target, err = utils.OpenBackupTarget(utils.TargetLocal, utils.TargetConfig{Path: dir})
+		}
+	} else {
+		target, err = openTarget(*targetID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	store := utils.NewChunkStore(target)
+	backupStores[targetKey(targetID)] = store
+	return store, nil
+}
+
+// Helper function to connect to a backup target in the database
+func openTarget(targetID int) (utils.BackupTarget, error) {
+	var target database.BackupTarget
+	err := database.DB.Where("backup_targets.id = ?", targetID).First(&target).Error
+	if err != nil {
+		return nil, err
+	}
+	config, err := targetConfig(target)
+	if err != nil {
+		return nil, err
+	}
+	return utils.OpenBackupTarget(target.Kind, config)
+}
+
+// Helper function to decrypt the config of a backup target
+func targetConfig(target database.BackupTarget) (config utils.TargetConfig, err error) {
+	data, err := utils.DecryptSecret(target.Config)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(data, &config)
+	return config, err
+}
+
+// pendingCollects holds the keys of the targets whose garbage couldn't be collected because they
+// were in use. They're tried again along with the backup schedules
+var pendingCollects = make(map[int]bool)
+
+// collectChunks deletes the chunks on a backup target no backup uses anymore
+func collectChunks(targetID *int) {
+	store, err := backupStore(targetID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	removed, err := store.Collect()
+	if errors.Is(err, utils.ErrChunkStoreInUse) {
+		storesLock.Lock()
+		pendingCollects[targetKey(targetID)] = true
+		storesLock.Unlock()
+		return
+	}
+	if err != nil {
+		log.Printf("Could not collect backup chunks: %s\n", err)
+		return
+	}
+	if removed > 0 {
+		log.Printf("Deleted %d backup chunks no backup uses\n", removed)
+	}
+}
+
+// retryCollects collects the garbage on targets that were in use the last time it was tried
+func retryCollects() {
+	storesLock.Lock()
+	keys := make([]int, 0, len(pendingCollects))
+	for key := range pendingCollects {
+		keys = append(keys, key)
+	}
+	pendingCollects = make(map[int]bool)
+	storesLock.Unlock()
+
+	for _, key := range keys {
+		if key == 0 {
+			collectChunks(nil)
+		} else {
+			targetID := key
+			collectChunks(&targetID)
+		}
+	}
+}
+
+// targetResponse is a backup target as shown to users, without its credentials
+type targetResponse struct {
+	database.BackupTarget
+	Config utils.TargetConfig `json:"config"`
+}
+
+// Helper function to check a user can manage backup targets. They hold credentials for other
+// systems, so only portal administrators can
+func checkTargetPerms(w http.ResponseWriter, r *http.Request) bool {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || !hasUserPerms(tokenCookie.Value, "administrator") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// GetBackupTargets lists every backup target
+func GetBackupTargets(w http.ResponseWriter, r *http.Request) {
+	// Check perms and bail if the perms aren't good
+	if !checkTargetPerms(w, r) {
+		return
+	}
+
+	var targets []database.BackupTarget
+	err := database.DB.Order("backup_targets.name").Find(&targets).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp := make([]targetResponse, 0, len(targets))
+	for _, target := range targets {
+		config, err := targetConfig(target)
+		if err != nil {
+			log.Printf("Could not read backup target %d: %s\n", *target.ID, err)
+		}
+		resp = append(resp, targetResponse{BackupTarget: target, Config: config.Redacted()})
+	}
+
+	// Write out the targets
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
+
+// CreateBackupTarget adds somewhere backups can be kept. The target is connected to first to make
+// sure it works
+func CreateBackupTarget(w http.ResponseWriter, r *http.Request) {
+	// Check perms and bail if the perms aren't good
+	if !checkTargetPerms(w, r) {
+		return
+	}
+
+	// Get JSON of body
+	body := struct {
+		Name   string             `json:"name"`
+		Kind   string             `json:"kind"`
+		Config utils.TargetConfig `json:"config"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if len(body.Name) == 0 || len(body.Name) > 64 {
+		utils.ErrorJSON(w, http.StatusBadRequest, "Must supply a name of up to 64 characters")
+		return
+	}
+
+	target, err := utils.OpenBackupTarget(body.Kind, body.Config)
+	if err == nil {
+		_, err = target.List("manifests/")
+	}
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusBadRequest, "Could not use backup target: "+err.Error())
+		return
+	}
+	data, err := json.Marshal(body.Config)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	encrypted, err := utils.EncryptSecret(data)
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	backupTarget := database.BackupTarget{Name: body.Name, Kind: body.Kind, Config: encrypted}
+	result := database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&backupTarget)
+	if result.Error != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, result.Error.Error())
+		return
+	}
+	if result.RowsAffected == 0 {
+		utils.ErrorJSON(w, http.StatusConflict, "Backup target already exists")
+		return
+	}
+
+	// Write out the target
+	resp := targetResponse{BackupTarget: backupTarget, Config: body.Config.Redacted()}
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
+
+// DeleteBackupTarget deletes a backup target. Targets still holding backups can't be deleted, and
+// servers backing up to it go back to msmf's own data directory
+func DeleteBackupTarget(w http.ResponseWriter, r *http.Request) {
+	// Check perms and bail if the perms aren't good
+	if !checkTargetPerms(w, r) {
+		return
+	}
+
+	var target database.BackupTarget
+	id, err := strconv.Atoi(mux.Vars(r)["target"])
+	if err == nil {
+		database.DB.Where("backup_targets.id = ?", id).Find(&target)
+	}
+	if target.ID == nil {
+		utils.ErrorJSON(w, http.StatusNotFound, "Backup target does not exist")
+		return
+	}
+	var backups int64
+	database.DB.Model(&database.Backup{}).Where("backups.target_id = ?", *target.ID).Count(&backups)
+	if backups > 0 {
+		utils.ErrorJSON(w, http.StatusConflict, "Backup target still has backups")
+		return
+	}
+
+	err = database.DB.Delete(&target).Error
+	if err != nil {
+		utils.ErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	storesLock.Lock()
+	delete(backupStores, *target.ID)
+	storesLock.Unlock()
+
+	// Write out response
+	resp := make(map[string]string)
+	resp["status"] = "Success"
+	_, _ = w.Write(utils.ToJSON(&resp))
+}
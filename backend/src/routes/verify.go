@@ -0,0 +1,134 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"msmf/database"
+	"msmf/games"
+	"msmf/utils"
+)
+
+// How a backup did when it was restored to try it
+const (
+	verificationPassed       = "passed"
+	verificationFailed       = "failed"
+	verificationUnverifiable = "unverifiable"
+)
+
+// How often backups are looked at for ones that need verifying
+const verifyCheckInterval = time.Hour
+
+// How long a backup stays verified before it's tried again, in hours from BACKUP_VERIFY_INTERVAL.
+// 0 turns scheduled verification off
+var verifyInterval = time.Duration(utils.EnvInt("BACKUP_VERIFY_INTERVAL", 24)) * time.Hour
+
+// testRestore restores a backup into a scratch directory and checks the game could load what's
+// in it. Every chunk is checked against its hash as it's read, so a damaged backup fails too
+func testRestore(backup database.Backup, key *utils.BackupKey) error {
+	store, manifest, done, err := openBackup(backup, key)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	dir, err := utils.DataPath("verify", strconv.Itoa(*backup.ID))
+	if err != nil {
+		return err
+	}
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	reader, writer := io.Pipe()
+	go func() {
+		_ = writer.CloseWithError(manifest.WriteTar(store, writer))
+	}()
+	err = utils.ExtractServerData(reader, dir)
+	_ = reader.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return err
+	}
+
+	var server database.Server
+	err = database.DB.Preload("Game").Where("servers.id = ?", backup.ServerID).First(&server).Error
+	if err != nil {
+		return err
+	}
+	return games.CheckWorld(server.Game.Name, dir)
+}
+
+// verifyRestore tries restoring a backup and records how it went. The server's owner is alerted
+// if it failed. Backups encrypted with a key msmf doesn't have, such as one only given with a
+// request, can't be tried and aren't counted as failing
+func verifyRestore(backup database.Backup) {
+	updates := map[string]interface{}{
+		"verification":       verificationPassed,
+		"verification_error": "",
+		"verified_at":        time.Now(),
+	}
+	key, err := backupKey(backup, "")
+	if errors.Is(err, utils.ErrBackupKeyMissing) {
+		updates["verification"] = verificationUnverifiable
+		updates["verification_error"] = err.Error()
+		database.DB.Model(&backup).Where("backups.status = ?", backupComplete).Updates(updates)
+		return
+	}
+	if err == nil {
+		err = testRestore(backup, key)
+	}
+	if err != nil {
+		updates["verification"] = verificationFailed
+		updates["verification_error"] = err.Error()
+	}
+
+	// Backups deleted while they were being tried failed for that reason alone
+	result := database.DB.Model(&backup).Where("backups.status = ?", backupComplete).Updates(updates)
+	if result.Error != nil || result.RowsAffected == 0 || err == nil {
+		return
+	}
+	log.Printf("Backup %d of server %d failed verification: %s\n", *backup.ID, backup.ServerID, err)
+	alertOwner(backup.ServerID, fmt.Sprintf(
+		"The backup from %s failed verification and might not restore: %s",
+		backup.Time.Format("2006-01-02 15:04"), err,
+	))
+}
+
+// runVerifications tries the newest backup of every server that hasn't been verified lately. They
+// go one at a time, since each takes up room on disk while it's restored
+func runVerifications() {
+	var servers []int
+	database.DB.Model(&database.Server{}).Pluck("id", &servers)
+	for _, serverID := range servers {
+		var backup database.Backup
+		database.DB.Where(
+			"backups.server_id = ? AND backups.status = ?", serverID, backupComplete,
+		).Order("backups.time DESC").Limit(1).Find(&backup)
+		if backup.ID == nil {
+			continue
+		}
+		if backup.VerifiedAt != nil && time.Since(*backup.VerifiedAt) < verifyInterval {
+			continue
+		}
+		verifyRestore(backup)
+	}
+}
+
+// WatchVerifications verifies backups by restoring them on a schedule. It never returns
+func WatchVerifications() {
+	if verifyInterval <= 0 {
+		return
+	}
+	// Throw away restores cut short by msmf stopping
+	dir, err := utils.DataPath("verify")
+	if err == nil {
+		_ = os.RemoveAll(dir)
+	}
+	for {
+		time.Sleep(verifyCheckInterval)
+		runVerifications()
+	}
+}
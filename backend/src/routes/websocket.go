@@ -1,7 +1,7 @@
 package routes
 
 import (
-	"bufio"
+	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"log"
 	"msmf/database"
@@ -10,20 +10,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
-// ConnContainer is a helper struct to contain both a websocket connection and console pipes
-type ConnContainer struct {
-	Conn    *websocket.Conn
-	Console utils.Console
-}
-
-// PipeChans is a helper struct for the SPMC
-type PipeChans struct {
-	StdoutChan chan []byte
-	StderrChan chan []byte
-}
-
 // ConnDetails is a helper struct to hold necessary communication
 // information between servers and websockets
 type ConnDetails struct {
@@ -36,16 +25,40 @@ type ConnDetails struct {
 
 	// SPMC - Single Producer Multiple Consumer
 	// This will connect a single instance of stdout/stderr on a server to multiple websockets
-	SPMC map[*websocket.Conn]PipeChans
+	SPMC map[*consoleSubscriber]struct{}
 	// Lock for access to the SPMC
 	SLock *sync.Mutex
 
-	// A channel for errors so we know to shut down all go routines related and clean up
-	// The function to handle stdin will handle this channel
-	ErrChan chan error
+	// The current attachment to the server pipes. Only good while attached, both are guarded by
+	// SLock
+	Pipes    utils.Console
+	attached bool
+	// Whether the container was running the last time the supervisor looked, and the state the
+	// websockets were last told about, guarded by SLock
+	running  bool
+	reported string
+	// Set once the supervisor lets go of the server, guarded by SLock
+	released bool
+
+	// Nudges the supervisor to look at the container right away
+	wake chan struct{}
+	// Closed to stop supervising the server, such as when it's deleted
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// Follows players joining and leaving from the console output
+	Players *playerTracker
+
+	// Recent output replayed to new websockets
+	Scrollback *scrollback
+}
 
-	// A place to store all of the server pipes. Guard them well because if they die the server crashes
-	Pipes utils.Console
+// broadcast sends a message to every websocket watching the console without blocking on any of
+// them. SLock must already be held
+func (connDetails *ConnDetails) broadcast(msg consoleMessage) {
+	for sub := range connDetails.SPMC {
+		sub.send(msg)
+	}
 }
 
 // Specify amount of data that can be read from a websocket at a time
@@ -60,251 +73,220 @@ var AttachedServers = make(map[int]*ConnDetails)
 // WsLock is a lock for accessing the Attached Servers map
 var WsLock sync.Mutex
 
-// WsServerHandler accepts incoming connections
+// WsServerHandler accepts incoming connections. Messages use the JSON console protocol unless
+// the mode query parameter is raw
 func WsServerHandler(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(r.URL.String(), "/")
 	// Can't error due to regex checking on route
-	serverID, _ := strconv.Atoi(parts[len(parts)-1])
+	serverID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	raw := r.URL.Query().Get("mode") == "raw"
 
-	// Get user token
-	tokenCookie, err := r.Cookie("token")
-	// This shouldn't happen
+	// By default all of the scrollback is replayed
+	lines := -1
+	if len(r.URL.Query().Get("lines")) > 0 {
+		var err error
+		lines, err = strconv.Atoi(r.URL.Query().Get("lines"))
+		if err != nil || lines < 0 {
+			http.Error(w, "lines must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Commands are recorded against whoever typed them
+	user, err := currentUser(r)
 	if err != nil {
-		log.Println(err)
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
-	token := tokenCookie.Value
-	var count int64
-
-	// See if this user has any permissions to be able to view this server console
-	err = database.DB.Table("servers").Joins(
-		"INNER JOIN server_perms_per_users sp ON servers.id = sp.server_id",
-	).Joins(
-		"INNER JOIN server_perms p ON sp.server_perm_id = p.id",
-	).Joins(
-		"INNER JOIN users ON sp.user_id = users.id",
-	).Where(
-		"users.token = ? AND servers.id = ? AND (p.name = 'administrator' OR p."+
-			"name = 'view_logs' OR p.name = 'manage_server_console')", token, serverID,
-	).Count(&count).Error
 
 	// Owner does not have permissions to view this server
-	if err != nil || count == 0 {
+	if !canWatchConsole(*user.ID, serverID) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	// See if server console has already been attached
-	var conn *websocket.Conn
-	WsLock.Lock()
-	connDetails, exists := AttachedServers[serverID]
-	// If we haven't already attached a server
-	if !exists {
-		// Attach the server console
-		console, err := utils.AttachServer(utils.GameName(serverID))
-		if err != nil {
-			// Don't forget to unlock
-			WsLock.Unlock()
+	// Users that can't send any commands only get to watch
+	checker, err := newCommandChecker(serverID, *user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	readOnly := !checker.CanWrite()
 
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+	// Supervise the server console if nobody else is. Stopped servers can be watched too so the
+	// websocket sees them start
+	connDetails, err := AttachConsole(serverID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		// Create the ConnChan struct
-		connDetails = &ConnDetails{
-			MChan:   make(chan []byte, 5), // Take up to 5 messages before blocking
-			SPMC:    make(map[*websocket.Conn]PipeChans),
-			SLock:   &sync.Mutex{},
-			ErrChan: make(chan error, 1),
-			Pipes:   console,
-		}
+	// Upgrade the http connection to a websocket
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sub := newConsoleSubscriber(conn, serverID, raw)
 
-		// Add it into the map
-		AttachedServers[serverID] = connDetails
+	recordSession(sub, checker, serverID, user)
 
-		// Remember to unlock
-		WsLock.Unlock()
+	// Register into the spmc
+	connDetails, replay, state, err := watchConsole(connDetails, sub, lines)
+	if err != nil {
+		_ = sub.write(errorMessage(err.Error()))
+		_ = conn.Close()
+		if sub.recorder != nil {
+			sub.recorder.Close()
+		}
+		return
+	}
 
-		// Upgrade the http connection to a websocket
-		conn, err = upgrader.Upgrade(w, r, nil)
+	// Say hello and catch the websocket up on what it missed before anything new is sent
+	_ = sub.write(consoleMessage{
+		Type:     msgHello,
+		Version:  consoleProtocolVersion,
+		Time:     time.Now(),
+		State:    state,
+		ReadOnly: readOnly,
+	})
+	for _, line := range replay {
+		err = sub.write(replayMessage(line))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			break
 		}
+	}
 
-		// Create the connection container
-		c := ConnContainer{
-			Conn:    conn,
-			Console: console,
-		}
+	// Now that the server is attached and handlers are running, link websocket
+	go sub.writeLoop()
+	readFromSocket(sub, connDetails, user, readOnly)
+}
 
-		// Set up the framework for now handling the attachment of the server pipes to go channels
-		ServerConsole(connDetails, c)
-	} else {
-		// Remember to unlock
-		WsLock.Unlock()
+// Helper function to see if a user has any permissions to be able to view a server console
+func canWatchConsole(userID, serverID int) bool {
+	var count int64
+	err := database.DB.Table("servers").Joins(
+		"INNER JOIN server_perms_per_users sp ON servers.id = sp.server_id",
+	).Joins(
+		"INNER JOIN server_perms p ON sp.server_perm_id = p.id",
+	).Where(
+		"sp.user_id = ? AND servers.id = ? AND (p.name = 'administrator' OR p."+
+			"name = 'view_logs' OR p.name = 'manage_server_console')", userID, serverID,
+	).Count(&count).Error
+	return err == nil && count > 0
+}
+
+// Helper function to record a console session if the user can manage the console
+func recordSession(sub *consoleSubscriber, checker *commandChecker, serverID int, user database.User) {
+	if !recordConsoles || !(checker.admin || checker.allowed) {
+		return
+	}
+	var err error
+	sub.recorder, err = startRecording(serverID, user)
+	if err != nil {
+		log.Printf("Could not record console of server %d: %s\n", serverID, err)
+	}
+}
 
-		// Upgrade the http connection to a websocket
-		conn, err = upgrader.Upgrade(w, r, nil)
+// watchConsole registers a websocket on a server console, getting a new supervisor if the one
+// given let go of the server in the meantime. It returns the scrollback to replay and the state
+// of the server
+func watchConsole(connDetails *ConnDetails, sub *consoleSubscriber, lines int) (*ConnDetails, []scrollLine, string, error) {
+	replay, state, ok := connDetails.subscribe(sub, lines)
+	for !ok {
+		var err error
+		connDetails, err = AttachConsole(connDetails.ServerID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, nil, "", err
 		}
+		replay, state, ok = connDetails.subscribe(sub, lines)
 	}
-
-	// Make the channels for stdin and stdout
-	pipes := PipeChans{
-		StdoutChan: make(chan []byte, 5),
-		StderrChan: make(chan []byte, 5),
+	// Recordings start with the state the server was in
+	if sub.recorder != nil {
+		sub.recorder.Record(stateMessage(state))
 	}
+	return connDetails, replay, state, nil
+}
 
-	// Register into the spmc
-	connDetails.SLock.Lock()
-	connDetails.SPMC[conn] = pipes
-	connDetails.SLock.Unlock()
-
-	// Now that the server is attached and handlers are running, link websocket
+// Helper function to turn a line of scrollback into a message
+func replayMessage(line scrollLine) consoleMessage {
+	return consoleMessage{
+		Type:   msgOutput,
+		Time:   line.Time,
+		Stream: line.Stream,
+		Data:   line.Data,
+		Replay: true,
+	}
+}
 
-	writeToSocket := func(conn *websocket.Conn, pipes PipeChans) {
-		var err error
-		// Constantly read messages
-		for {
-			select {
-			// If stdout send as message type 1
-			case data := <-pipes.StdoutChan:
-				err = conn.WriteMessage(websocket.TextMessage, data)
-			// If stderr send as message type 2
-			case data := <-pipes.StderrChan:
-				err = conn.WriteMessage(websocket.BinaryMessage, data)
-			}
-			// Reader already takes care of closing the websocket
-			if err != nil {
-				log.Println("websocket err:", err)
-				// Kill this function
-				return
+// readFromSocket reads in messages from a websocket until it closes. Commands are checked and
+// sent to stdin
+func readFromSocket(sub *consoleSubscriber, connDetails *ConnDetails, user database.User, readOnly bool) {
+	// Forever try to read in messages
+	for {
+		messageType, data, err := sub.conn.ReadMessage()
+		if err != nil {
+			log.Println("websocket err:", err)
+			// Lock to remove this connection from the SPMC and clean up
+			connDetails.SLock.Lock()
+			delete(connDetails.SPMC, sub)
+			close(sub.messages)
+			connDetails.SLock.Unlock()
+			if sub.recorder != nil {
+				sub.recorder.Close()
 			}
+			// Best effort close the connection since something is wrong
+			_ = sub.conn.Close()
+			// Kill this function
+			return
 		}
-	}
 
-	go writeToSocket(conn, pipes)
-	// Read in data from the websocket to send to stdin
-	readFromSocket := func(conn *websocket.Conn, connDetails *ConnDetails) {
-		// Forever try to read in messages
-		for {
-			messageType, data, err := conn.ReadMessage()
-			// Make sure to add the newline character
-			data = append(data, byte('\n'))
-			if err != nil {
-				log.Println("websocket err:", err)
-				// Lock to remove this connection from the SPMC and clean up
-				connDetails.SLock.Lock()
-				delete(connDetails.SPMC, conn)
-				connDetails.SLock.Unlock()
-				// Best effort close the connection since something is wrong
-				_ = conn.Close()
-				// Kill this function
-				return
+		msg, ok := sub.decode(messageType, data)
+		if !ok {
+			if !sub.raw {
+				sub.send(errorMessage("messages must be JSON"))
 			}
+			continue
+		}
 
-			if messageType == websocket.TextMessage {
-				// Before sending to stdin, tell all other open websockets you are sending this message
-				// This is important so everyone gets to see the same console state
-				connDetails.SLock.Lock()
-				for _, pipes := range connDetails.SPMC {
-					pipes.StdoutChan <- data
-				}
-				// Now actually send data over to stdin
-				connDetails.MChan <- data
-				connDetails.SLock.Unlock()
-			}
+		switch msg.Type {
+		case msgInput:
+			sendInput(sub, connDetails, user, readOnly, utils.SourceConsole, msg.Data)
+		case msgPing:
+			sub.send(consoleMessage{Type: msgPong, Time: time.Now()})
+		case msgResize:
+			// The game console isn't a terminal, so there is nothing to resize
+		default:
+			sub.send(errorMessage("unknown message type " + msg.Type))
 		}
 	}
-
-	readFromSocket(conn, connDetails)
 }
 
-// ServerConsole handles communication between the websocket and the channels
-func ServerConsole(connDetails *ConnDetails, c ConnContainer) {
-	go func(connDetails *ConnDetails, c ConnContainer) {
-		w := c.Console.Stdin
-		// Forever write into stdin
-		for {
-			select {
-			// If data received from any websockets, send it into stdin
-			case data := <-connDetails.MChan:
-				_, err := w.Write(data)
-				if err != nil {
-					log.Println("stdin error:", err)
-					// Send the error to the error handler
-					connDetails.ErrChan <- err
-				}
-			// Handle errors received from any of the pipes by closing all of them and cleaning up
-			// TODO see if we can recover from these
-			case _ = <-connDetails.ErrChan:
-				// Best effort to try to close the pipes, could already be closed
-				_ = c.Console.Stdin.Close()
-				_ = c.Console.Stdout.Close()
-				_ = c.Console.Stderr.Close()
-
-				// Best effort to try to close the websocket, could already be closed
-				_ = c.Conn.Close()
-
-				// Delete this server from the servers attached. Since these pipes died, the server
-				// is now down. If anything was previously attached, it's dead now anyways
-				WsLock.Lock()
-				// If this key doesn't exist it doesn't matter
-				delete(AttachedServers, connDetails.ServerID)
-				WsLock.Unlock()
-
-				// Update the database to say that this server is no longer started
-				database.DB.Model(&database.Server{}).Where(
-					"servers.id = ?", connDetails.ServerID,
-				).Update("running", false)
-
-				// We are done, kill this function
-				return
-			}
-		}
-	}(connDetails, c)
-
-	// Create scanners for stdout and stderr
-	outReader := bufio.NewScanner(c.Console.Stdout)
-	errReader := bufio.NewScanner(c.Console.Stderr)
-
-	// Take in the scanner, connDetails to send stuff to and the corresponding lock
-	read := func(scanner *bufio.Scanner, connDetails *ConnDetails, isStdout bool) {
-		// Repeatedly scan for more data
-		for scanner.Scan() {
-			// Read in the data from the scanner
-			data := scanner.Bytes()
-			if err := scanner.Err(); err != nil {
-				if isStdout {
-					log.Println("stdout err:", err)
-				} else {
-					log.Println("stderr err:", err)
-				}
-				// Send over the error which will handle closing pipes
-				connDetails.ErrChan <- err
-				return
-			}
+// sendInput checks a command someone typed, echoes it to everyone watching and sends it to stdin
+func sendInput(sub *consoleSubscriber, connDetails *ConnDetails, user database.User, readOnly bool, source, command string) {
+	command = strings.TrimRight(command, "\r\n")
 
-			// Only one producer can do this at a time
-			// This ensures everyone gets their messages in the same order
-			connDetails.SLock.Lock()
-			// Look through the whole map and send the data on all of the corresponding channels
-			for _, pipes := range connDetails.SPMC {
-				if isStdout {
-					pipes.StdoutChan <- data
-				} else {
-					pipes.StderrChan <- data
-				}
-			}
-			connDetails.SLock.Unlock()
-		}
+	// Users that can only watch, or send some commands, get told off just on their socket
+	if readOnly {
+		utils.RecordRejectedCommand(connDetails.ServerID, user.ID, source, command)
+		sub.send(errorMessage("This console is read only"))
+		return
 	}
+	err := checkCommand(connDetails.ServerID, user, source, command)
+	if err != nil {
+		sub.send(errorMessage(err.Error()))
+		return
+	}
+	utils.RecordCommand(connDetails.ServerID, user.ID, source, command)
 
-	// Run readers for stdout and stderr
-	go read(outReader, connDetails, true)
-	go read(errReader, connDetails, false)
+	// Before sending to stdin, tell all other open websockets you are sending this message
+	// This is important so everyone gets to see the same console state
+	connDetails.SLock.Lock()
+	connDetails.broadcast(inputMessage(user.Username, command))
+	connDetails.SLock.Unlock()
+	// Now actually send data over to stdin. This is done without the lock so a stuck stdin can
+	// never hold up output
+	err = connDetails.Input([]byte(command + "\n"))
+	if err != nil {
+		sub.send(errorMessage(err.Error()))
+	}
 }
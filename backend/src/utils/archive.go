@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Formats backups can be downloaded and exported as
+const (
+	FormatTarZstd = "tar.zst"
+	FormatTarGzip = "tar.gz"
+	FormatZip     = "zip"
+)
+
+// DefaultArchiveFormat is the format used when none is picked
+const DefaultArchiveFormat = FormatTarGzip
+
+// ArchiveContentType gets the MIME type of an archive format, or an empty string if the format
+// doesn't exist
+func ArchiveContentType(format string) string {
+	switch format {
+	case FormatTarZstd:
+		return "application/zstd"
+	case FormatTarGzip:
+		return "application/gzip"
+	case FormatZip:
+		return "application/zip"
+	}
+	return ""
+}
+
+// WriteArchive writes the files of a manifest out as an archive, one chunk at a time so nothing
+// has to be buffered. Modes and modification times are kept in every format, owners only in
+// tar. The store must be in use while it runs
+func (m *BackupManifest) WriteArchive(store *ChunkStore, format string, w io.Writer) error {
+	var compressor io.WriteCloser
+	var err error
+	switch format {
+	case FormatTarZstd:
+		compressor, err = zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+	case FormatTarGzip:
+		compressor = gzip.NewWriter(w)
+	case FormatZip:
+		return m.writeZip(store, w)
+	default:
+		return errors.New("unknown archive format")
+	}
+
+	err = m.WriteTar(store, compressor)
+	if closeErr := compressor.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Helper function to get the mode of a file in a backup as Go sees it
+func fileMode(file BackupFile) os.FileMode {
+	mode := os.FileMode(file.Mode).Perm()
+	switch file.Type {
+	case tar.TypeDir:
+		mode |= os.ModeDir
+	case tar.TypeSymlink:
+		mode |= os.ModeSymlink
+	}
+	return mode
+}
+
+// writeZip writes the files of a manifest out as a zip archive. Zip has no hard links, so they
+// get a copy of what they link to, and things like devices are left out
+func (m *BackupManifest) writeZip(store *ChunkStore, w io.Writer) error {
+	writer := zip.NewWriter(w)
+	regular := make(map[string]BackupFile)
+	for _, file := range m.Files {
+		header := &zip.FileHeader{Name: file.Name, Modified: file.ModTime, Method: zip.Deflate}
+		header.SetMode(fileMode(file))
+
+		chunks := file.Chunks
+		var content string
+		switch file.Type {
+		case tar.TypeReg:
+			regular[file.Name] = file
+		case tar.TypeDir:
+			header.Name = strings.TrimSuffix(file.Name, "/") + "/"
+			header.Method = zip.Store
+		case tar.TypeSymlink:
+			// Zip keeps where a link points as its content
+			content = file.Linkname
+		case tar.TypeLink:
+			target, exists := regular[file.Linkname]
+			if !exists {
+				continue
+			}
+			chunks = target.Chunks
+			header.SetMode(fileMode(target))
+		default:
+			continue
+		}
+
+		out, err := writer.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(out, content)
+		if err != nil {
+			return err
+		}
+		for _, hash := range chunks {
+			data, err := store.Get(hash)
+			if err != nil {
+				return err
+			}
+			_, err = out.Write(data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return writer.Close()
+}
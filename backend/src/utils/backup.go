@@ -1,137 +1,131 @@
 package utils
 
 import (
-	"archive/zip"
+	"archive/tar"
+	"bytes"
 	"errors"
-	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
-func zipFiles(filename string, files []string) error {
+// ServerDataDir is where game containers keep everything that gets backed up
+const ServerDataDir = "/data"
 
-	newZipFile, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	defer newZipFile.Close()
-
-	zipWriter := zip.NewWriter(newZipFile)
-	defer zipWriter.Close()
+// archive is the output of docker cp, which has to be waited on once it's read
+type archive struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
 
-	//Add files to zip
-	for _, file := range files {
-		if err = addFileToZip(zipWriter, file); err != nil {
-			return err
-		}
+// Close waits for docker to finish, returning whatever went wrong
+func (a *archive) Close() error {
+	_ = a.ReadCloser.Close()
+	err := a.cmd.Wait()
+	if err != nil && a.stderr.Len() > 0 {
+		return errors.New(strings.TrimSpace(a.stderr.String()))
 	}
-	return nil
+	return err
 }
 
-func addFileToZip(zipWriter *zip.Writer, filename string) error {
-
-	fileToZip, err := os.Open(filename)
+// ArchiveServerData streams a tar archive of a directory in a server container. Entries are
+// named starting with the directory's own name. This works whether the server is running or not
+func ArchiveServerData(name, dir string) (io.ReadCloser, error) {
+	cmd := exec.Command("docker", "cp", name+":"+dir, "-")
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.StdoutPipe()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer fileToZip.Close()
-
-	//Get the file information
-	info, err := fileToZip.Stat()
+	err = cmd.Start()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &archive{ReadCloser: out, cmd: cmd, stderr: stderr}, nil
+}
 
-	header, err := zip.FileInfoHeader(info)
+// ClearServerData deletes everything in a directory of a stopped server container. docker cp
+// can only add files, so this runs the container's own image against its volumes
+func ClearServerData(name, dir string) error {
+	out, err := exec.Command("docker", "inspect", "-f", "{{.Config.Image}}", name).Output()
 	if err != nil {
 		return err
 	}
-
-	//Using FileInfoHeader() above only uses the basename of the file. If we want
-	//to preserve the folder structure we can overwrite this with the full path.
-	header.Name = filename
-
-	//Change to deflate to gain better compression
-	header.Method = zip.Deflate
-
-	writer, err := zipWriter.CreateHeader(header)
+	image := strings.TrimSpace(string(out))
+	out, err = exec.Command(
+		"docker", "run", "--rm", "--volumes-from", name, "--user", "0", "--entrypoint", "find",
+		image, dir, "-mindepth", "1", "-delete",
+	).CombinedOutput()
 	if err != nil {
-		return err
+		return errors.New(strings.TrimSpace(string(out)))
 	}
-	_, err = io.Copy(writer, fileToZip)
-	return err
+	return nil
 }
 
-func walk(basePath string, walkedFiles *[]string) error {
-	//Open the Directory
-	files, err := ioutil.ReadDir(basePath)
+// RestoreServerData unpacks a tar archive made by ArchiveServerData back into a server
+// container, keeping the owners in the archive
+func RestoreServerData(name, dir string, archive io.Reader) error {
+	cmd := exec.Command("docker", "cp", "-a", "-", name+":"+path.Dir(dir))
+	cmd.Stdin = archive
+	out, err := cmd.CombinedOutput()
 	if err != nil {
-		fmt.Println(err)
+		return errors.New(strings.TrimSpace(string(out)))
 	}
+	return nil
+}
+
+// ExtractServerData unpacks a tar archive made by ArchiveServerData into a directory on msmf's
+// own disk, such as to try restoring a backup. Only directories and regular files are unpacked,
+// so links can't point anything outside the directory
+func ExtractServerData(archive io.Reader, dir string) error {
+	reader := tar.NewReader(archive)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name, err := cleanName(header.Name)
+		if err != nil {
+			return errors.New("archive has an invalid path " + header.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
 
-	for _, file := range files {
-		if file.IsDir() {
-			//Recurse
-			newBase := filepath.Join(basePath, file.Name()) + "/"
-			err = walk(newBase, walkedFiles)
-			if err != nil {
-				return err
-			}
-		} else {
-			*walkedFiles = append(*walkedFiles, filepath.Join(basePath, file.Name()))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0750)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(reader, target, header.ModTime)
+		}
+		if err != nil {
+			return err
 		}
 	}
-	return nil
 }
 
-/*
-Backup a Minecraft world. Takes a path to the
-server folder as an argument.
-*/
-func Backup(path, world string) error {
-	os.Chdir(path)
-	files, err := ioutil.ReadDir(".")
+// Helper function to write out a file from an archive
+func extractFile(r io.Reader, path string, modTime time.Time) error {
+	err := os.MkdirAll(filepath.Dir(path), 0750)
 	if err != nil {
 		return err
 	}
-
-	worldFound := false
-	for _, file := range files {
-		if file.Name() == world {
-			worldFound = true
-			fi, err := os.Stat(file.Name())
-			if err != nil {
-				return err
-			}
-			if fi.Mode().IsDir() {
-				filesToZip := []string{}
-				err = walk(file.Name(), &filesToZip)
-
-				fmt.Println("Zipping")
-				err = zipFiles(world+".zip", filesToZip)
-				if err != nil {
-					return err
-				}
-			}
-		}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
 	}
-	if !worldFound {
-		err = errors.New("World file not found")
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, modTime, modTime)
 }
-
-// func main() {
-// 	reader := bufio.NewReader(os.Stdin)
-// 	scanner := bufio.NewScanner(reader)
-// 	scanner.Scan()
-// 	text := scanner.Text()
-// 	err := Backup(text, "world")
-// 	if err != nil {
-// 		fmt.Println(err)
-// 	} else {
-// 		fmt.Println("Zipped!")
-// 	}
-// }
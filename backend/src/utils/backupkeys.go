@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrBackupKeyMissing is returned when a backup is encrypted with a key msmf doesn't have
+var ErrBackupKeyMissing = errors.New("backup is encrypted with a key msmf doesn't have")
+
+// PortalBackupKey is the key backups are encrypted with when their server doesn't have its own,
+// or nil if the portal doesn't have one
+var PortalBackupKey *BackupKey
+
+// BackupKeyInfo is what's needed besides the passphrase to get a key back. None of it is secret,
+// so it's kept with every backup made with the key
+type BackupKeyInfo struct {
+	// A random ID telling keys apart, so it gives nothing about the passphrase away
+	ID string `json:"id"`
+	// The salt the key is derived with, random for every key so no two installs or passphrases
+	// can be attacked at once
+	Salt []byte `json:"salt"`
+}
+
+// BackupKey encrypts backups before they leave msmf. Chunks are named by a keyed hash rather than
+// the hash of what's in them, so nothing about the data can be learnt without the key
+type BackupKey struct {
+	aead  cipher.AEAD
+	mac   []byte
+	check []byte
+	info  BackupKeyInfo
+}
+
+// NewBackupKey makes a new key from a passphrase, with a salt and ID of its own
+func NewBackupKey(passphrase string) (*BackupKey, error) {
+	id := make([]byte, 8)
+	salt := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, id)
+	if err == nil {
+		_, err = io.ReadFull(rand.Reader, salt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return OpenBackupKey(passphrase, BackupKeyInfo{ID: hex.EncodeToString(id), Salt: salt})
+}
+
+// OpenBackupKey derives a key made by NewBackupKey again from its passphrase. It's deliberately
+// slow. A wrong passphrase still gives a key, it just can't decrypt anything
+func OpenBackupKey(passphrase string, info BackupKeyInfo) (*BackupKey, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("backup passphrases can't be empty")
+	}
+	if len(info.Salt) == 0 {
+		return nil, errors.New("backup key has no salt")
+	}
+	derived, err := scrypt.Key([]byte(passphrase), info.Salt, 1<<15, 8, 1, 96)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(derived[:32])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &BackupKey{aead: aead, mac: derived[32:64], check: derived[64:], info: info}, nil
+}
+
+// portalKeyFile is where the salt and ID of the portal's key are kept between restarts, with a
+// check that the passphrase hasn't changed. It never leaves msmf's own disk
+type portalKeyFile struct {
+	BackupKeyInfo
+	Check string `json:"check"`
+}
+
+// LoadBackupKey reads the BACKUP_PASSPHRASE environment variable. Leaving it unset means backups
+// are only encrypted for servers with a passphrase of their own. Changing it makes a new key, and
+// backups made with the old one need the old passphrase given to be read
+func LoadBackupKey() error {
+	passphrase, exists := os.LookupEnv("BACKUP_PASSPHRASE")
+	if !exists || len(passphrase) == 0 {
+		return nil
+	}
+	path, err := DataPath("backup-key.json")
+	if err != nil {
+		return err
+	}
+
+	var saved portalKeyFile
+	data, err := ioutil.ReadFile(path)
+	if err == nil && json.Unmarshal(data, &saved) == nil {
+		key, err := OpenBackupKey(passphrase, saved.BackupKeyInfo)
+		if err == nil && hmac.Equal([]byte(key.checkValue()), []byte(saved.Check)) {
+			PortalBackupKey = key
+			return nil
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	key, err := NewBackupKey(passphrase)
+	if err != nil {
+		return err
+	}
+	data, err = json.Marshal(portalKeyFile{BackupKeyInfo: key.Info(), Check: key.checkValue()})
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		return err
+	}
+	PortalBackupKey = key
+	return nil
+}
+
+// Fingerprint is the ID of the key, so backups can record which key they need
+func (k *BackupKey) Fingerprint() string {
+	return k.info.ID
+}
+
+// Info gets the salt and ID of the key
+func (k *BackupKey) Info() BackupKeyInfo {
+	return k.info
+}
+
+// Helper function to get a value showing the passphrase is right, from a part of the key that
+// isn't used for anything else
+func (k *BackupKey) checkValue() string {
+	mac := hmac.New(sha256.New, k.check)
+	_, _ = mac.Write([]byte(k.info.ID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Helper function to get the keyed hash of some data as hex
+func (k *BackupKey) hash(data []byte) string {
+	mac := hmac.New(sha256.New, k.mac)
+	_, _ = mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// seal encrypts data, keeping the nonce in front of it
+func (k *BackupKey) seal(data []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return k.aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// open decrypts data made by seal
+func (k *BackupKey) open(data []byte) ([]byte, error) {
+	if len(data) < k.aead.NonceSize() {
+		return nil, errors.New("encrypted data is too short")
+	}
+	nonce := data[:k.aead.NonceSize()]
+	return k.aead.Open(nil, nonce, data[k.aead.NonceSize():], nil)
+}
@@ -0,0 +1,504 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BackupChunkSize is how big the pieces files are split into for backups. Minecraft region
+// files are laid out in fixed sectors, so changing a chunk of the world doesn't move the rest of
+// the file and fixed size pieces dedupe well
+const BackupChunkSize = 1 << 20
+
+// The version of the manifest format
+const manifestVersion = 1
+
+// Chunks are named by the SHA-256 of what's in them, or by its HMAC with the key for encrypted
+// backups
+var chunkName = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ErrChunkCorrupt is returned when a chunk no longer has the hash it's named by
+var ErrChunkCorrupt = errors.New("chunk is corrupt")
+
+// ErrChunkStoreInUse is returned when garbage can't be collected because the store is in use
+var ErrChunkStoreInUse = errors.New("chunk store is in use")
+
+// ChunkStore keeps backup data on a target split into chunks, each stored once no matter how
+// many backups use it. Chunks are gzipped, and each backup is a manifest of its chunks
+type ChunkStore struct {
+	target BackupTarget
+	// Garbage is only collected while nothing uses the store, so chunks can't be thrown away
+	// between being stored and being saved in a manifest
+	users *storeUsers
+	// What chunks and manifests are encrypted with, if anything
+	key *BackupKey
+}
+
+// NewChunkStore makes a chunk store on a backup target
+func NewChunkStore(target BackupTarget) *ChunkStore {
+	users := &storeUsers{}
+	users.done = sync.NewCond(&users.lock)
+	return &ChunkStore{target: target, users: users}
+}
+
+// WithKey gets the same store, but encrypting what it writes and decrypting what it reads with
+// a key. A nil key reads and writes unencrypted backups
+func (s *ChunkStore) WithKey(key *BackupKey) *ChunkStore {
+	return &ChunkStore{target: s.target, users: s.users, key: key}
+}
+
+// Target gets the backup target the chunks are kept on
+func (s *ChunkStore) Target() BackupTarget {
+	return s.target
+}
+
+// Helper function to get what a chunk is called. Chunks are spread over directories by their
+// first byte so no directory gets too big
+func chunkObject(hash string) string {
+	return "chunks/" + hash[:2] + "/" + hash
+}
+
+// Helper function to get what the manifest of a backup is called
+func manifestObject(serverID, id int) string {
+	return fmt.Sprintf("manifests/%d/%d.json.gz", serverID, id)
+}
+
+// storeUsers counts what is using a chunk store
+type storeUsers struct {
+	lock       sync.Mutex
+	count      int
+	collecting bool
+	// Signalled when garbage collection is done
+	done *sync.Cond
+}
+
+// Use stops garbage from being collected until the returned function is called. Hold it while
+// storing chunks until the manifest using them is saved, or while reading a backup. It only
+// waits if garbage is being collected right now
+func (s *ChunkStore) Use() func() {
+	s.users.lock.Lock()
+	defer s.users.lock.Unlock()
+	for s.users.collecting {
+		s.users.done.Wait()
+	}
+	s.users.count++
+	return func() {
+		s.users.lock.Lock()
+		defer s.users.lock.Unlock()
+		s.users.count--
+	}
+}
+
+// Helper function to get the name of a chunk holding some data
+func (s *ChunkStore) hash(data []byte) string {
+	if s.key != nil {
+		return s.key.hash(data)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Put stores a chunk if it isn't already, returning its hash and how many bytes it took up if
+// it was new. Chunks are compressed before they're encrypted, since encrypted data won't compress
+func (s *ChunkStore) Put(data []byte) (hash string, stored int64, err error) {
+	hash = s.hash(data)
+	exists, err := s.target.Exists(chunkObject(hash))
+	if err != nil || exists {
+		return hash, 0, err
+	}
+
+	var buf bytes.Buffer
+	compressor, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	_, _ = compressor.Write(data)
+	_ = compressor.Close()
+	chunk := buf.Bytes()
+	if s.key != nil {
+		chunk, err = s.key.seal(chunk)
+		if err != nil {
+			return hash, 0, err
+		}
+	}
+	return hash, int64(len(chunk)), s.target.Put(chunkObject(hash), chunk)
+}
+
+// Get reads a chunk, making sure it still has the hash it's named by
+func (s *ChunkStore) Get(hash string) ([]byte, error) {
+	if !chunkName.MatchString(hash) {
+		return nil, ErrChunkCorrupt
+	}
+	compressed, err := s.target.Get(chunkObject(hash))
+	if err != nil {
+		return nil, err
+	}
+	if s.key != nil {
+		compressed, err = s.key.open(compressed)
+		if err != nil {
+			return nil, ErrChunkCorrupt
+		}
+	}
+	decompressor, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, ErrChunkCorrupt
+	}
+	data, err := ioutil.ReadAll(decompressor)
+	if err != nil {
+		return nil, ErrChunkCorrupt
+	}
+	if s.hash(data) != hash {
+		return nil, ErrChunkCorrupt
+	}
+	return data, nil
+}
+
+// PutManifest saves the manifest of a backup, as encoded by EncodeManifest
+func (s *ChunkStore) PutManifest(serverID, id int, data []byte) error {
+	return s.target.Put(manifestObject(serverID, id), data)
+}
+
+// GetManifest reads the manifest of a backup
+func (s *ChunkStore) GetManifest(serverID, id int) ([]byte, error) {
+	return s.target.Get(manifestObject(serverID, id))
+}
+
+// DeleteManifest deletes the manifest of a backup. Its chunks stay until garbage is collected
+func (s *ChunkStore) DeleteManifest(serverID, id int) error {
+	return s.target.Delete(manifestObject(serverID, id))
+}
+
+// DeleteManifests deletes the manifests of every backup of a server
+func (s *ChunkStore) DeleteManifests(serverID int) error {
+	names, err := s.target.List(fmt.Sprintf("manifests/%d/", serverID))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = s.target.Delete(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// referenced finds every chunk a saved manifest uses
+func (s *ChunkStore) referenced() (map[string]bool, error) {
+	names, err := s.target.List("manifests/")
+	if err != nil {
+		return nil, err
+	}
+	referenced := make(map[string]bool)
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".json.gz") {
+			continue
+		}
+		data, err := s.target.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		// A manifest that can't be read might still need its chunks, so collect nothing
+		manifest, err := DecodeManifest(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		manifest.Reference(referenced)
+	}
+	return referenced, nil
+}
+
+// Collect deletes every chunk no saved manifest uses, returning how many were deleted. Nothing
+// can start using the store while it runs, so nothing is halfway through storing a backup. If
+// the store is already in use it gives up with ErrChunkStoreInUse rather than wait, since a slow
+// download could hold it for ages
+func (s *ChunkStore) Collect() (removed int, err error) {
+	s.users.lock.Lock()
+	if s.users.count > 0 || s.users.collecting {
+		s.users.lock.Unlock()
+		return 0, ErrChunkStoreInUse
+	}
+	s.users.collecting = true
+	s.users.lock.Unlock()
+	defer func() {
+		s.users.lock.Lock()
+		defer s.users.lock.Unlock()
+		s.users.collecting = false
+		s.users.done.Broadcast()
+	}()
+
+	keep, err := s.referenced()
+	if err != nil {
+		return 0, err
+	}
+	names, err := s.target.List("chunks/")
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		// Leftovers from writes that never finished are garbage too
+		if hash := path.Base(name); chunkName.MatchString(hash) && keep[hash] {
+			continue
+		}
+		err = s.target.Delete(name)
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// BackupFile is a file, directory or link in a backup
+type BackupFile struct {
+	Name     string    `json:"name"`
+	Type     byte      `json:"type"`
+	Mode     int64     `json:"mode"`
+	UID      int       `json:"uid"`
+	GID      int       `json:"gid"`
+	ModTime  time.Time `json:"mod_time"`
+	Size     int64     `json:"size,omitempty"`
+	Linkname string    `json:"link,omitempty"`
+	// The hashes of the chunks making up the file, in order
+	Chunks []string `json:"chunks,omitempty"`
+}
+
+// BackupManifest lists everything in a backup. Restoring a backup puts back exactly what's in
+// its manifest, however many other backups share its chunks
+type BackupManifest struct {
+	Version int          `json:"version"`
+	Files   []BackupFile `json:"files"`
+	// Encrypted backups keep their files sealed, and only show the ID and salt of their key and
+	// which chunks they use so garbage can be collected without the key
+	Key     string   `json:"key,omitempty"`
+	KeySalt []byte   `json:"key_salt,omitempty"`
+	Chunks  []string `json:"chunks,omitempty"`
+	Sealed  []byte   `json:"sealed,omitempty"`
+}
+
+// BackupStats is how big a backup is
+type BackupStats struct {
+	// The size of every file in the backup
+	Size int64
+	// How much new data the backup added to the chunk store
+	Stored int64
+}
+
+// ChunkArchive splits the files in a tar archive into chunks and stores them, returning the
+// manifest of the archive. The store must be in use until the manifest is saved
+func ChunkArchive(store *ChunkStore, archive io.Reader) (*BackupManifest, BackupStats, error) {
+	manifest := &BackupManifest{Version: manifestVersion, Files: make([]BackupFile, 0)}
+	var stats BackupStats
+	reader := tar.NewReader(archive)
+	buf := make([]byte, BackupChunkSize)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return manifest, stats, nil
+		} else if err != nil {
+			return nil, stats, err
+		}
+
+		file := BackupFile{
+			Name:     header.Name,
+			Type:     header.Typeflag,
+			Mode:     header.Mode,
+			UID:      header.Uid,
+			GID:      header.Gid,
+			ModTime:  header.ModTime,
+			Linkname: header.Linkname,
+		}
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			file.Type = tar.TypeReg
+			file.Size = header.Size
+			stats.Size += header.Size
+			for {
+				n, err := io.ReadFull(reader, buf)
+				if n > 0 {
+					hash, stored, putErr := store.Put(buf[:n])
+					if putErr != nil {
+						return nil, stats, putErr
+					}
+					file.Chunks = append(file.Chunks, hash)
+					stats.Stored += stored
+				}
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					break
+				} else if err != nil {
+					return nil, stats, err
+				}
+			}
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+}
+
+// WriteTar writes the files of a manifest back out as a tar archive. The store must be in use
+// while it runs
+func (m *BackupManifest) WriteTar(store *ChunkStore, w io.Writer) error {
+	writer := tar.NewWriter(w)
+	for _, file := range m.Files {
+		err := writer.WriteHeader(&tar.Header{
+			Typeflag: file.Type,
+			Name:     file.Name,
+			Linkname: file.Linkname,
+			Size:     file.Size,
+			Mode:     file.Mode,
+			Uid:      file.UID,
+			Gid:      file.GID,
+			ModTime:  file.ModTime,
+		})
+		if err != nil {
+			return err
+		}
+		for _, hash := range file.Chunks {
+			data, err := store.Get(hash)
+			if err != nil {
+				return err
+			}
+			_, err = writer.Write(data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return writer.Close()
+}
+
+// ChunkReport is what checking the chunks of a backup found
+type ChunkReport struct {
+	// Whether every chunk was there and intact
+	OK      bool     `json:"ok"`
+	Files   int      `json:"files"`
+	Chunks  int      `json:"chunks"`
+	Missing []string `json:"missing"`
+	Corrupt []string `json:"corrupt"`
+}
+
+// Verify reads every chunk of a manifest to make sure it's there and intact. The store must be
+// in use while it runs
+func (m *BackupManifest) Verify(store *ChunkStore) ChunkReport {
+	report := ChunkReport{Files: len(m.Files), Missing: make([]string, 0), Corrupt: make([]string, 0)}
+	checked := make(map[string]bool)
+	for _, file := range m.Files {
+		for _, hash := range file.Chunks {
+			if checked[hash] {
+				continue
+			}
+			checked[hash] = true
+			report.Chunks++
+			_, err := store.Get(hash)
+			if errors.Is(err, os.ErrNotExist) {
+				report.Missing = append(report.Missing, hash)
+			} else if err != nil {
+				report.Corrupt = append(report.Corrupt, hash)
+			}
+		}
+	}
+	report.OK = len(report.Missing) == 0 && len(report.Corrupt) == 0
+	return report
+}
+
+// Reference marks every chunk a manifest uses
+func (m *BackupManifest) Reference(referenced map[string]bool) {
+	for _, file := range m.Files {
+		for _, hash := range file.Chunks {
+			referenced[hash] = true
+		}
+	}
+	for _, hash := range m.Chunks {
+		referenced[hash] = true
+	}
+}
+
+// SealManifest encrypts the files of a manifest with the store's key, if it has one
+func (s *ChunkStore) SealManifest(m *BackupManifest) (*BackupManifest, error) {
+	if s.key == nil {
+		return m, nil
+	}
+	referenced := make(map[string]bool)
+	m.Reference(referenced)
+	chunks := make([]string, 0, len(referenced))
+	for hash := range referenced {
+		chunks = append(chunks, hash)
+	}
+	sort.Strings(chunks)
+
+	files, err := json.Marshal(m.Files)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := s.key.seal(files)
+	if err != nil {
+		return nil, err
+	}
+	return &BackupManifest{
+		Version: m.Version,
+		Key:     s.key.Fingerprint(),
+		KeySalt: s.key.Info().Salt,
+		Chunks:  chunks,
+		Sealed:  sealed,
+	}, nil
+}
+
+// OpenManifest decrypts the files of a manifest sealed by SealManifest. It fails with
+// ErrBackupKeyMissing if the store doesn't have the key the manifest was sealed with
+func (s *ChunkStore) OpenManifest(m *BackupManifest) (*BackupManifest, error) {
+	if len(m.Key) == 0 {
+		return m, nil
+	}
+	if s.key == nil || s.key.Fingerprint() != m.Key {
+		return nil, fmt.Errorf("%w (key %s)", ErrBackupKeyMissing, m.Key)
+	}
+	files, err := s.key.open(m.Sealed)
+	if err != nil {
+		return nil, fmt.Errorf("%w (key %s), the passphrase is wrong or the manifest is corrupt", ErrBackupKeyMissing, m.Key)
+	}
+	opened := &BackupManifest{Version: m.Version}
+	err = json.Unmarshal(files, &opened.Files)
+	if err != nil {
+		return nil, err
+	}
+	return opened, nil
+}
+
+// EncodeManifest turns a manifest into the gzipped JSON it's saved as
+func EncodeManifest(m *BackupManifest) ([]byte, error) {
+	var buf bytes.Buffer
+	compressor := gzip.NewWriter(&buf)
+	err := json.NewEncoder(compressor).Encode(m)
+	if err != nil {
+		return nil, err
+	}
+	err = compressor.Close()
+	return buf.Bytes(), err
+}
+
+// DecodeManifest reads a manifest saved by EncodeManifest
+func DecodeManifest(data []byte) (*BackupManifest, error) {
+	decompressor, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var m BackupManifest
+	err = json.NewDecoder(decompressor).Decode(&m)
+	if err != nil {
+		return nil, err
+	}
+	if m.Version != manifestVersion {
+		return nil, errors.New("unknown manifest version")
+	}
+	return &m, nil
+}
@@ -0,0 +1,310 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// testFile is a file to put in a test archive. Directories and links have no data
+type testFile struct {
+	name string
+	kind byte
+	data []byte
+	link string
+}
+
+// Helper function to make random data that won't compress, the same every time for a seed
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// Helper function to make a tar archive of files
+func testArchive(t *testing.T, files []testFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	for _, file := range files {
+		header := &tar.Header{
+			Typeflag: file.kind,
+			Name:     file.name,
+			Linkname: file.link,
+			Size:     int64(len(file.data)),
+			Mode:     0640,
+			ModTime:  time.Unix(1600000000, 0),
+		}
+		if file.kind == tar.TypeDir {
+			header.Mode = 0750
+		}
+		err := writer.WriteHeader(header)
+		if err == nil {
+			_, err = writer.Write(file.data)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Helper function to make a chunk store on a local target in a temporary directory
+func testStore(t *testing.T) *ChunkStore {
+	t.Helper()
+	target, err := newLocalTarget(TargetConfig{Path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewChunkStore(target)
+}
+
+// Helper function to store an archive and save its manifest as a backup
+func storeBackup(t *testing.T, store *ChunkStore, id int, archive []byte) (*BackupManifest, BackupStats) {
+	t.Helper()
+	manifest, stats, err := ChunkArchive(store, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := store.SealManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := EncodeManifest(sealed)
+	if err == nil {
+		err = store.PutManifest(1, id, data)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifest, stats
+}
+
+// Helper function to count the chunks in a store
+func countChunks(t *testing.T, store *ChunkStore) int {
+	t.Helper()
+	names, err := store.Target().List("chunks/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(names)
+}
+
+func TestChunkStoreDedup(t *testing.T) {
+	store := testStore(t)
+	chunk := randomData(1, BackupChunkSize)
+	archive := testArchive(t, []testFile{
+		// The same chunk twice in one file, and again in another
+		{name: "world/region/r.0.0.mca", kind: tar.TypeReg, data: append(append([]byte{}, chunk...), chunk...)},
+		{name: "world/region/r.1.0.mca", kind: tar.TypeReg, data: chunk},
+		{name: "server.properties", kind: tar.TypeReg, data: []byte("motd=hi")},
+	})
+
+	manifest, stats := storeBackup(t, store, 1, archive)
+	if stats.Stored == 0 {
+		t.Error("first backup stored nothing")
+	}
+	if stats.Size != int64(3*BackupChunkSize+len("motd=hi")) {
+		t.Errorf("first backup has size %d", stats.Size)
+	}
+	if chunks := countChunks(t, store); chunks != 2 {
+		t.Errorf("store has %d chunks after the first backup, want 2", chunks)
+	}
+	if manifest.Files[0].Chunks[0] != manifest.Files[0].Chunks[1] {
+		t.Error("the same data in a file was stored as different chunks")
+	}
+
+	// Storing it again adds nothing
+	again, stats := storeBackup(t, store, 2, archive)
+	if stats.Stored != 0 {
+		t.Errorf("second backup stored %d bytes, want 0", stats.Stored)
+	}
+	if chunks := countChunks(t, store); chunks != 2 {
+		t.Errorf("store has %d chunks after the second backup, want 2", chunks)
+	}
+	for i, file := range again.Files {
+		if len(file.Chunks) != len(manifest.Files[i].Chunks) {
+			t.Errorf("%s has different chunks the second time", file.Name)
+		}
+	}
+}
+
+func TestChunkStoreCollect(t *testing.T) {
+	store := testStore(t)
+	shared := testFile{name: "world/level.dat", kind: tar.TypeReg, data: randomData(1, 1000)}
+	first := testArchive(t, []testFile{shared, {name: "old.txt", kind: tar.TypeReg, data: randomData(2, 1000)}})
+	second := testArchive(t, []testFile{shared, {name: "new.txt", kind: tar.TypeReg, data: randomData(3, 1000)}})
+	storeBackup(t, store, 1, first)
+	manifest, _ := storeBackup(t, store, 2, second)
+
+	// Leftovers from a write that never finished are garbage too
+	err := store.Target().Put("chunks/ab/abcd.tmp123", []byte("half a chunk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is collected while both backups are kept
+	removed, err := store.Collect()
+	if err != nil || removed != 1 {
+		t.Fatalf("Collect() = %d, %v, want only the leftover removed", removed, err)
+	}
+
+	err = store.DeleteManifest(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err = store.Collect()
+	if err != nil || removed != 1 {
+		t.Errorf("Collect() = %d, %v, want only the chunk of old.txt removed", removed, err)
+	}
+	if chunks := countChunks(t, store); chunks != 2 {
+		t.Errorf("store has %d chunks left, want 2", chunks)
+	}
+
+	// The backup that's left still has everything
+	report := manifest.Verify(store)
+	if !report.OK {
+		t.Errorf("backup left behind is missing %v and has %v corrupt", report.Missing, report.Corrupt)
+	}
+}
+
+func TestChunkStoreCollectInUse(t *testing.T) {
+	store := testStore(t)
+	err := store.Target().Put("chunks/ab/abcd.tmp123", []byte("half a chunk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Collecting while the store is used gives up instead of waiting
+	done := store.WithKey(nil).Use()
+	removed, err := store.Collect()
+	if !errors.Is(err, ErrChunkStoreInUse) || removed != 0 {
+		t.Errorf("Collect() while in use = %d, %v, want ErrChunkStoreInUse", removed, err)
+	}
+	done()
+
+	removed, err = store.Collect()
+	if err != nil || removed != 1 {
+		t.Errorf("Collect() once done = %d, %v, want the leftover removed", removed, err)
+	}
+}
+
+func TestChunkStoreCollectEncrypted(t *testing.T) {
+	// Encrypted manifests still show which chunks they use, so they're kept without the key
+	key, err := NewBackupKey("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := testStore(t)
+	archive := testArchive(t, []testFile{{name: "world/level.dat", kind: tar.TypeReg, data: randomData(1, 1000)}})
+	storeBackup(t, store.WithKey(key), 1, archive)
+
+	removed, err := store.Collect()
+	if err != nil || removed != 0 {
+		t.Errorf("Collect() = %d, %v, want nothing removed", removed, err)
+	}
+}
+
+func TestChunkStoreVerify(t *testing.T) {
+	store := testStore(t)
+	archive := testArchive(t, []testFile{
+		{name: "a.txt", kind: tar.TypeReg, data: randomData(1, 1000)},
+		{name: "b.txt", kind: tar.TypeReg, data: randomData(2, 1000)},
+		{name: "c.txt", kind: tar.TypeReg, data: randomData(3, 1000)},
+	})
+	manifest, _ := storeBackup(t, store, 1, archive)
+	report := manifest.Verify(store)
+	if !report.OK || report.Files != 3 || report.Chunks != 3 {
+		t.Fatalf("Verify() of an intact backup = %+v", report)
+	}
+
+	// Swap one chunk for another and delete one
+	corrupt, missing := manifest.Files[0].Chunks[0], manifest.Files[1].Chunks[0]
+	other, err := store.Target().Get(chunkObject(manifest.Files[2].Chunks[0]))
+	if err == nil {
+		err = store.Target().Put(chunkObject(corrupt), other)
+	}
+	if err == nil {
+		err = store.Target().Delete(chunkObject(missing))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report = manifest.Verify(store)
+	if report.OK || len(report.Corrupt) != 1 || report.Corrupt[0] != corrupt ||
+		len(report.Missing) != 1 || report.Missing[0] != missing {
+		t.Errorf("Verify() of a damaged backup = %+v, want %s corrupt and %s missing", report, corrupt, missing)
+	}
+	err = manifest.WriteTar(store, io.Discard)
+	if !errors.Is(err, ErrChunkCorrupt) {
+		t.Errorf("WriteTar() of a damaged backup = %v, want ErrChunkCorrupt", err)
+	}
+}
+
+func TestWriteTarRoundTrip(t *testing.T) {
+	files := []testFile{
+		{name: "world/", kind: tar.TypeDir},
+		{name: "world/region/r.0.0.mca", kind: tar.TypeReg, data: randomData(1, 2*BackupChunkSize+100)},
+		{name: "world/empty.dat", kind: tar.TypeReg},
+		{name: "world/latest", kind: tar.TypeSymlink, link: "region/r.0.0.mca"},
+		{name: "server.properties", kind: tar.TypeReg, data: []byte("motd=hi\n")},
+	}
+	archive := testArchive(t, files)
+	key, err := NewBackupKey("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, key := range map[string]*BackupKey{"plain": nil, "encrypted": key} {
+		t.Run(name, func(t *testing.T) {
+			store := testStore(t).WithKey(key)
+			storeBackup(t, store, 1, archive)
+
+			// Read the manifest back the way a restore does
+			data, err := store.GetManifest(1, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			manifest, err := DecodeManifest(data)
+			if err == nil {
+				manifest, err = store.OpenManifest(manifest)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			err = manifest.WriteTar(store, &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader := tar.NewReader(&out)
+			for _, file := range files {
+				header, err := reader.Next()
+				if err != nil {
+					t.Fatalf("archive ends before %s: %s", file.name, err)
+				}
+				if header.Name != file.name || header.Typeflag != file.kind || header.Linkname != file.link ||
+					!header.ModTime.Equal(time.Unix(1600000000, 0)) {
+					t.Errorf("got header %+v for %s", header, file.name)
+				}
+				data, err := io.ReadAll(reader)
+				if err != nil || !bytes.Equal(data, file.data) {
+					t.Errorf("%s has %d bytes, %v, want %d", file.name, len(data), err, len(file.data))
+				}
+			}
+			if _, err = reader.Next(); err != io.EOF {
+				t.Errorf("archive has more than was stored: %v", err)
+			}
+		})
+	}
+}
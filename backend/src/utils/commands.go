@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"msmf/database"
+)
+
+// Where a console command came from
+const (
+	// Typed into a console websocket
+	SourceConsole = "console"
+	// Typed into a console over SSH
+	SourceSSH = "ssh"
+	// Sent to the command endpoint
+	SourceAPI = "api"
+	// Run on a schedule, such as for backups
+	SourceScheduler = "scheduler"
+	// Sent by the moderation API
+	SourceModeration = "moderation"
+	// Sent by msmf itself, such as syncing players and shared ban lists
+	SourceMsmf = "msmf"
+	// Run by a player in game
+	SourceGame = "game"
+)
+
+// RecordCommand stores a command sent to a server in the server logs. userID is the portal
+// user behind it, if there was one
+func RecordCommand(serverID int, userID *int, source, command string) {
+	recordCommand(serverID, userID, source, command, false)
+}
+
+// RecordRejectedCommand stores a command a user wasn't allowed to send in the server logs
+func RecordRejectedCommand(serverID int, userID *int, source, command string) {
+	recordCommand(serverID, userID, source, command, true)
+}
+
+// recordCommand stores a command in the server logs
+func recordCommand(serverID int, userID *int, source, command string, rejected bool) {
+	command = strings.TrimSpace(command)
+	if len(command) == 0 {
+		return
+	}
+	err := database.DB.Create(&database.ServerLog{
+		Time:     time.Now(),
+		Command:  command,
+		Source:   source,
+		Rejected: rejected,
+		UserID:   userID,
+		ServerID: &serverID,
+	}).Error
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// dataDir is where msmf keeps its own files, like console history and backups
+var dataDir = func() string {
+	dir, exists := os.LookupEnv("DATA_DIR")
+	if !exists || len(dir) == 0 {
+		dir = "data"
+	}
+	return dir
+}()
+
+// DataPath joins a path onto the msmf data directory and makes sure the directory holding
+// it exists
+func DataPath(elem ...string) (string, error) {
+	path := filepath.Join(append([]string{dataDir}, elem...)...)
+	err := os.MkdirAll(filepath.Dir(path), 0750)
+	return path, err
+}
+
+// EnvInt reads a whole number from the environment, falling back to def when it's missing
+// or not a number
+func EnvInt(name string, def int) int {
+	str, exists := os.LookupEnv(name)
+	if !exists {
+		return def
+	}
+	n, err := strconv.Atoi(str)
+	if err != nil {
+		return def
+	}
+	return n
+}
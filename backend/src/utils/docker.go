@@ -13,6 +13,22 @@ type Console struct {
 	Stdin  io.WriteCloser
 	Stdout io.ReadCloser
 	Stderr io.ReadCloser
+
+	// The docker attach process the pipes belong to
+	cmd *exec.Cmd
+}
+
+// Close detaches from a server console. The server itself keeps running
+func (console Console) Close() error {
+	_ = console.Stdin.Close()
+	_ = console.Stdout.Close()
+	_ = console.Stderr.Close()
+	if console.cmd == nil || console.cmd.Process == nil {
+		return nil
+	}
+	// A kill isn't passed on to the container like an interrupt would be
+	_ = console.cmd.Process.Kill()
+	return console.cmd.Wait()
 }
 
 // GameName returns the docker container name
@@ -84,7 +100,7 @@ func CreateServer(serverID int, image string, isImage bool, parameters []string)
 func DeleteServer(name string) {
 	var cmdSlice []string
 	// First stop the container if it is running
-	cmdSlice = append([]string{"docker", "stop", name})
+	cmdSlice = []string{"docker", "stop", name}
 	cmd := exec.Command(cmdSlice[0], cmdSlice[1:]...)
 	err := cmd.Run()
 	if err != nil {
@@ -92,7 +108,7 @@ func DeleteServer(name string) {
 	}
 
 	// Remove the container
-	cmdSlice = append([]string{"docker", "rm", name})
+	cmdSlice = []string{"docker", "rm", name}
 	cmd = exec.Command(cmdSlice[0], cmdSlice[1:]...)
 	err = cmd.Run()
 	if err != nil {
@@ -134,11 +150,11 @@ func AttachServer(name string) (console Console, err error) {
 
 	// Try to attach to the server
 	var cmdSlice []string
-	cmdSlice = append([]string{
+	cmdSlice = []string{
 		"docker",
 		"attach",
 		name,
-	})
+	}
 	cmd := exec.Command(cmdSlice[0], cmdSlice[1:]...)
 
 	// Get stdin pipe
@@ -161,5 +177,36 @@ func AttachServer(name string) (console Console, err error) {
 
 	// Start the server
 	err = cmd.Start()
+	console.cmd = cmd
 	return console, err
 }
+
+// ContainerRunning asks docker whether a container is running right now
+func ContainerRunning(name string) (bool, error) {
+	out, err := exec.Command("docker", "inspect", "-f", "{{.State.Running}}", name).Output()
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(out)) == "true", nil
+}
+
+// ServerIP returns the IP address of a container on its docker network
+func ServerIP(name string) (string, error) {
+	out, err := exec.Command(
+		"docker",
+		"inspect",
+		"-f",
+		"{{range .NetworkSettings.Networks}}{{.IPAddress}} {{end}}",
+		name,
+	).Output()
+	if err != nil {
+		return "", err
+	}
+
+	// Just take the first network the container is attached to
+	ips := strings.Fields(string(out))
+	if len(ips) == 0 {
+		return "", errors.New("server has no ip address, is it running?")
+	}
+	return ips[0], nil
+}
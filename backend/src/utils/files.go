@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrFileNotFound is returned when a file doesn't exist in a server container
+var ErrFileNotFound = errors.New("file does not exist on the server")
+
+// The user game containers run as, files written into them need to belong to it
+const containerUID = 1000
+
+// ReadServerFile reads a file out of a server container. This works whether the server is running or not
+func ReadServerFile(name, filePath string) ([]byte, error) {
+	cmd := exec.Command("docker", "cp", name+":"+filePath, "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if strings.Contains(stderr.String(), "Could not find the file") ||
+			strings.Contains(stderr.String(), "No such container:path") {
+			return nil, ErrFileNotFound
+		}
+		return nil, errors.New(strings.TrimSpace(stderr.String()))
+	}
+
+	// docker cp always hands back a tar archive, even for a single file
+	reader := tar.NewReader(bytes.NewReader(out))
+	header, err := reader.Next()
+	if err != nil {
+		return nil, err
+	}
+	if header.Typeflag != tar.TypeReg {
+		return nil, errors.New(filePath + " is not a regular file")
+	}
+	return ioutil.ReadAll(reader)
+}
+
+// WriteServerFile writes a file into a server container, replacing it if it already exists
+func WriteServerFile(name, filePath string, data []byte) error {
+	// docker cp only takes tar archives from stdin
+	var archive bytes.Buffer
+	writer := tar.NewWriter(&archive)
+	err := writer.WriteHeader(&tar.Header{
+		Name:    path.Base(filePath),
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+		Uid:     containerUID,
+		Gid:     containerUID,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	// Archive mode keeps the owner from the tar header so the server can still write to it
+	cmd := exec.Command("docker", "cp", "-a", "-", name+":"+path.Dir(filePath))
+	cmd.Stdin = &archive
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// ReadServerJSON reads a JSON file out of a server container into v. Files that don't
+// exist leave v alone
+func ReadServerJSON(name, filePath string, v interface{}) error {
+	data, err := ReadServerFile(name, filePath)
+	if err == ErrFileNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// Servers write out empty files sometimes
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// WriteServerJSON writes v as a JSON file into a server container
+func WriteServerJSON(name, filePath string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteServerFile(name, filePath, data)
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"msmf/database"
+	"msmf/games"
+)
+
+// Where to look up the UUIDs of players on online mode servers
+const mojangProfileURL = "https://api.mojang.com/users/profiles/minecraft/"
+
+// ErrUnknownPlayer is returned when there is no account with a player name
+var ErrUnknownPlayer = errors.New("player does not exist")
+
+// PlayerUUID works out the UUID a server will give a player name. Players msmf has seen are
+// looked up in the database, otherwise offline mode servers compute it from the name and
+// online mode servers ask Mojang
+func PlayerUUID(serverID int, name string) (string, error) {
+	var player database.Player
+	database.DB.Joins(
+		"INNER JOIN player_logs pl ON pl.player_id = players.id",
+	).Where(
+		"LOWER(players.name) = LOWER(?) AND pl.server_id = ?", name, serverID,
+	).Order("players.last_seen DESC").Limit(1).Find(&player)
+	if player.ID != nil {
+		return player.UUID, nil
+	}
+
+	// Servers are in online mode unless they say otherwise
+	data, err := ReadServerFile(GameName(serverID), games.McPropertiesFile)
+	if err != nil && err != ErrFileNotFound {
+		return "", err
+	}
+	if games.MCParseProperties(data)["online-mode"] == "false" {
+		return games.MCOfflineUUID(name), nil
+	}
+	return mojangUUID(name)
+}
+
+// mojangUUID looks up the UUID of a premium account
+func mojangUUID(name string) (string, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Get(mojangProfileURL + name)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	// Mojang answers with no content for names nobody has
+	if res.StatusCode == http.StatusNoContent || res.StatusCode == http.StatusNotFound {
+		return "", ErrUnknownPlayer
+	} else if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not look up player %s: %s", name, res.Status)
+	}
+
+	var profile struct {
+		ID string `json:"id"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&profile)
+	if err != nil {
+		return "", err
+	}
+	if len(profile.ID) != 32 {
+		return "", ErrUnknownPlayer
+	}
+
+	// Mojang leaves the dashes out
+	id := strings.ToLower(profile.ID)
+	return id[:8] + "-" + id[8:12] + "-" + id[12:16] + "-" + id[16:20] + "-" + id[20:], nil
+}
+
+// ReadServerList reads one of the player lists of a Minecraft server
+func ReadServerList(serverID int, list games.MCList) ([]games.MCListEntry, error) {
+	entries := make([]games.MCListEntry, 0)
+	err := ReadServerJSON(GameName(serverID), list.File, &entries)
+	return entries, err
+}
+
+// WriteServerList writes one of the player lists of a Minecraft server. A running server
+// keeps the lists in memory, so it should be stopped first
+func WriteServerList(serverID int, list games.MCList, entries []games.MCListEntry) error {
+	if entries == nil {
+		entries = make([]games.MCListEntry, 0)
+	}
+	return WriteServerJSON(GameName(serverID), list.File, entries)
+}
@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"msmf/database"
+	"msmf/games"
+)
+
+// How long to wait on an RCON server before giving up
+const rconTimeout = 5 * time.Second
+
+// ErrNoRcon is returned for servers that were created without an RCON password
+var ErrNoRcon = errors.New("rcon is not configured for this server")
+
+// rconClients holds one open RCON connection per server so commands don't log in every time
+var rconClients = make(map[int]*games.RCON)
+
+// rconLock is a lock for accessing the rconClients map
+var rconLock sync.Mutex
+
+// RconParameters returns the docker parameters needed to turn on RCON for a new server
+// along with the encrypted password to store with it
+func RconParameters() (parameters []string, encrypted []byte, err error) {
+	password, err := GeneratePassword()
+	if err != nil {
+		return nil, nil, err
+	}
+	encrypted, err = EncryptSecret([]byte(password))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parameters = []string{
+		"-e", "ENABLE_RCON=TRUE",
+		"-e", fmt.Sprintf("RCON_PORT=%d", games.McDefaultRconPort),
+		"-e", "RCON_PASSWORD=" + password,
+	}
+	return parameters, encrypted, nil
+}
+
+// RconUnsent checks if an RCON command failed before it reached the server, so nothing was run
+func RconUnsent(err error) bool {
+	var unsent *games.RconUnsentError
+	return errors.As(err, &unsent)
+}
+
+// RconCommand runs a command on a server over RCON and returns its response
+func RconCommand(serverID int, command string) (string, error) {
+	client, err := rconClient(serverID)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Command(command)
+	if err != nil {
+		// The connection is dead either way. Only a command that never got sent is tried again
+		// on a fresh one (the server restarted), since anything else might have run already
+		CloseRcon(serverID)
+		if !RconUnsent(err) {
+			return "", err
+		}
+		client, err = rconClient(serverID)
+		if err != nil {
+			return "", err
+		}
+		resp, err = client.Command(command)
+		if err != nil {
+			CloseRcon(serverID)
+			return "", err
+		}
+	}
+	return resp, nil
+}
+
+// CloseRcon drops the cached RCON connection to a server if there is one
+func CloseRcon(serverID int) {
+	rconLock.Lock()
+	defer rconLock.Unlock()
+	client, exists := rconClients[serverID]
+	if exists {
+		_ = client.Close()
+		delete(rconClients, serverID)
+	}
+}
+
+// rconClient gets the cached RCON connection for a server or makes a new one
+func rconClient(serverID int) (*games.RCON, error) {
+	rconLock.Lock()
+	defer rconLock.Unlock()
+
+	client, exists := rconClients[serverID]
+	if exists {
+		return client, nil
+	}
+
+	// Get the password for this server
+	var server database.Server
+	err := database.DB.Select("id", "rcon_password").Where(
+		"servers.id = ?", serverID,
+	).First(&server).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(server.RconPassword) == 0 {
+		return nil, ErrNoRcon
+	}
+	password, err := DecryptSecret(server.RconPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	// RCON isn't published on the host, so talk to the container directly
+	ip, err := ServerIP(GameName(serverID))
+	if err != nil {
+		return nil, &games.RconUnsentError{Err: err}
+	}
+
+	client, err = games.DialRCON(
+		fmt.Sprintf("%s:%d", ip, games.McDefaultRconPort),
+		string(password),
+		rconTimeout,
+	)
+	if err != nil {
+		return nil, err
+	}
+	rconClients[serverID] = client
+	return client, nil
+}
@@ -0,0 +1,185 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// How long a single request to S3 can take, other than streaming an object
+const s3Timeout = 5 * time.Minute
+
+// How much of a stream is sent to S3 at a time. Each part is held in memory so it can be sent
+// again if it fails, and S3 needs them to be at least 5 MiB
+const s3PartSize = 16 << 20
+
+// s3Target keeps backups in a bucket on S3 compatible storage
+type s3Target struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// newS3Target makes a target for an S3 bucket. AWS is used if no endpoint is given
+func newS3Target(config TargetConfig) (BackupTarget, error) {
+	if len(config.Bucket) == 0 || len(config.AccessKey) == 0 || len(config.SecretKey) == 0 {
+		return nil, errors.New("S3 backup targets need a bucket, access key and secret key")
+	}
+	region := config.Region
+	if len(region) == 0 {
+		region = "us-east-1"
+	}
+	endpoint := config.Endpoint
+	if len(endpoint) == 0 {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	parsed, err := url.Parse(endpoint)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Host) == 0 ||
+		strings.Trim(parsed.Path, "/") != "" {
+		return nil, errors.New("S3 endpoint must be an http or https URL without a path")
+	}
+
+	lookup := minio.BucketLookupDNS
+	if config.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(parsed.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure:       parsed.Scheme == "https",
+		Region:       region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.Trim(config.Path, "/")
+	if len(prefix) > 0 {
+		prefix += "/"
+	}
+	return &s3Target{client: client, bucket: config.Bucket, prefix: prefix}, nil
+}
+
+// Helper function to turn a missing object into os.ErrNotExist
+func s3Error(err error) error {
+	resp := minio.ToErrorResponse(err)
+	if resp.Code == "NoSuchKey" || resp.StatusCode == http.StatusNotFound {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+// Helper function to get the key of an object in the bucket. Names are checked the same as on
+// other targets so they behave the same everywhere
+func (t *s3Target) key(name string) (string, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return "", err
+	}
+	return t.prefix + name, nil
+}
+
+// Put stores an object
+func (t *s3Target) Put(name string, data []byte) error {
+	key, err := t.key(name)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	_, err = t.client.PutObject(
+		ctx, t.bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{},
+	)
+	return err
+}
+
+// Get reads an object
+func (t *s3Target) Get(name string) ([]byte, error) {
+	key, err := t.key(name)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	object, err := t.client.GetObject(ctx, t.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	defer object.Close()
+	data, err := ioutil.ReadAll(object)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return data, nil
+}
+
+// Exists checks if an object exists
+func (t *s3Target) Exists(name string) (bool, error) {
+	key, err := t.key(name)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	_, err = t.client.StatObject(ctx, t.bucket, key, minio.StatObjectOptions{})
+	err = s3Error(err)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete deletes an object
+func (t *s3Target) Delete(name string) error {
+	key, err := t.key(name)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	err = s3Error(t.client.RemoveObject(ctx, t.bucket, key, minio.RemoveObjectOptions{}))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// List lists the objects starting with a prefix
+func (t *s3Target) List(prefix string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	names := make([]string, 0)
+	for object := range t.client.ListObjects(ctx, t.bucket, minio.ListObjectsOptions{
+		Prefix:    t.prefix + prefix,
+		Recursive: true,
+	}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		names = append(names, strings.TrimPrefix(object.Key, t.prefix))
+	}
+	return names, nil
+}
+
+// PutStream stores an object as it's read, in parts so no more than one is held at a time. Each
+// part is retried by the client on its own
+func (t *s3Target) PutStream(name string, r io.Reader) error {
+	key, err := t.key(name)
+	if err != nil {
+		return err
+	}
+	_, err = t.client.PutObject(
+		context.Background(), t.bucket, key, r, -1, minio.PutObjectOptions{PartSize: s3PartSize},
+	)
+	return err
+}
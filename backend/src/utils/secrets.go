@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+)
+
+// secretKey is the key used to encrypt secrets msmf needs to read back, such as RCON passwords
+var secretKey []byte
+
+// LoadSecretKey reads the SECRET_KEY environment variable. It must be called before
+// any secrets are encrypted or decrypted
+func LoadSecretKey() error {
+	key, exists := os.LookupEnv("SECRET_KEY")
+	if !exists || len(key) == 0 {
+		return errors.New("you must set a secret key")
+	}
+	// Stretch whatever the user gave us into a valid AES-256 key
+	sum := sha256.Sum256([]byte(key))
+	secretKey = sum[:]
+	return nil
+}
+
+// EncryptSecret encrypts a secret with the portal's secret key
+func EncryptSecret(plaintext []byte) ([]byte, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	// Keep the nonce in front of the ciphertext so it can be decrypted later
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// DecryptSecret decrypts a secret made by EncryptSecret
+func DecryptSecret(ciphertext []byte) ([]byte, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("secret is too short")
+	}
+	nonce := ciphertext[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, ciphertext[gcm.NonceSize():], nil)
+}
+
+// GeneratePassword returns a random password safe to pass through environment variables
+func GeneratePassword() (string, error) {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// secretCipher builds the AEAD used for secrets
+func secretCipher() (cipher.AEAD, error) {
+	if secretKey == nil {
+		return nil, errors.New("secret key has not been loaded")
+	}
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,267 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// How long connecting to an SFTP server can take
+const sftpTimeout = 30 * time.Second
+
+// sftpConn is an SFTP session along with the SSH connection it runs over
+type sftpConn struct {
+	*sftp.Client
+	ssh *ssh.Client
+}
+
+// dialSFTP connects to an SFTP server
+func dialSFTP(config TargetConfig) (*sftpConn, error) {
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(config.HostKey))
+	if err != nil {
+		return nil, errors.New("SFTP backup targets need the host key of the server")
+	}
+	auth := make([]ssh.AuthMethod, 0)
+	if len(config.PrivateKey) > 0 {
+		signer, err := ssh.ParsePrivateKey([]byte(config.PrivateKey))
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if len(config.Password) > 0 {
+		auth = append(auth, ssh.Password(config.Password))
+	}
+
+	conn, err := ssh.Dial("tcp", config.Address, &ssh.ClientConfig{
+		User:            config.User,
+		Auth:            auth,
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+		Timeout:         sftpTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &sftpConn{Client: client, ssh: conn}, nil
+}
+
+// mkdirAll makes a directory and any parents it's missing
+func (c *sftpConn) mkdirAll(dir string) error {
+	err := c.MkdirAll(dir)
+	// Someone else may have made it in the meantime
+	if err != nil {
+		if info, statErr := c.Stat(dir); statErr == nil && info.IsDir() {
+			return nil
+		}
+	}
+	return err
+}
+
+// writeFile writes everything from a reader into a file, replacing what was in it
+func (c *sftpConn) writeFile(name string, r io.Reader) error {
+	file, err := c.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readFile reads all of a file
+func (c *sftpConn) readFile(name string) ([]byte, error) {
+	file, err := c.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+// Close hangs up on the server
+func (c *sftpConn) Close() error {
+	_ = c.Client.Close()
+	return c.ssh.Close()
+}
+
+// sftpTarget keeps backups in a directory on an SFTP server. The connection is made again
+// whenever it fails
+type sftpTarget struct {
+	config TargetConfig
+	dir    string
+	lock   sync.Mutex
+	client *sftpConn
+}
+
+// newSFTPTarget makes a target for an SFTP server, connecting to make sure it works
+func newSFTPTarget(config TargetConfig) (BackupTarget, error) {
+	if len(config.Address) == 0 || len(config.User) == 0 {
+		return nil, errors.New("SFTP backup targets need an address and user")
+	}
+	if len(config.Password) == 0 && len(config.PrivateKey) == 0 {
+		return nil, errors.New("SFTP backup targets need a password or private key")
+	}
+	dir := config.Path
+	if len(dir) == 0 {
+		dir = "."
+	}
+	t := &sftpTarget{config: config, dir: path.Clean(dir)}
+	err := t.with(func(c *sftpConn) error { return c.mkdirAll(t.dir) })
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// with runs something on the connection, connecting first if needed. The connection is thrown
+// away if anything other than a missing file goes wrong, in case it's what broke
+func (t *sftpTarget) with(do func(c *sftpConn) error) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.client == nil {
+		client, err := dialSFTP(t.config)
+		if err != nil {
+			return err
+		}
+		t.client = client
+	}
+	err := do(t.client)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		_ = t.client.Close()
+		t.client = nil
+	}
+	return err
+}
+
+// Helper function to get where an object is kept
+func (t *sftpTarget) path(name string) (string, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(t.dir, name), nil
+}
+
+// Put stores an object
+func (t *sftpTarget) Put(name string, data []byte) error {
+	return t.PutStream(name, bytes.NewReader(data))
+}
+
+// PutStream stores an object as it's read
+func (t *sftpTarget) PutStream(name string, r io.Reader) error {
+	file, err := t.path(name)
+	if err != nil {
+		return err
+	}
+	return t.with(func(c *sftpConn) error {
+		err := c.mkdirAll(path.Dir(file))
+		if err != nil {
+			return err
+		}
+
+		// Write to the side so a half written object never looks like a whole one. Renaming
+		// over a file fails on most servers, so the old one goes first
+		tmp := file + ".tmp"
+		err = c.writeFile(tmp, r)
+		if err != nil {
+			return err
+		}
+		err = c.Remove(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return c.Rename(tmp, file)
+	})
+}
+
+// Get reads an object
+func (t *sftpTarget) Get(name string) (data []byte, err error) {
+	file, err := t.path(name)
+	if err != nil {
+		return nil, err
+	}
+	err = t.with(func(c *sftpConn) error {
+		data, err = c.readFile(file)
+		return err
+	})
+	return data, err
+}
+
+// Exists checks if an object exists
+func (t *sftpTarget) Exists(name string) (bool, error) {
+	file, err := t.path(name)
+	if err != nil {
+		return false, err
+	}
+	err = t.with(func(c *sftpConn) error {
+		_, err := c.Stat(file)
+		return err
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete deletes an object
+func (t *sftpTarget) Delete(name string) error {
+	file, err := t.path(name)
+	if err != nil {
+		return err
+	}
+	err = t.with(func(c *sftpConn) error {
+		return c.Remove(file)
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// List lists the objects starting with a prefix
+func (t *sftpTarget) List(prefix string) ([]string, error) {
+	names := make([]string, 0)
+	err := t.with(func(c *sftpConn) error {
+		walker := c.Walk(t.dir)
+		for walker.Step() {
+			err := walker.Err()
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			name := ""
+			if walker.Path() != t.dir {
+				name = strings.TrimPrefix(walker.Path(), strings.TrimSuffix(t.dir, "/")+"/")
+			}
+			if walker.Stat().IsDir() {
+				// Skip directories that can't hold anything with the prefix
+				if len(name) > 0 && !strings.HasPrefix(name+"/", prefix) && !strings.HasPrefix(prefix, name+"/") {
+					walker.SkipDir()
+				}
+				continue
+			}
+			if strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+			}
+		}
+		return nil
+	})
+	return names, err
+}
@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// dockerSocket is where the docker engine API is. The CLI can't give an exec session a TTY
+// without one on this end, so shells talk to the API directly
+var dockerSocket = func() string {
+	host := os.Getenv("DOCKER_HOST")
+	if strings.HasPrefix(host, "unix://") {
+		return strings.TrimPrefix(host, "unix://")
+	}
+	return "/var/run/docker.sock"
+}()
+
+// dialDocker connects to the docker engine API
+func dialDocker(ctx context.Context, _, _ string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "unix", dockerSocket)
+}
+
+// dockerClient sends requests to the docker engine API
+var dockerClient = &http.Client{Transport: &http.Transport{DialContext: dialDocker}}
+
+// Helper function to make a request to the docker engine API
+func dockerRequest(method, path string, body interface{}) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://docker"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// Helper function to turn an error response from docker into an error
+func dockerError(resp *http.Response) error {
+	msg := struct {
+		Message string `json:"message"`
+	}{}
+	_ = json.NewDecoder(resp.Body).Decode(&msg)
+	if len(msg.Message) == 0 {
+		msg.Message = resp.Status
+	}
+	return errors.New(msg.Message)
+}
+
+// dockerAPI calls the docker engine API, decoding the response into out if it isn't nil
+func dockerAPI(method, path string, body, out interface{}) error {
+	req, err := dockerRequest(method, path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := dockerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return dockerError(resp)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// Shell is an interactive shell with a TTY running inside a container
+type Shell struct {
+	ID string
+	// The stream is the hijacked API connection, with whatever was read past the response
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// OpenShell starts a shell inside a running container. bash is used if the container has it
+func OpenShell(name string, cols, rows int) (*Shell, error) {
+	exec := struct {
+		ID string `json:"Id"`
+	}{}
+	err := dockerAPI("POST", "/containers/"+url.PathEscape(name)+"/exec", map[string]interface{}{
+		"AttachStdin":  true,
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Tty":          true,
+		"Env":          []string{"TERM=xterm-256color"},
+		"Cmd": []string{
+			"/bin/sh", "-c", "if command -v bash >/dev/null 2>&1; then exec bash; else exec sh; fi",
+		},
+	}, &exec)
+	if err != nil {
+		return nil, err
+	}
+
+	// Starting the exec takes the connection over for the shell's input and output
+	req, err := dockerRequest("POST", "/exec/"+exec.ID+"/start", map[string]bool{
+		"Detach": false,
+		"Tty":    true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	conn, err := dialDocker(context.Background(), "", "")
+	if err != nil {
+		return nil, err
+	}
+	err = req.Write(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		err = dockerError(resp)
+		_ = conn.Close()
+		return nil, err
+	}
+
+	shell := &Shell{ID: exec.ID, conn: conn, reader: reader}
+	// A shell that can't be resized still works, just at the wrong size
+	_ = shell.Resize(cols, rows)
+	return shell, nil
+}
+
+// Read reads output from the shell
+func (shell *Shell) Read(p []byte) (int, error) {
+	return shell.reader.Read(p)
+}
+
+// Write types into the shell
+func (shell *Shell) Write(p []byte) (int, error) {
+	return shell.conn.Write(p)
+}
+
+// Resize changes the size of the shell's TTY
+func (shell *Shell) Resize(cols, rows int) error {
+	return dockerAPI("POST", fmt.Sprintf("/exec/%s/resize?h=%d&w=%d", shell.ID, rows, cols), nil, nil)
+}
+
+// ExitCode gets the exit code of the shell once it has finished. Docker can take a moment to
+// notice the shell ended, so it's given a second
+func (shell *Shell) ExitCode() (int, error) {
+	inspect := struct {
+		Running  bool
+		ExitCode int
+	}{}
+	for tries := 0; tries < 10; tries++ {
+		err := dockerAPI("GET", "/exec/"+shell.ID+"/json", nil, &inspect)
+		if err != nil {
+			return 0, err
+		}
+		if !inspect.Running {
+			return inspect.ExitCode, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return 0, errors.New("shell is still running")
+}
+
+// Close hangs up on the shell. Docker closes its input, which ends it
+func (shell *Shell) Close() error {
+	return shell.conn.Close()
+}
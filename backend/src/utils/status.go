@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"msmf/games"
+)
+
+// How long to wait on a server to answer a status request
+const statusTimeout = 3 * time.Second
+
+// cachedStatus is a server status along with when it was fetched
+type cachedStatus struct {
+	Status  *games.MCStatus
+	Err     error
+	Fetched time.Time
+}
+
+// statusCache keeps recent server statuses so the dashboard doesn't hammer the servers
+var statusCache = make(map[int]cachedStatus)
+
+// statusLock is a lock for accessing the statusCache map
+var statusLock sync.Mutex
+
+// statusTTL is how long a status is good for before asking the server again
+var statusTTL = func() time.Duration {
+	ttlStr, exists := os.LookupEnv("STATUS_CACHE_SECONDS")
+	if !exists {
+		ttlStr = "10"
+	}
+	ttl, err := strconv.Atoi(ttlStr)
+	if err != nil {
+		ttl = 10
+	}
+	return time.Duration(ttl) * time.Second
+}()
+
+// QueryParameters returns the docker parameters needed to turn on the query protocol
+// for a new server
+func QueryParameters() []string {
+	return []string{
+		"-e", "ENABLE_QUERY=TRUE",
+		"-e", "QUERY_PORT=" + strconv.Itoa(int(games.McDefaultPort)),
+	}
+}
+
+// ServerStatus gets the status of a running server, using a cached copy if it's recent enough
+func ServerStatus(serverID int) (*games.MCStatus, error) {
+	statusLock.Lock()
+	cached, exists := statusCache[serverID]
+	statusLock.Unlock()
+	if exists && time.Since(cached.Fetched) < statusTTL {
+		return cached.Status, cached.Err
+	}
+
+	status, err := fetchStatus(serverID)
+
+	// Errors are cached too, a down server shouldn't be asked again every request
+	statusLock.Lock()
+	statusCache[serverID] = cachedStatus{
+		Status:  status,
+		Err:     err,
+		Fetched: time.Now(),
+	}
+	statusLock.Unlock()
+	return status, err
+}
+
+// ForgetStatus removes a server from the status cache, such as after it was stopped
+func ForgetStatus(serverID int) {
+	statusLock.Lock()
+	delete(statusCache, serverID)
+	statusLock.Unlock()
+}
+
+// fetchStatus asks a server for its status
+func fetchStatus(serverID int) (*games.MCStatus, error) {
+	// Ports inside the container are always the defaults, so talk to it directly
+	ip, err := ServerIP(GameName(serverID))
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := games.MCPing(ip, games.McDefaultPort, statusTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// The ping only gives a sample of players. The query protocol gives the full list,
+	// so use it if we can when the sample is missing people
+	if status.Players.Online <= len(status.Players.Sample) {
+		return status, nil
+	}
+	query, err := games.MCQuery(ip, games.McDefaultPort, statusTimeout)
+	if err != nil {
+		return status, nil
+	}
+
+	// Query doesn't give UUIDs, so keep the ones from the sample where we have them
+	ids := make(map[string]string)
+	for _, player := range status.Players.Sample {
+		ids[player.Name] = player.ID
+	}
+	for i, player := range query.Players.Sample {
+		query.Players.Sample[i].ID = ids[player.Name]
+	}
+	status.Players.Sample = query.Players.Sample
+	status.Map = query.Map
+	status.Plugins = query.Plugins
+	return status, nil
+}
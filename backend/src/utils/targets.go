@@ -0,0 +1,302 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Kinds of backup targets
+const (
+	TargetLocal = "local"
+	TargetS3    = "s3"
+	TargetSFTP  = "sftp"
+)
+
+// How many times a backup target is tried before giving up, and how long to wait after the
+// first failure. The wait doubles each time
+var (
+	targetAttempts = func() int {
+		attempts := EnvInt("BACKUP_RETRIES", 3)
+		if attempts < 1 {
+			attempts = 1
+		}
+		return attempts
+	}()
+	targetBackoff = time.Second
+)
+
+// BackupTarget is somewhere backups are kept. Objects are named like slash separated paths.
+// Getting an object that doesn't exist returns an error matching os.ErrNotExist
+type BackupTarget interface {
+	Put(name string, data []byte) error
+	Get(name string) ([]byte, error)
+	Exists(name string) (bool, error)
+	// Deleting an object that doesn't exist isn't an error
+	Delete(name string) error
+	// List returns the names of every object starting with a prefix
+	List(prefix string) ([]string, error)
+	// PutStream stores an object as it's read, without holding all of it. A failed stream can't
+	// be read again, so only the pieces of it that are buffered anyway get retried
+	PutStream(name string, r io.Reader) error
+}
+
+// TargetConfig is how to reach a backup target. Which fields are used depends on the kind
+type TargetConfig struct {
+	// The directory backups go in, or the key prefix on S3
+	Path string `json:"path,omitempty"`
+
+	// S3 compatible storage. Path style requests are needed by most servers that aren't AWS,
+	// such as MinIO
+	Endpoint  string `json:"endpoint,omitempty"`
+	Region    string `json:"region,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+	PathStyle bool   `json:"path_style,omitempty"`
+	AccessKey string `json:"access_key,omitempty"`
+	SecretKey string `json:"secret_key,omitempty"`
+
+	// SFTP. The host key is in authorized_keys format and has to match
+	Address    string `json:"address,omitempty"`
+	User       string `json:"user,omitempty"`
+	Password   string `json:"password,omitempty"`
+	PrivateKey string `json:"private_key,omitempty"`
+	HostKey    string `json:"host_key,omitempty"`
+}
+
+// Redacted is the config without any credentials, for showing to users
+func (c TargetConfig) Redacted() TargetConfig {
+	c.SecretKey = ""
+	c.Password = ""
+	c.PrivateKey = ""
+	return c
+}
+
+// OpenBackupTarget connects to a backup target. Anything that fails is retried a few times
+func OpenBackupTarget(kind string, config TargetConfig) (BackupTarget, error) {
+	var target BackupTarget
+	var err error
+	switch kind {
+	case TargetLocal:
+		target, err = newLocalTarget(config)
+	case TargetS3:
+		target, err = newS3Target(config)
+	case TargetSFTP:
+		target, err = newSFTPTarget(config)
+	default:
+		return nil, errors.New("unknown kind of backup target")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return retryTarget{target}, nil
+}
+
+// errBadName is returned for object names that could get out of where backups are kept
+var errBadName = errors.New("invalid object name")
+
+// Helper function to check an object name can't get out of where backups are kept
+func cleanName(name string) (string, error) {
+	clean := path.Clean("/" + name)[1:]
+	if len(clean) == 0 || clean != strings.TrimSuffix(name, "/") {
+		return "", fmt.Errorf("%w %s", errBadName, name)
+	}
+	return clean, nil
+}
+
+// retry keeps trying something on a backup target until it works. Objects that don't exist
+// won't start existing and bad names won't get better, so those aren't retried
+func retry(what string, try func() error) error {
+	wait := targetBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = try()
+		if err == nil || errors.Is(err, os.ErrNotExist) || errors.Is(err, errBadName) || attempt >= targetAttempts {
+			return err
+		}
+		log.Printf("Backup target failed to %s, trying again: %s\n", what, err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// retryTarget tries everything on a backup target a few times before giving up
+type retryTarget struct {
+	target BackupTarget
+}
+
+// Put stores an object
+func (t retryTarget) Put(name string, data []byte) error {
+	return retry("store "+name, func() error {
+		return t.target.Put(name, data)
+	})
+}
+
+// Get reads an object
+func (t retryTarget) Get(name string) (data []byte, err error) {
+	err = retry("read "+name, func() error {
+		data, err = t.target.Get(name)
+		return err
+	})
+	return data, err
+}
+
+// Exists checks if an object exists
+func (t retryTarget) Exists(name string) (exists bool, err error) {
+	err = retry("find "+name, func() error {
+		exists, err = t.target.Exists(name)
+		return err
+	})
+	return exists, err
+}
+
+// Delete deletes an object
+func (t retryTarget) Delete(name string) error {
+	return retry("delete "+name, func() error {
+		return t.target.Delete(name)
+	})
+}
+
+// PutStream stores an object as it's read
+func (t retryTarget) PutStream(name string, r io.Reader) error {
+	return t.target.PutStream(name, r)
+}
+
+// List lists the objects starting with a prefix
+func (t retryTarget) List(prefix string) (names []string, err error) {
+	err = retry("list "+prefix, func() error {
+		names, err = t.target.List(prefix)
+		return err
+	})
+	return names, err
+}
+
+// localTarget keeps backups in a directory
+type localTarget struct {
+	dir string
+}
+
+// newLocalTarget makes a target for a directory, creating it if it doesn't exist
+func newLocalTarget(config TargetConfig) (BackupTarget, error) {
+	if len(config.Path) == 0 {
+		return nil, errors.New("local backup targets need a path")
+	}
+	err := os.MkdirAll(config.Path, 0750)
+	if err != nil {
+		return nil, err
+	}
+	return localTarget{dir: config.Path}, nil
+}
+
+// Helper function to get where an object is kept
+func (t localTarget) path(name string) (string, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(t.dir, filepath.FromSlash(name)), nil
+}
+
+// Put stores an object
+func (t localTarget) Put(name string, data []byte) error {
+	return t.PutStream(name, bytes.NewReader(data))
+}
+
+// PutStream stores an object as it's read
+func (t localTarget) PutStream(name string, r io.Reader) error {
+	path, err := t.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		return err
+	}
+
+	// Write to the side so a half written object never looks like a whole one
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get reads an object
+func (t localTarget) Get(name string) ([]byte, error) {
+	path, err := t.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+// Exists checks if an object exists
+func (t localTarget) Exists(name string) (bool, error) {
+	path, err := t.path(name)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete deletes an object
+func (t localTarget) Delete(name string) error {
+	path, err := t.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List lists the objects starting with a prefix
+func (t localTarget) List(prefix string) ([]string, error) {
+	names := make([]string, 0)
+	err := filepath.Walk(t.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(t.dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if info.IsDir() {
+			// Skip directories that can't hold anything with the prefix
+			if name != "." && !strings.HasPrefix(name+"/", prefix) && !strings.HasPrefix(prefix, name+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
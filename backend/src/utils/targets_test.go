@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// testTarget runs a backup target through everything backups need from it
+func testTarget(t *testing.T, target BackupTarget) {
+	t.Helper()
+	objects := map[string][]byte{
+		"chunks/ab/abcd":     []byte("chunk"),
+		"chunks/cd/cdef":     []byte("another chunk"),
+		"manifests/1/2.json": []byte("{}"),
+	}
+	for name, data := range objects {
+		err := target.Put(name, data)
+		if err != nil {
+			t.Fatalf("Put(%s) failed: %s", name, err)
+		}
+	}
+
+	for name, data := range objects {
+		got, err := target.Get(name)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("Get(%s) = %q, %v, want %q", name, got, err, data)
+		}
+	}
+	_, err := target.Get("chunks/ff/ffff")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Get of a missing object gave %v, want os.ErrNotExist", err)
+	}
+
+	exists, err := target.Exists("chunks/ab/abcd")
+	if err != nil || !exists {
+		t.Errorf("Exists of a stored object = %v, %v", exists, err)
+	}
+	exists, err = target.Exists("chunks/ff/ffff")
+	if err != nil || exists {
+		t.Errorf("Exists of a missing object = %v, %v", exists, err)
+	}
+
+	names, err := target.List("chunks/")
+	sort.Strings(names)
+	if err != nil || len(names) != 2 || names[0] != "chunks/ab/abcd" || names[1] != "chunks/cd/cdef" {
+		t.Errorf("List(chunks/) = %v, %v", names, err)
+	}
+	names, err = target.List("chunks/ab")
+	if err != nil || len(names) != 1 || names[0] != "chunks/ab/abcd" {
+		t.Errorf("List(chunks/ab) = %v, %v", names, err)
+	}
+
+	// Streams bigger than an S3 part are sent in several
+	stream := bytes.Repeat([]byte("0123456789abcdef"), s3PartSize/16+1024)
+	err = target.PutStream("exports/world.tar", bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("PutStream failed: %s", err)
+	}
+	got, err := target.Get("exports/world.tar")
+	if err != nil || !bytes.Equal(got, stream) {
+		t.Errorf("Get of a streamed object gave %d bytes, %v, want %d bytes", len(got), err, len(stream))
+	}
+	// Storing over an object replaces it
+	err = target.Put("exports/world.tar", []byte("smaller"))
+	if err != nil {
+		t.Fatalf("Put over an object failed: %s", err)
+	}
+	got, err = target.Get("exports/world.tar")
+	if err != nil || string(got) != "smaller" {
+		t.Errorf("Get of a replaced object = %q, %v", got, err)
+	}
+
+	// Names that would mean something different on another target are turned away
+	for _, name := range []string{"../x", "chunks/../x", "chunks//ab", "/chunks/ab", ""} {
+		err = target.Put(name, []byte("x"))
+		if err == nil {
+			t.Errorf("Put(%q) worked, want an invalid name", name)
+		}
+		_, err = target.Get(name)
+		if err == nil || errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Get(%q) = %v, want an invalid name", name, err)
+		}
+	}
+
+	for _, name := range []string{"chunks/ab/abcd", "chunks/ff/ffff"} {
+		err = target.Delete(name)
+		if err != nil {
+			t.Errorf("Delete(%s) failed: %s", name, err)
+		}
+	}
+	exists, err = target.Exists("chunks/ab/abcd")
+	if err != nil || exists {
+		t.Errorf("Exists of a deleted object = %v, %v", exists, err)
+	}
+}
+
+func TestLocalTarget(t *testing.T) {
+	target, err := OpenBackupTarget(TargetLocal, TargetConfig{Path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTarget(t, target)
+}
+
+// Helper function to run an SFTP server on the loopback interface, returning its address and
+// host key
+func serveSFTP(t *testing.T, password string) (string, string) {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, given []byte) (*ssh.Permissions, error) {
+			if string(given) != password {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTPConn(conn, config)
+		}
+	}()
+	return listener.Addr().String(), string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+}
+
+// Helper function to serve the SFTP subsystem on an SSH connection
+func serveSFTPConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range channelRequests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(channel)
+				if err == nil {
+					_ = server.Serve()
+				}
+				_ = channel.Close()
+			}
+		}()
+	}
+}
+
+func TestSFTPTarget(t *testing.T) {
+	address, hostKey := serveSFTP(t, "hunter2")
+	config := TargetConfig{
+		Path:     t.TempDir() + "/backups",
+		Address:  address,
+		User:     "msmf",
+		Password: "hunter2",
+		HostKey:  hostKey,
+	}
+	target, err := OpenBackupTarget(TargetSFTP, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTarget(t, target)
+
+	config.Password = "wrong"
+	_, err = OpenBackupTarget(TargetSFTP, config)
+	if err == nil {
+		t.Error("SFTP target opened with the wrong password")
+	}
+}
+
+// TestS3Target needs S3 compatible storage, such as the MinIO service in docker-compose.dev.yml.
+// It's skipped unless MSMF_TEST_S3_ENDPOINT is set
+func TestS3Target(t *testing.T) {
+	endpoint, exists := os.LookupEnv("MSMF_TEST_S3_ENDPOINT")
+	if !exists {
+		t.Skip("MSMF_TEST_S3_ENDPOINT isn't set")
+	}
+	config := TargetConfig{
+		Path:      "msmf-test",
+		Endpoint:  endpoint,
+		Bucket:    os.Getenv("MSMF_TEST_S3_BUCKET"),
+		PathStyle: true,
+		AccessKey: os.Getenv("MSMF_TEST_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("MSMF_TEST_S3_SECRET_KEY"),
+	}
+	target, err := newS3Target(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Start from an empty bucket
+	client := target.(*s3Target).client
+	ctx := context.Background()
+	exists, err = client.BucketExists(ctx, config.Bucket)
+	if err == nil && !exists {
+		err = client.MakeBucket(ctx, config.Bucket, minio.MakeBucketOptions{})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := target.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		_ = target.Delete(name)
+	}
+	testTarget(t, target)
+}
@@ -116,10 +116,10 @@ func getURL(url string) (string, error) {
 
 	//Do an https get
 	res, err := client.Get(url)
-	defer res.Body.Close()
 	if err != nil {
 		return "", err
 	}
+	defer res.Body.Close()
 
 	//Read all of the data
 	byteStr, err := ioutil.ReadAll(res.Body)
@@ -133,10 +133,10 @@ func getURL(url string) (string, error) {
 func downloadFile(filepath, url string) error {
 	// Get the data
 	resp, err := http.Get(url)
-	defer resp.Body.Close()
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
 	// Create the file
 	out, err := os.Create(filepath)
@@ -1,4 +1,4 @@
-let socket = new WebSocket("ws://localhost:8080/api/ws/server/1");
+let socket = new WebSocket("ws://localhost:8080/api/ws/server/1?mode=raw");
 
 socket.onopen = function (e) {
     socket.send("/say hello world!");